@@ -0,0 +1,264 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scopes a key can be granted. Admin implies every other scope.
+const (
+	ScopeReadStream          = "stream:read"
+	ScopeManageSubscriptions = "subscriptions:manage"
+	ScopeAdmin               = "admin"
+)
+
+var Scopes = []string{ScopeReadStream, ScopeManageSubscriptions, ScopeAdmin}
+
+// DefaultTier is the rate limit tier of keys created without one
+const DefaultTier = "default"
+
+const (
+	keyPrefix   = "kf"
+	idBytes     = 6
+	secretBytes = 24
+
+	// Keys and the index share a hash tag, they are changed together in transactions
+	redisKeyPrefix = "{apikeys}:"
+	redisIndexKey  = "{apikeys}"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid API key")
+	ErrNotFound   = errors.New("API key not found")
+)
+
+// Key is the stored part of an API key. The secret itself is never stored, only its SHA-256 hash,
+// which is enough since keys are random and not guessable.
+type Key struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tier selects the rate limits of the key
+	Tier      string    `json:"tier"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasScope reports whether the key grants scope
+func (k Key) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+func IsScope(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+// Store keeps API keys in Redis, one hash per key plus a set of all key IDs
+type Store struct {
+	rdb redis.Cmdable
+}
+
+func NewStore(rdb redis.Cmdable) *Store {
+	return &Store{rdb: rdb}
+}
+
+// Create generates a new key and returns it together with the secret key string, which is only
+// available at this point
+func (s *Store) Create(ctx context.Context, name string, scopes []string, tier string) (Key, string, error) {
+	if tier == "" {
+		tier = DefaultTier
+	}
+
+	if name == "" {
+		return Key{}, "", errors.New("missing key name")
+	}
+
+	if len(scopes) == 0 {
+		return Key{}, "", errors.New("missing key scopes")
+	}
+
+	for _, scope := range scopes {
+		if !IsScope(scope) {
+			return Key{}, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	id, err := randomString(idBytes, hex.EncodeToString)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	secret, err := randomString(secretBytes, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	raw := fmt.Sprintf("%s_%s_%s", keyPrefix, id, secret)
+
+	scopes = slices.Clone(scopes)
+	sort.Strings(scopes)
+
+	key := Key{
+		ID:        id,
+		Name:      name,
+		Scopes:    slices.Compact(scopes),
+		Tier:      tier,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisKeyPrefix+id, map[string]any{
+			"name":       key.Name,
+			"scopes":     strings.Join(key.Scopes, ","),
+			"tier":       key.Tier,
+			"hash":       hash(raw),
+			"created_at": key.CreatedAt.Format(time.RFC3339),
+		})
+		pipe.SAdd(ctx, redisIndexKey, id)
+		return nil
+	})
+	if err != nil {
+		return Key{}, "", fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return key, raw, nil
+}
+
+// Authenticate returns the key a key string belongs to, or ErrInvalidKey for unknown or revoked keys
+func (s *Store) Authenticate(ctx context.Context, raw string) (Key, error) {
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return Key{}, ErrInvalidKey
+	}
+
+	fields, err := s.rdb.HGetAll(ctx, redisKeyPrefix+parts[1]).Result()
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to read API key: %w", err)
+	}
+
+	if len(fields) == 0 || subtle.ConstantTimeCompare([]byte(fields["hash"]), []byte(hash(raw))) != 1 {
+		return Key{}, ErrInvalidKey
+	}
+
+	return decodeKey(parts[1], fields)
+}
+
+// Get returns the key with id, or ErrNotFound when there is none
+func (s *Store) Get(ctx context.Context, id string) (Key, error) {
+	fields, err := s.rdb.HGetAll(ctx, redisKeyPrefix+id).Result()
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to read API key: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return Key{}, ErrNotFound
+	}
+
+	return decodeKey(id, fields)
+}
+
+// List returns all keys ordered by creation time
+func (s *Store) List(ctx context.Context) ([]Key, error) {
+	ids, err := s.rdb.SMembers(ctx, redisIndexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+
+	pipe := s.rdb.Pipeline()
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, redisKeyPrefix+id)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	keys := []Key{}
+	for i, cmd := range cmds {
+		// Index entries can outlive their key if a revocation was interrupted
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+
+		key, err := decodeKey(ids[i], cmd.Val())
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+// Revoke deletes a key, requests using it fail from then on
+func (s *Store) Revoke(ctx context.Context, id string) error {
+	var deleted *redis.IntCmd
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, redisKeyPrefix+id)
+		pipe.SRem(ctx, redisIndexKey, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	if deleted.Val() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func decodeKey(id string, fields map[string]string) (Key, error) {
+	createdAt, err := time.Parse(time.RFC3339, fields["created_at"])
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to parse creation time of API key %s: %w", id, err)
+	}
+
+	// Keys created before tiers existed use the default tier
+	tier := fields["tier"]
+	if tier == "" {
+		tier = DefaultTier
+	}
+
+	return Key{
+		ID:        id,
+		Name:      fields["name"],
+		Scopes:    strings.Split(fields["scopes"], ","),
+		Tier:      tier,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random key: %w", err)
+	}
+
+	return encode(buf), nil
+}
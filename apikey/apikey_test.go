@@ -0,0 +1,204 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return NewStore(rdb), server
+}
+
+func TestCreateStoresOnlyTheHash(t *testing.T) {
+	store, server := newTestStore(t)
+
+	key, raw, err := store.Create(context.Background(), "test", []string{ScopeReadStream}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	if !strings.HasPrefix(raw, keyPrefix+"_"+key.ID+"_") {
+		t.Fatalf("key string %q does not carry the key ID %s", raw, key.ID)
+	}
+
+	if key.Tier != DefaultTier {
+		t.Fatalf("expected the default tier, got %q", key.Tier)
+	}
+
+	if stored := server.HGet(redisKeyPrefix+key.ID, "hash"); stored != hash(raw) {
+		t.Fatalf("expected the SHA-256 hash of the key to be stored, got %q", stored)
+	}
+
+	fields, err := server.HKeys(redisKeyPrefix + key.ID)
+	if err != nil {
+		t.Fatalf("failed to read stored key: %v", err)
+	}
+
+	secret := raw[strings.LastIndex(raw, "_")+1:]
+	for _, field := range fields {
+		if strings.Contains(server.HGet(redisKeyPrefix+key.ID, field), secret) {
+			t.Fatalf("secret stored in field %s", field)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	key, raw, err := store.Create(ctx, "test", []string{ScopeReadStream, ScopeManageSubscriptions}, "partner")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	authenticated, err := store.Authenticate(ctx, raw)
+	if err != nil {
+		t.Fatalf("failed to authenticate key: %v", err)
+	}
+
+	if authenticated.ID != key.ID || authenticated.Tier != "partner" || len(authenticated.Scopes) != 2 {
+		t.Fatalf("expected %+v, got %+v", key, authenticated)
+	}
+
+	// The ID alone does not authenticate, the whole key string has to match the stored hash
+	invalid := []string{
+		"",
+		raw[:len(raw)-1],
+		raw + "x",
+		keyPrefix + "_" + key.ID + "_",
+		"xx_" + strings.TrimPrefix(raw, keyPrefix+"_"),
+		keyPrefix + "_unknown_" + raw[strings.LastIndex(raw, "_")+1:],
+	}
+
+	for _, raw := range invalid {
+		if _, err := store.Authenticate(ctx, raw); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("expected ErrInvalidKey for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestCreateValidatesScopes(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	if _, _, err := store.Create(context.Background(), "test", []string{"stream:write"}, ""); err == nil {
+		t.Fatal("key with an unknown scope created")
+	}
+
+	if _, _, err := store.Create(context.Background(), "test", nil, ""); err == nil {
+		t.Fatal("key without scopes created")
+	}
+
+	key, _, err := store.Create(context.Background(), "test", []string{ScopeReadStream, ScopeReadStream}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	if len(key.Scopes) != 1 {
+		t.Fatalf("expected duplicate scopes to be merged, got %v", key.Scopes)
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	read := Key{Scopes: []string{ScopeReadStream}}
+	admin := Key{Scopes: []string{ScopeAdmin}}
+
+	if !read.HasScope(ScopeReadStream) || read.HasScope(ScopeManageSubscriptions) || read.HasScope(ScopeAdmin) {
+		t.Fatalf("read key grants %v", read.Scopes)
+	}
+
+	// Admin implies every other scope
+	for _, scope := range Scopes {
+		if !admin.HasScope(scope) {
+			t.Fatalf("admin key lacks the %s scope", scope)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	key, raw, err := store.Create(ctx, "test", []string{ScopeReadStream}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	if err := store.Revoke(ctx, key.ID); err != nil {
+		t.Fatalf("failed to revoke key: %v", err)
+	}
+
+	if _, err := store.Authenticate(ctx, raw); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("revoked key authenticated: %v", err)
+	}
+
+	if _, err := store.Get(ctx, key.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a revoked key, got %v", err)
+	}
+
+	if err := store.Revoke(ctx, key.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound when revoking twice, got %v", err)
+	}
+
+	keys, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+
+	if len(keys) != 0 {
+		t.Fatalf("revoked key still listed: %+v", keys)
+	}
+}
+
+func TestListDoesNotLeakSecrets(t *testing.T) {
+	store, server := newTestStore(t)
+	ctx := context.Background()
+
+	raws := []string{}
+	for _, name := range []string{"first", "second"} {
+		_, raw, err := store.Create(ctx, name, []string{ScopeReadStream}, "")
+		if err != nil {
+			t.Fatalf("failed to create key: %v", err)
+		}
+
+		raws = append(raws, raw)
+	}
+
+	// An index entry whose key is gone is skipped
+	server.SAdd(redisIndexKey, "gone")
+
+	keys, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %+v", keys)
+	}
+
+	encoded, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatalf("failed to encode keys: %v", err)
+	}
+
+	for _, raw := range raws {
+		if strings.Contains(string(encoded), raw) || strings.Contains(string(encoded), hash(raw)) {
+			t.Fatalf("listed keys leak a secret or hash: %s", encoded)
+		}
+	}
+
+	if strings.Contains(string(encoded), `"hash"`) {
+		t.Fatalf("listed keys contain a hash field: %s", encoded)
+	}
+}
@@ -0,0 +1,338 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"killfeed"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Killmails are stored as gzip or zstd compressed JSON Lines files partitioned by the UTC day of
+// the kill. Every batch additionally writes an index object per range of killmail IDs it holds,
+// pointing each killmail at the file and line holding it.
+const (
+	dataPrefix  = "killmails/"
+	indexPrefix = "index/"
+
+	// indexRangeSize keeps the index objects of a range few enough to list them on every lookup,
+	// a batch from the live stream usually falls into a single range
+	indexRangeSize = 10_000
+)
+
+// File suffixes tell the compression of a file, so archives can mix both
+const (
+	gzipSuffix = ".jsonl.gz"
+	zstdSuffix = ".jsonl.zst"
+)
+
+var ErrKillmailNotFound = errors.New("killmail not found in archive")
+
+type indexEntry struct {
+	Key  string `json:"key"`
+	Line int    `json:"line"`
+}
+
+type Archive struct {
+	store       Store
+	compression string
+}
+
+// New opens an archive that writes files with the given compression, either
+// killfeed.ArchiveCompressionGzip or killfeed.ArchiveCompressionZstd
+func New(store Store, compression string) *Archive {
+	return &Archive{store: store, compression: compression}
+}
+
+// NewFromConfig opens the archive configured through ARCHIVE_URL and the ARCHIVE_S3_* settings
+func NewFromConfig(config killfeed.ArchiveConfig) (*Archive, error) {
+	if config.ArchiveURL == "" {
+		return nil, errors.New("missing archive url")
+	}
+
+	store, err := OpenStore(config.ArchiveURL, S3Options{
+		Endpoint:  config.ArchiveS3Endpoint,
+		Region:    config.ArchiveS3Region,
+		AccessKey: config.ArchiveS3AccessKey,
+		SecretKey: config.ArchiveS3SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return New(store, config.ArchiveCompression), nil
+}
+
+// DayPrefix returns the key prefix of all files holding kills of the given UTC day
+func DayPrefix(day time.Time) string {
+	return dataPrefix + day.UTC().Format("2006/01/02") + "/"
+}
+
+func indexRangePrefix(killmailID int32) string {
+	return fmt.Sprintf("%s%d/", indexPrefix, killmailID/indexRangeSize)
+}
+
+// indexKey names the index object of a batch by the lowest and highest killmail ID it covers, so
+// lookups only read the objects that can hold a killmail
+func indexKey(batchID string, first int32, last int32) string {
+	return fmt.Sprintf("%s%d-%d-%s.json", indexRangePrefix(first), first, last, batchID)
+}
+
+// indexCovers reports whether the index object at key can hold the killmail
+func indexCovers(key string, killmailID int32) bool {
+	name := key[strings.LastIndex(key, "/")+1:]
+
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return false
+	}
+
+	first, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return false
+	}
+
+	last, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return false
+	}
+
+	return int64(killmailID) >= first && int64(killmailID) <= last
+}
+
+func (a *Archive) fileSuffix() string {
+	if a.compression == killfeed.ArchiveCompressionZstd {
+		return zstdSuffix
+	}
+
+	return gzipSuffix
+}
+
+// WriteBatch archives a batch of killmails. The batch ID must be unique per batch, writing the
+// same batch ID again overwrites the previous files.
+func (a *Archive) WriteBatch(ctx context.Context, batchID string, killmails []killfeed.CombinedKillmail) error {
+	days := map[string][]killfeed.CombinedKillmail{}
+	for _, killmail := range killmails {
+		prefix := DayPrefix(killmail.KillmailTime)
+		days[prefix] = append(days[prefix], killmail)
+	}
+
+	// Index entries are collected by ID range, so a batch writes one index object per range
+	ranges := map[int32]map[int32]indexEntry{}
+
+	for prefix, dayKillmails := range days {
+		key := prefix + batchID + a.fileSuffix()
+
+		data, err := a.encodeKillmails(dayKillmails)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", key, err)
+		}
+
+		if err := a.store.Put(ctx, key, data); err != nil {
+			return err
+		}
+
+		for line, killmail := range dayKillmails {
+			idRange := killmail.KillmailId / indexRangeSize
+			if ranges[idRange] == nil {
+				ranges[idRange] = map[int32]indexEntry{}
+			}
+
+			ranges[idRange][killmail.KillmailId] = indexEntry{Key: key, Line: line}
+		}
+	}
+
+	for _, entries := range ranges {
+		first, last := int32(-1), int32(-1)
+		for killmailID := range entries {
+			if first == -1 || killmailID < first {
+				first = killmailID
+			}
+
+			last = max(last, killmailID)
+		}
+
+		key := indexKey(batchID, first, last)
+
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", key, err)
+		}
+
+		if err := a.store.Put(ctx, key, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get looks up a single archived killmail through the index
+func (a *Archive) Get(ctx context.Context, killmailID int32) (killfeed.CombinedKillmail, error) {
+	entry, err := a.lookup(ctx, killmailID)
+	if err != nil {
+		return killfeed.CombinedKillmail{}, err
+	}
+
+	killmails, err := a.ReadFile(ctx, entry.Key)
+	if err != nil {
+		return killfeed.CombinedKillmail{}, err
+	}
+
+	if entry.Line < len(killmails) && killmails[entry.Line].KillmailId == killmailID {
+		return killmails[entry.Line], nil
+	}
+
+	// Fall back to scanning in case the file was rewritten with a different layout
+	for _, killmail := range killmails {
+		if killmail.KillmailId == killmailID {
+			return killmail, nil
+		}
+	}
+
+	return killfeed.CombinedKillmail{}, ErrKillmailNotFound
+}
+
+// lookup finds the index entry of a killmail in the index objects of its ID range
+func (a *Archive) lookup(ctx context.Context, killmailID int32) (indexEntry, error) {
+	keys, err := a.store.List(ctx, indexRangePrefix(killmailID))
+	if err != nil {
+		return indexEntry{}, err
+	}
+
+	// Later batches win, a killmail archived twice is read from its latest file
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !indexCovers(keys[i], killmailID) {
+			continue
+		}
+
+		data, err := a.store.Get(ctx, keys[i])
+		if err != nil {
+			return indexEntry{}, err
+		}
+
+		var entries map[int32]indexEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return indexEntry{}, fmt.Errorf("failed to decode %s: %w", keys[i], err)
+		}
+
+		if entry, ok := entries[killmailID]; ok {
+			return entry, nil
+		}
+	}
+
+	return indexEntry{}, ErrKillmailNotFound
+}
+
+// ListDay returns the keys of all files holding kills of the given UTC day
+func (a *Archive) ListDay(ctx context.Context, day time.Time) ([]string, error) {
+	keys, err := a.store.List(ctx, DayPrefix(day))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, key := range keys {
+		if strings.HasSuffix(key, gzipSuffix) || strings.HasSuffix(key, zstdSuffix) {
+			files = append(files, key)
+		}
+	}
+
+	return files, nil
+}
+
+// ReadFile reads and decodes all killmails of an archived file
+func (a *Archive) ReadFile(ctx context.Context, key string) ([]killfeed.CombinedKillmail, error) {
+	data, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	killmails, err := decodeKillmails(data, strings.HasSuffix(key, zstdSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+
+	return killmails, nil
+}
+
+func (a *Archive) encodeKillmails(killmails []killfeed.CombinedKillmail) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var compressor io.WriteCloser
+	if a.compression == killfeed.ArchiveCompressionZstd {
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+
+		compressor = encoder
+	} else {
+		compressor = gzip.NewWriter(&buf)
+	}
+
+	encoder := json.NewEncoder(compressor)
+
+	for _, killmail := range killmails {
+		if err := encoder.Encode(killmail); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeKillmails(data []byte, zstdCompressed bool) ([]killfeed.CombinedKillmail, error) {
+	var decompressor io.Reader
+	if zstdCompressed {
+		decoder, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		defer decoder.Close()
+		decompressor = decoder
+	} else {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+		decompressor = gz
+	}
+
+	killmails := []killfeed.CombinedKillmail{}
+
+	scanner := bufio.NewScanner(decompressor)
+	// Killmails of big fights easily exceed the default line limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var killmail killfeed.CombinedKillmail
+		if err := json.Unmarshal(scanner.Bytes(), &killmail); err != nil {
+			return nil, err
+		}
+
+		killmails = append(killmails, killmail)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return killmails, nil
+}
@@ -0,0 +1,200 @@
+package archive
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"killfeed"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Server stands in for MinIO, it serves path-style object requests and ListObjectsV2 of one bucket
+type s3Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func newS3Server(t *testing.T, bucket string) *s3Server {
+	s := &s3Server{objects: map[string][]byte{}}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.URL.Path, "/"+bucket)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		key = strings.TrimPrefix(key, "/")
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			s.objects[key] = data
+			s.puts++
+
+		case r.Method == http.MethodGet && key == "":
+			result := struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []struct {
+					Key string `xml:"Key"`
+				} `xml:"Contents"`
+			}{}
+
+			prefix := r.URL.Query().Get("prefix")
+			for objectKey := range s.objects {
+				if strings.HasPrefix(objectKey, prefix) {
+					result.Contents = append(result.Contents, struct {
+						Key string `xml:"Key"`
+					}{Key: objectKey})
+				}
+			}
+
+			slices.SortFunc(result.Contents, func(a, b struct {
+				Key string `xml:"Key"`
+			}) int {
+				return strings.Compare(a.Key, b.Key)
+			})
+
+			xml.NewEncoder(w).Encode(result)
+
+		case r.Method == http.MethodGet:
+			data, ok := s.objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			w.Write(data)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *s3Server) putCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.puts
+}
+
+func testKillmails(day time.Time, ids ...int32) []killfeed.CombinedKillmail {
+	killmails := []killfeed.CombinedKillmail{}
+	for i, id := range ids {
+		killmails = append(killmails, killfeed.CombinedKillmail{KillmailId: id, KillmailTime: day.Add(time.Duration(i) * time.Minute)})
+	}
+
+	return killmails
+}
+
+func TestS3Store(t *testing.T) {
+	server := newS3Server(t, "archive")
+
+	store, err := OpenStore("s3://archive/killfeed", S3Options{Endpoint: server.URL, AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	archive := New(store, killfeed.ArchiveCompressionZstd)
+	ctx := context.Background()
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := archive.WriteBatch(ctx, "batch", testKillmails(day, 1001, 1002, 1003)); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	// One data file and one index object, however many killmails the batch holds
+	if puts := server.putCount(); puts != 2 {
+		t.Fatalf("expected 2 objects written, got %d", puts)
+	}
+
+	keys, err := archive.ListDay(ctx, day)
+	if err != nil || len(keys) != 1 || !strings.HasSuffix(keys[0], zstdSuffix) {
+		t.Fatalf("expected one zstd file, got %v: %v", keys, err)
+	}
+
+	killmail, err := archive.Get(ctx, 1002)
+	if err != nil || killmail.KillmailId != 1002 {
+		t.Fatalf("failed to get killmail: %+v %v", killmail, err)
+	}
+
+	if _, err := archive.Get(ctx, 1004); !errors.Is(err, ErrKillmailNotFound) {
+		t.Fatalf("expected ErrKillmailNotFound, got %v", err)
+	}
+}
+
+func TestArchiveReadsBothCompressions(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+	ctx := context.Background()
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := New(store, killfeed.ArchiveCompressionGzip).WriteBatch(ctx, "gzip", testKillmails(day, 1)); err != nil {
+		t.Fatalf("failed to write gzip batch: %v", err)
+	}
+
+	// Switching the compression leaves existing files readable
+	archive := New(store, killfeed.ArchiveCompressionZstd)
+	if err := archive.WriteBatch(ctx, "zstd", testKillmails(day.Add(time.Hour), 2)); err != nil {
+		t.Fatalf("failed to write zstd batch: %v", err)
+	}
+
+	for _, id := range []int32{1, 2} {
+		if killmail, err := archive.Get(ctx, id); err != nil || killmail.KillmailId != id {
+			t.Fatalf("failed to get killmail %d: %v", id, err)
+		}
+	}
+
+	killmails, _, err := archive.Search(ctx, day, day.Add(24*time.Hour), "", "", 10, matchAll)
+	if err != nil || len(killmails) != 2 {
+		t.Fatalf("expected both killmails, got %d: %v", len(killmails), err)
+	}
+}
+
+func TestIndexSplitsByRange(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+	archive := New(store, killfeed.ArchiveCompressionGzip)
+	ctx := context.Background()
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := archive.WriteBatch(ctx, "first", testKillmails(day, indexRangeSize-1, indexRangeSize)); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	// A later batch of the same range does not shadow killmails of the earlier one
+	if err := archive.WriteBatch(ctx, "second", testKillmails(day, indexRangeSize+1)); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	keys, err := store.List(ctx, indexPrefix)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("expected an index object per batch and range, got %v: %v", keys, err)
+	}
+
+	for _, id := range []int32{indexRangeSize - 1, indexRangeSize, indexRangeSize + 1} {
+		if killmail, err := archive.Get(ctx, id); err != nil || killmail.KillmailId != id {
+			t.Fatalf("failed to get killmail %d: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"killfeed"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchMaxFiles bounds the files read by one search request, so a selective query over a long
+// range returns a cursor to continue with instead of reading the whole range at once
+const searchMaxFiles = 32
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// position points at a line of an archived file
+type position struct {
+	key  string
+	line int
+}
+
+// queryHash identifies a search in its cursors, so a cursor cannot continue a different search
+func queryHash(from time.Time, to time.Time, query string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%d\n%s", from.UnixNano(), to.UnixNano(), query)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(hash string, pos position) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s\n%s\n%d", hash, pos.key, pos.line)))
+}
+
+func decodeCursor(cursor string, hash string) (position, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(data), "\n")
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], dataPrefix) {
+		return position{}, ErrInvalidCursor
+	}
+
+	if parts[0] != hash {
+		return position{}, fmt.Errorf("%w: cursor belongs to a different search", ErrInvalidCursor)
+	}
+
+	key, rawLine := parts[1], parts[2]
+
+	line, err := strconv.Atoi(rawLine)
+	if err != nil {
+		return position{}, ErrInvalidCursor
+	}
+
+	return position{key: key, line: line}, nil
+}
+
+// Search scans the archived kills between from and to and returns up to limit killmails accepted
+// by match, in archive order. The returned cursor continues the search where it stopped and is
+// empty once the range is exhausted. A search stops after reading searchMaxFiles files, so it can
+// return fewer than limit killmails, or none, together with a cursor.
+//
+// query describes the criteria checked by match, cursors are only accepted by searches with the
+// same range and query.
+func (a *Archive) Search(ctx context.Context, from time.Time, to time.Time, query string, cursor string, limit int, match func(killfeed.CombinedKillmail) (bool, error)) ([]killfeed.CombinedKillmail, string, error) {
+	hash := queryHash(from, to, query)
+
+	var after *position
+	if cursor != "" {
+		pos, err := decodeCursor(cursor, hash)
+		if err != nil {
+			return nil, "", err
+		}
+
+		after = &pos
+	}
+
+	killmails := []killfeed.CombinedKillmail{}
+	files := 0
+
+	from, to = from.UTC(), to.UTC()
+	for day := from.Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		// Keys sort chronologically, so whole days before the cursor can be skipped without listing them
+		if prefix := DayPrefix(day); after != nil && prefix < after.key && !strings.HasPrefix(after.key, prefix) {
+			continue
+		}
+
+		keys, err := a.ListDay(ctx, day)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, key := range keys {
+			if after != nil && key < after.key {
+				continue
+			}
+
+			// The next search starts with the first file this one did not read
+			if files == searchMaxFiles {
+				return killmails, encodeCursor(hash, position{key: key, line: -1}), nil
+			}
+
+			files++
+
+			fileKillmails, err := a.ReadFile(ctx, key)
+			if err != nil {
+				return nil, "", err
+			}
+
+			for line, killmail := range fileKillmails {
+				if after != nil && key == after.key && line <= after.line {
+					continue
+				}
+
+				if killmail.KillmailTime.Before(from) || killmail.KillmailTime.After(to) {
+					continue
+				}
+
+				ok, err := match(killmail)
+				if err != nil {
+					return nil, "", err
+				}
+
+				if !ok {
+					continue
+				}
+
+				killmails = append(killmails, killmail)
+				if len(killmails) == limit {
+					return killmails, encodeCursor(hash, position{key: key, line: line}), nil
+				}
+			}
+		}
+	}
+
+	return killmails, "", nil
+}
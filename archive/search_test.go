@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+	"testing"
+	"time"
+)
+
+// writeFiles archives one killmail per file, so searches read a file per killmail
+func writeFiles(t *testing.T, archive *Archive, day time.Time, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		killmail := killfeed.CombinedKillmail{KillmailId: int32(i + 1), KillmailTime: day.Add(time.Duration(i) * time.Minute), SolarSystemId: int32(30000000 + i%2)}
+		if err := archive.WriteBatch(context.Background(), fmt.Sprintf("batch-%03d", i), []killfeed.CombinedKillmail{killmail}); err != nil {
+			t.Fatalf("failed to write batch: %v", err)
+		}
+	}
+}
+
+func matchAll(killfeed.CombinedKillmail) (bool, error) {
+	return true, nil
+}
+
+func TestSearchLimitsFilesPerRequest(t *testing.T) {
+	archive := New(NewDirStore(t.TempDir()), killfeed.ArchiveCompressionGzip)
+	ctx := context.Background()
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	writeFiles(t, archive, day, searchMaxFiles+8)
+
+	// Only every other killmail matches, so the file limit is reached before the killmail limit
+	match := func(killmail killfeed.CombinedKillmail) (bool, error) {
+		return killmail.SolarSystemId == 30000000, nil
+	}
+
+	killmails, cursor, err := archive.Search(ctx, day, day.Add(24*time.Hour), "system=30000000", "", 1000, match)
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	if len(killmails) != searchMaxFiles/2 || cursor == "" {
+		t.Fatalf("expected %d killmails and a cursor, got %d and %q", searchMaxFiles/2, len(killmails), cursor)
+	}
+
+	killmails, cursor, err = archive.Search(ctx, day, day.Add(24*time.Hour), "system=30000000", cursor, 1000, match)
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+
+	if len(killmails) != 4 || cursor != "" {
+		t.Fatalf("expected the remaining 4 killmails without a cursor, got %d and %q", len(killmails), cursor)
+	}
+
+	if killmails[0].KillmailId != searchMaxFiles+1 {
+		t.Fatalf("continued search did not start after the last file read: %d", killmails[0].KillmailId)
+	}
+}
+
+func TestSearchContinuesWithinFile(t *testing.T) {
+	archive := New(NewDirStore(t.TempDir()), killfeed.ArchiveCompressionGzip)
+	ctx := context.Background()
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	killmails := []killfeed.CombinedKillmail{}
+	for i := 1; i <= 5; i++ {
+		killmails = append(killmails, killfeed.CombinedKillmail{KillmailId: int32(i), KillmailTime: day.Add(time.Duration(i) * time.Hour)})
+	}
+
+	if err := archive.WriteBatch(ctx, "batch", killmails); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	var ids []int32
+	cursor := ""
+	for {
+		page, next, err := archive.Search(ctx, day, day.Add(24*time.Hour), "", cursor, 2, matchAll)
+		if err != nil {
+			t.Fatalf("search failed: %v", err)
+		}
+
+		for _, killmail := range page {
+			ids = append(ids, killmail.KillmailId)
+		}
+
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+		t.Fatalf("pages skipped or repeated killmails: %v", ids)
+	}
+}
+
+func TestSearchRejectsCursorOfOtherSearch(t *testing.T) {
+	archive := New(NewDirStore(t.TempDir()), killfeed.ArchiveCompressionGzip)
+	ctx := context.Background()
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	writeFiles(t, archive, day, 3)
+
+	_, cursor, err := archive.Search(ctx, day, day.Add(24*time.Hour), "character=1", "", 1, matchAll)
+	if err != nil || cursor == "" {
+		t.Fatalf("expected a cursor: %v", err)
+	}
+
+	for name, search := range map[string]func() error{
+		"other query": func() error {
+			_, _, err := archive.Search(ctx, day, day.Add(24*time.Hour), "character=2", cursor, 1, matchAll)
+			return err
+		},
+		"other range": func() error {
+			_, _, err := archive.Search(ctx, day, day.Add(12*time.Hour), "character=1", cursor, 1, matchAll)
+			return err
+		},
+		"garbage": func() error {
+			_, _, err := archive.Search(ctx, day, day.Add(24*time.Hour), "character=1", "not a cursor", 1, matchAll)
+			return err
+		},
+	} {
+		if err := search(); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("%s: expected ErrInvalidCursor, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Store is a flat key/value object store, either a local directory or an S3-compatible bucket
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys starting with prefix in lexical order
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// S3Options are the connection settings used for s3:// archive URLs
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// OpenStore opens the store for an archive URL, either file:///path/to/dir or s3://bucket/prefix
+func OpenStore(rawURL string, s3Options S3Options) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse archive url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file", "":
+		if u.Path == "" {
+			return nil, errors.New("missing archive directory")
+		}
+
+		return NewDirStore(u.Path), nil
+
+	case "s3":
+		if u.Host == "" {
+			return nil, errors.New("missing archive bucket")
+		}
+
+		if s3Options.Endpoint == "" {
+			return nil, errors.New("missing S3 endpoint")
+		}
+
+		return NewS3Store(s3Options, u.Host, strings.Trim(u.Path, "/")), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported archive url scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,285 @@
+package classify
+
+import (
+	"killfeed"
+	"math"
+	"slices"
+)
+
+const (
+	TagCapital        = "capital"
+	TagSupercapital   = "supercapital"
+	TagStructure      = "structure"
+	TagPod            = "pod"
+	TagGank           = "gank"
+	TagHighsec        = "highsec"
+	TagLowsec         = "lowsec"
+	TagNullsec        = "nullsec"
+	TagWormhole       = "wormhole"
+	TagFactionWarfare = "faction-warfare"
+	TagWar            = "war"
+	TagNpcOnly        = "npc-only"
+
+	TagFleetSolo   = "fleet:solo"
+	TagFleetSmall  = "fleet:small"
+	TagFleetMedium = "fleet:medium"
+	TagFleetLarge  = "fleet:large"
+	TagFleetBlob   = "fleet:blob"
+)
+
+const (
+	groupTitan                = 30
+	groupCapsule              = 29
+	groupDreadnought          = 485
+	groupCarrier              = 547
+	groupSupercarrier         = 659
+	groupCapitalIndustrial    = 883
+	groupForceAuxiliary       = 1538
+	groupLancerDreadnought    = 4594
+	categoryStarbase          = 23
+	categorySovereignty       = 40
+	categoryStructure         = 65
+	corporationConcord        = 1000125
+	factionConcord            = 500006
+	wormholeSystemMin         = 31_000_000
+	wormholeSystemMax         = 31_999_999
+	wormholeRegionMin         = 11_000_001
+	factionWarfareCaldari     = 500001
+	factionWarfareMinmatar    = 500002
+	factionWarfareAmarr       = 500003
+	factionWarfareGallente    = 500004
+	factionWarfareGuristas    = 500010
+	factionWarfareAngelCartel = 500011
+)
+
+// Ship is the static data of a ship type needed by the rules
+type Ship struct {
+	TypeID     int32
+	GroupID    int32
+	CategoryID int32
+}
+
+// System is the static data of a solar system needed by the rules
+type System struct {
+	ID             int32
+	SecurityStatus float32
+	RegionID       int32
+}
+
+// Input is a killmail together with the resolved static data of the ships and system involved.
+// AttackerShips is indexed like Killmail.Attackers.
+type Input struct {
+	Killmail      killfeed.Killmail
+	VictimShip    Ship
+	AttackerShips []Ship
+	System        System
+}
+
+// Rule returns the tags that apply to a killmail
+type Rule func(in Input) []string
+
+var DefaultRules = []Rule{
+	ShipClassRule,
+	StructureRule,
+	PodRule,
+	SecurityRule,
+	WormholeRule,
+	GankRule,
+	FleetSizeRule,
+	FactionWarfareRule,
+	WarRule,
+	NpcOnlyRule,
+}
+
+// Classify runs the rules against the input and returns the sorted, deduplicated tags
+func Classify(in Input, rules []Rule) []string {
+	tags := []string{}
+	for _, rule := range rules {
+		tags = append(tags, rule(in)...)
+	}
+
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// ShipClassRule tags capital and supercapital involvement on either side. Supercapitals are
+// also tagged as capitals.
+func ShipClassRule(in Input) []string {
+	tags := []string{}
+	for _, ship := range append([]Ship{in.VictimShip}, in.AttackerShips...) {
+		switch ship.GroupID {
+		case groupTitan, groupSupercarrier:
+			tags = append(tags, TagCapital, TagSupercapital)
+		case groupCarrier, groupDreadnought, groupLancerDreadnought, groupForceAuxiliary, groupCapitalIndustrial:
+			tags = append(tags, TagCapital)
+		}
+	}
+
+	return tags
+}
+
+func StructureRule(in Input) []string {
+	switch in.VictimShip.CategoryID {
+	case categoryStructure, categoryStarbase, categorySovereignty:
+		return []string{TagStructure}
+	}
+
+	return nil
+}
+
+func PodRule(in Input) []string {
+	if in.VictimShip.GroupID == groupCapsule {
+		return []string{TagPod}
+	}
+
+	return nil
+}
+
+func SecurityRule(in Input) []string {
+	if in.System.ID == 0 || isWormholeSystem(in.System.ID) {
+		return nil
+	}
+
+	switch security := roundSecurity(in.System.SecurityStatus); {
+	case security >= 0.5:
+		return []string{TagHighsec}
+	case security > 0:
+		return []string{TagLowsec}
+	default:
+		return []string{TagNullsec}
+	}
+}
+
+// WormholeRule tags kills in J-space with their wormhole class, derived from the region
+func WormholeRule(in Input) []string {
+	if !isWormholeSystem(in.Killmail.SolarSystemId) {
+		return nil
+	}
+
+	tags := []string{TagWormhole}
+	if class := wormholeClass(in.System.RegionID); class != "" {
+		tags = append(tags, "wh:"+class)
+	}
+
+	return tags
+}
+
+// GankRule tags high-sec kills where CONCORD shows up on the killmail
+func GankRule(in Input) []string {
+	if in.System.ID == 0 || isWormholeSystem(in.System.ID) || roundSecurity(in.System.SecurityStatus) < 0.5 {
+		return nil
+	}
+
+	for _, attacker := range in.Killmail.Attackers {
+		if attacker.CorporationId == corporationConcord || attacker.FactionId == factionConcord {
+			return []string{TagGank}
+		}
+	}
+
+	return nil
+}
+
+func FleetSizeRule(in Input) []string {
+	switch count := len(in.Killmail.Attackers); {
+	case count == 0:
+		return nil
+	case count == 1:
+		return []string{TagFleetSolo}
+	case count < 10:
+		return []string{TagFleetSmall}
+	case count < 30:
+		return []string{TagFleetMedium}
+	case count < 100:
+		return []string{TagFleetLarge}
+	default:
+		return []string{TagFleetBlob}
+	}
+}
+
+// FactionWarfareRule tags kills between pilots enlisted in opposing militias
+func FactionWarfareRule(in Input) []string {
+	if !isFactionWarfareFaction(in.Killmail.Victim.FactionId) {
+		return nil
+	}
+
+	for _, attacker := range in.Killmail.Attackers {
+		if attacker.CharacterId != 0 && isFactionWarfareFaction(attacker.FactionId) && attacker.FactionId != in.Killmail.Victim.FactionId {
+			return []string{TagFactionWarfare}
+		}
+	}
+
+	return nil
+}
+
+func WarRule(in Input) []string {
+	if in.Killmail.WarId != 0 {
+		return []string{TagWar}
+	}
+
+	return nil
+}
+
+func NpcOnlyRule(in Input) []string {
+	if len(in.Killmail.Attackers) == 0 {
+		return nil
+	}
+
+	for _, attacker := range in.Killmail.Attackers {
+		if attacker.CharacterId != 0 {
+			return nil
+		}
+	}
+
+	return []string{TagNpcOnly}
+}
+
+// roundSecurity rounds the security status the same way the game client displays it, to one
+// decimal except for systems just above 0, which are shown as 0.1 and are low-sec rather than
+// null-sec
+func roundSecurity(security float32) float64 {
+	if security > 0 && security < 0.05 {
+		return 0.1
+	}
+
+	return math.Round(float64(security)*10) / 10
+}
+
+func isWormholeSystem(systemID int32) bool {
+	return systemID >= wormholeSystemMin && systemID <= wormholeSystemMax
+}
+
+func wormholeClass(regionID int32) string {
+	switch offset := regionID - wormholeRegionMin; {
+	case offset < 0:
+		return ""
+	case offset < 3:
+		return "c1"
+	case offset < 8:
+		return "c2"
+	case offset < 15:
+		return "c3"
+	case offset < 23:
+		return "c4"
+	case offset < 29:
+		return "c5"
+	case offset < 30:
+		return "c6"
+	case offset < 31:
+		return "thera"
+	case offset < 32:
+		return "c13"
+	case offset < 33:
+		return "drifter"
+	default:
+		return ""
+	}
+}
+
+func isFactionWarfareFaction(factionID int32) bool {
+	switch factionID {
+	case factionWarfareCaldari, factionWarfareMinmatar, factionWarfareAmarr, factionWarfareGallente, factionWarfareGuristas, factionWarfareAngelCartel:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,125 @@
+package classify
+
+import (
+	"killfeed"
+	"slices"
+	"testing"
+
+	"github.com/antihax/goesi/esi"
+)
+
+func TestSecurityRule(t *testing.T) {
+	for _, test := range []struct {
+		security float32
+		expected string
+	}{
+		{1.0, TagHighsec},
+		{0.5, TagHighsec},
+		{0.46, TagHighsec},
+		{0.44, TagLowsec},
+		{0.1, TagLowsec},
+		{0.05, TagLowsec},
+		// Shown as 0.1 in game although it rounds to 0.0
+		{0.04, TagLowsec},
+		{0.0001, TagLowsec},
+		{0, TagNullsec},
+		{-0.04, TagNullsec},
+		{-1.0, TagNullsec},
+	} {
+		tags := SecurityRule(Input{System: System{ID: 30000142, SecurityStatus: test.security}})
+		if !slices.Equal(tags, []string{test.expected}) {
+			t.Errorf("security %g: expected %s, got %v", test.security, test.expected, tags)
+		}
+	}
+
+	// Wormholes and unresolved systems have no security band
+	if tags := SecurityRule(Input{System: System{ID: 31000005, SecurityStatus: -1}}); tags != nil {
+		t.Errorf("wormhole system tagged %v", tags)
+	}
+
+	if tags := SecurityRule(Input{}); tags != nil {
+		t.Errorf("unresolved system tagged %v", tags)
+	}
+}
+
+func TestWormholeRule(t *testing.T) {
+	for regionID, expected := range map[int32][]string{
+		11000001: {TagWormhole, "wh:c1"},
+		11000003: {TagWormhole, "wh:c1"},
+		11000004: {TagWormhole, "wh:c2"},
+		11000009: {TagWormhole, "wh:c3"},
+		11000016: {TagWormhole, "wh:c4"},
+		11000024: {TagWormhole, "wh:c5"},
+		11000030: {TagWormhole, "wh:c6"},
+		11000031: {TagWormhole, "wh:thera"},
+		11000032: {TagWormhole, "wh:c13"},
+		11000033: {TagWormhole, "wh:drifter"},
+		11000034: {TagWormhole},
+		// Unresolved region
+		0: {TagWormhole},
+	} {
+		in := Input{Killmail: killfeed.Killmail{SolarSystemId: 31000005}, System: System{ID: 31000005, RegionID: regionID}}
+		if tags := WormholeRule(in); !slices.Equal(tags, expected) {
+			t.Errorf("region %d: expected %v, got %v", regionID, expected, tags)
+		}
+	}
+
+	if tags := WormholeRule(Input{Killmail: killfeed.Killmail{SolarSystemId: 30000142}}); tags != nil {
+		t.Errorf("k-space system tagged %v", tags)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	pilot := func(factionID int32) esi.GetKillmailsKillmailIdKillmailHashAttacker {
+		return esi.GetKillmailsKillmailIdKillmailHashAttacker{CharacterId: 90000001, FactionId: factionID}
+	}
+
+	highsec := System{ID: 30000142, SecurityStatus: 0.9}
+	lowsec := System{ID: 30002813, SecurityStatus: 0.3}
+
+	for name, test := range map[string]struct {
+		in       Input
+		expected []string
+	}{
+		"solo pod": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(0)}}, VictimShip: Ship{GroupID: groupCapsule}, System: lowsec},
+			expected: []string{TagFleetSolo, TagLowsec, TagPod},
+		},
+		"gank": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(0), {CorporationId: corporationConcord}}}, System: highsec},
+			expected: []string{TagFleetSmall, TagGank, TagHighsec},
+		},
+		"concord in lowsec is no gank": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{{CorporationId: corporationConcord}}}, System: lowsec},
+			expected: []string{TagFleetSolo, TagLowsec, TagNpcOnly},
+		},
+		"titan killing a carrier": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(0)}}, VictimShip: Ship{GroupID: groupCarrier}, AttackerShips: []Ship{{GroupID: groupTitan}}, System: lowsec},
+			expected: []string{TagCapital, TagFleetSolo, TagLowsec, TagSupercapital},
+		},
+		"structure": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: make([]esi.GetKillmailsKillmailIdKillmailHashAttacker, 120)}, VictimShip: Ship{CategoryID: categoryStructure}, System: System{ID: 30004759, SecurityStatus: -0.4}},
+			expected: []string{TagFleetBlob, TagNpcOnly, TagNullsec, TagStructure},
+		},
+		"faction warfare": {
+			in:       Input{Killmail: killfeed.Killmail{Victim: esi.GetKillmailsKillmailIdKillmailHashVictim{FactionId: factionWarfareCaldari}, Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(factionWarfareGallente)}}, System: lowsec},
+			expected: []string{TagFactionWarfare, TagFleetSolo, TagLowsec},
+		},
+		"same militia is no faction warfare": {
+			in:       Input{Killmail: killfeed.Killmail{Victim: esi.GetKillmailsKillmailIdKillmailHashVictim{FactionId: factionWarfareCaldari}, Attackers: []esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(factionWarfareCaldari)}}, System: lowsec},
+			expected: []string{TagFleetSolo, TagLowsec},
+		},
+		"war": {
+			in:       Input{Killmail: killfeed.Killmail{WarId: 1, Attackers: make([]esi.GetKillmailsKillmailIdKillmailHashAttacker, 15)}, System: highsec},
+			expected: []string{TagFleetMedium, TagHighsec, TagNpcOnly, TagWar},
+		},
+		"large fleet": {
+			in:       Input{Killmail: killfeed.Killmail{Attackers: slices.Repeat([]esi.GetKillmailsKillmailIdKillmailHashAttacker{pilot(0)}, 30)}, System: lowsec},
+			expected: []string{TagFleetLarge, TagLowsec},
+		},
+	} {
+		if tags := Classify(test.in, DefaultRules); !slices.Equal(tags, test.expected) {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, tags)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package classify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+	"net/http"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// Resolver looks up the static data the rules need
+type Resolver interface {
+	Ship(ctx context.Context, typeID int32) (Ship, error)
+	System(ctx context.Context, systemID int32) (System, error)
+}
+
+// ESILimiter paces ESI calls, it is implemented by ingest.ESILimiter. ESI tracks its limits per IP,
+// so the resolver should share the limiter of the other ESI callers of a process.
+type ESILimiter interface {
+	// Wait blocks while ESI calls are paused
+	Wait(ctx context.Context) error
+	// Observe updates the limiter from a response and reports whether the call should be retried
+	Observe(res *http.Response) bool
+}
+
+// esiMaxAttempts bounds the retries of a lookup the limiter asks for
+const esiMaxAttempts = 5
+
+// ESIResolver resolves static data through ESI. Static data rarely changes, so lookups are
+// cached for the lifetime of the process.
+type ESIResolver struct {
+	esiClient *goesi.APIClient
+	limiter   ESILimiter
+
+	types          *lru.Cache[int32, Ship]
+	groups         *lru.Cache[int32, int32]
+	systems        *lru.Cache[int32, System]
+	constellations *lru.Cache[int32, int32]
+}
+
+func NewESIResolver(esiClient *goesi.APIClient, limiter ESILimiter) *ESIResolver {
+	types, _ := lru.New[int32, Ship](8192)
+	groups, _ := lru.New[int32, int32](2048)
+	systems, _ := lru.New[int32, System](8192)
+	constellations, _ := lru.New[int32, int32](2048)
+
+	return &ESIResolver{
+		esiClient:      esiClient,
+		limiter:        limiter,
+		types:          types,
+		groups:         groups,
+		systems:        systems,
+		constellations: constellations,
+	}
+}
+
+func (r *ESIResolver) Ship(ctx context.Context, typeID int32) (Ship, error) {
+	if ship, ok := r.types.Get(typeID); ok {
+		return ship, nil
+	}
+
+	var shipType esi.GetUniverseTypesTypeIdOk
+	err := r.call(ctx, func() (res *http.Response, err error) {
+		shipType, res, err = r.esiClient.ESI.UniverseApi.GetUniverseTypesTypeId(ctx, typeID, nil)
+		return res, err
+	})
+	if err != nil {
+		return Ship{}, fmt.Errorf("failed to fetch type %d: %w", typeID, err)
+	}
+
+	categoryID, ok := r.groups.Get(shipType.GroupId)
+	if !ok {
+		var group esi.GetUniverseGroupsGroupIdOk
+		err := r.call(ctx, func() (res *http.Response, err error) {
+			group, res, err = r.esiClient.ESI.UniverseApi.GetUniverseGroupsGroupId(ctx, shipType.GroupId, nil)
+			return res, err
+		})
+		if err != nil {
+			return Ship{}, fmt.Errorf("failed to fetch group %d: %w", shipType.GroupId, err)
+		}
+
+		categoryID = group.CategoryId
+		r.groups.Add(shipType.GroupId, categoryID)
+	}
+
+	ship := Ship{TypeID: typeID, GroupID: shipType.GroupId, CategoryID: categoryID}
+	r.types.Add(typeID, ship)
+
+	return ship, nil
+}
+
+func (r *ESIResolver) System(ctx context.Context, systemID int32) (System, error) {
+	if system, ok := r.systems.Get(systemID); ok {
+		return system, nil
+	}
+
+	var solarSystem esi.GetUniverseSystemsSystemIdOk
+	err := r.call(ctx, func() (res *http.Response, err error) {
+		solarSystem, res, err = r.esiClient.ESI.UniverseApi.GetUniverseSystemsSystemId(ctx, systemID, nil)
+		return res, err
+	})
+	if err != nil {
+		return System{}, fmt.Errorf("failed to fetch system %d: %w", systemID, err)
+	}
+
+	regionID, ok := r.constellations.Get(solarSystem.ConstellationId)
+	if !ok {
+		var constellation esi.GetUniverseConstellationsConstellationIdOk
+		err := r.call(ctx, func() (res *http.Response, err error) {
+			constellation, res, err = r.esiClient.ESI.UniverseApi.GetUniverseConstellationsConstellationId(ctx, solarSystem.ConstellationId, nil)
+			return res, err
+		})
+		if err != nil {
+			return System{}, fmt.Errorf("failed to fetch constellation %d: %w", solarSystem.ConstellationId, err)
+		}
+
+		regionID = constellation.RegionId
+		r.constellations.Add(solarSystem.ConstellationId, regionID)
+	}
+
+	system := System{ID: systemID, SecurityStatus: solarSystem.SecurityStatus, RegionID: regionID}
+	r.systems.Add(systemID, system)
+
+	return system, nil
+}
+
+// call runs an ESI request once the limiter allows it and retries it while the limiter asks for it,
+// e.g. after ESI rejected it for the error limit
+func (r *ESIResolver) call(ctx context.Context, request func() (*http.Response, error)) error {
+	for attempt := 1; ; attempt++ {
+		if err := r.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		res, err := request()
+		if r.limiter.Observe(res) && attempt < esiMaxAttempts {
+			continue
+		}
+
+		return err
+	}
+}
+
+// Resolve builds the rule input for a killmail. Lookups that fail are left zeroed and reported
+// in the returned error, so callers can still classify with partial data.
+func Resolve(ctx context.Context, resolver Resolver, killmail killfeed.Killmail) (Input, error) {
+	var errs []error
+
+	in := Input{
+		Killmail:      killmail,
+		AttackerShips: make([]Ship, len(killmail.Attackers)),
+	}
+
+	ships := map[int32]Ship{}
+	resolveShip := func(typeID int32) Ship {
+		if typeID == 0 {
+			return Ship{}
+		}
+
+		if ship, ok := ships[typeID]; ok {
+			return ship
+		}
+
+		ship, err := resolver.Ship(ctx, typeID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		ships[typeID] = ship
+		return ship
+	}
+
+	in.VictimShip = resolveShip(killmail.Victim.ShipTypeId)
+	for i, attacker := range killmail.Attackers {
+		in.AttackerShips[i] = resolveShip(attacker.ShipTypeId)
+	}
+
+	system, err := resolver.System(ctx, killmail.SolarSystemId)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	in.System = system
+
+	return in, errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package classify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/antihax/goesi"
+)
+
+// countingLimiter asks for a retry of responses rejected for the error limit, like ingest.ESILimiter
+type countingLimiter struct {
+	waits atomic.Int32
+}
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.waits.Add(1)
+	return nil
+}
+
+func (l *countingLimiter) Observe(res *http.Response) bool {
+	return res != nil && res.StatusCode == 420
+}
+
+func TestESIResolverWaitsForLimiter(t *testing.T) {
+	var systemRequests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/v4/universe/systems/30000142/":
+			// The first request is rejected for the error limit
+			if systemRequests.Add(1) == 1 {
+				w.WriteHeader(420)
+				w.Write([]byte(`{"error":"error limited"}`))
+				return
+			}
+
+			w.Write([]byte(`{"system_id":30000142,"constellation_id":20000020,"security_status":0.9459,"name":"Jita","star_id":40009076}`))
+
+		case "/v1/universe/constellations/20000020/":
+			w.Write([]byte(`{"constellation_id":20000020,"region_id":10000002,"name":"Kimotoro","systems":[30000142]}`))
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	esiClient := goesi.NewAPIClient(server.Client(), "test")
+	esiClient.ChangeBasePath(server.URL)
+
+	limiter := &countingLimiter{}
+	resolver := NewESIResolver(esiClient, limiter)
+
+	system, err := resolver.System(context.Background(), 30000142)
+	if err != nil {
+		t.Fatalf("failed to resolve system: %v", err)
+	}
+
+	if system.RegionID != 10000002 {
+		t.Fatalf("expected region 10000002, got %d", system.RegionID)
+	}
+
+	// The rejected system request, its retry and the constellation request
+	if waits := limiter.waits.Load(); waits != 3 {
+		t.Fatalf("expected 3 ESI calls to wait for the limiter, got %d", waits)
+	}
+
+	// Cached lookups do not call ESI
+	if _, err := resolver.System(context.Background(), 30000142); err != nil {
+		t.Fatalf("failed to resolve cached system: %v", err)
+	}
+
+	if waits := limiter.waits.Load(); waits != 3 {
+		t.Fatalf("cached lookup waited for the limiter")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"killfeed"
+	"killfeed/apikey"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// apikey manages API keys without going through the admin API, which is needed to create the
+// first admin key
+func main() {
+	ctx := context.Background()
+
+	create := flag.String("create", "", "create a key with this name")
+	scopes := flag.String("scopes", apikey.ScopeReadStream, "comma separated scopes of the created key")
+	tier := flag.String("tier", apikey.DefaultTier, "rate limit tier of the created key")
+	list := flag.Bool("list", false, "list all keys")
+	revoke := flag.String("revoke", "", "revoke the key with this ID")
+
+	log.Logger = log.Output(killfeed.LogOut{})
+
+	var config killfeed.APIKeyConfig
+	if err := killfeed.Load(&config); err != nil {
+		log.Fatal().Err(err).Msg("failed to read config")
+	}
+
+	killfeed.SetupLogging(config.Log)
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to redis")
+	}
+
+	defer rdb.Close()
+
+	keys := apikey.NewStore(rdb)
+
+	switch {
+	case *create != "":
+		if _, ok := config.RateLimitTiers[*tier]; !ok {
+			log.Fatal().Str("tier", *tier).Msg("unknown rate limit tier")
+		}
+
+		key, raw, err := keys.Create(ctx, *create, strings.Split(*scopes, ","), *tier)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create key")
+		}
+
+		log.Info().Str("key-id", key.ID).Strs("scopes", key.Scopes).Msg("created key, it is only shown once")
+		fmt.Println(raw)
+
+	case *list:
+		all, err := keys.List(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to list keys")
+		}
+
+		for _, key := range all {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.Tier, key.CreatedAt.Format("2006-01-02"))
+		}
+
+	case *revoke != "":
+		if err := keys.Revoke(ctx, *revoke); err != nil {
+			log.Fatal().Err(err).Msg("failed to revoke key")
+		}
+
+		log.Info().Str("key-id", *revoke).Msg("revoked key")
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
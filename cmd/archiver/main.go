@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"killfeed"
+	"killfeed/archive"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const GroupID = "killfeed:archiver"
+
+const (
+	BatchSize     = 1000
+	FlushInterval = 1 * time.Minute
+)
+
+func main() {
+	ctx := context.Background()
+
+	fromStart := flag.Bool("from-start", false, "archive every entry still retained in the stream when the consumer group is created")
+
+	log.Logger = log.Output(killfeed.LogOut{})
+
+	var config killfeed.ArchiverConfig
+	if err := killfeed.Load(&config); err != nil {
+		log.Fatal().Err(err).Msg("failed to read config")
+	}
+
+	killfeed.SetupLogging(config.Log)
+
+	arch, err := archive.NewFromConfig(config.ArchiveConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open archive")
+	}
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to redis")
+	}
+
+	defer rdb.Close()
+
+	consumerID, err := os.Hostname()
+	if err != nil {
+		consumerID = "any"
+	}
+
+	startID := "$"
+	if *fromStart {
+		startID = "0"
+	}
+
+	if err := rdb.XGroupCreateMkStream(ctx, config.Stream.Name, GroupID, startID).Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Fatal().Err(err).Msg("failed to create consumer group")
+	}
+
+	if err := rdb.XGroupCreateConsumer(ctx, config.Stream.Name, GroupID, consumerID).Err(); err != nil {
+		log.Fatal().Err(err).Msg("failed to create consumer")
+	}
+
+	// Entries delivered before a restart but never acknowledged are archived first
+	readID := "0"
+
+	batch := []redis.XMessage{}
+	lastFlush := time.Now()
+
+	for {
+		args := &redis.XReadGroupArgs{
+			Group:    GroupID,
+			Consumer: consumerID,
+			Streams:  []string{config.Stream.Name, readID},
+			Count:    BatchSize - int64(len(batch)),
+			Block:    5 * time.Second,
+		}
+
+		responses, err := rdb.XReadGroup(ctx, args).Result()
+		if err != nil && err != redis.Nil {
+			log.Error().Err(err).Msg("failed to read stream")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		received := 0
+		for _, response := range responses {
+			batch = append(batch, response.Messages...)
+			received += len(response.Messages)
+		}
+
+		pending := readID == "0"
+		if pending && received == 0 {
+			readID = ">"
+		}
+
+		// Pending entries are returned again until acknowledged, so they are flushed right away
+		if len(batch) == 0 || (!pending && len(batch) < BatchSize && time.Since(lastFlush) < FlushInterval) {
+			continue
+		}
+
+		for {
+			err := archiveBatch(ctx, rdb, config.Stream, arch, consumerID, batch)
+			if err == nil {
+				break
+			}
+
+			log.Error().Err(err).Int("entries", len(batch)).Msg("failed to archive batch, retrying")
+			time.Sleep(10 * time.Second)
+		}
+
+		batch = batch[:0]
+		lastFlush = time.Now()
+	}
+}
+
+func archiveBatch(ctx context.Context, rdb redis.UniversalClient, stream killfeed.StreamConfig, arch *archive.Archive, consumerID string, batch []redis.XMessage) error {
+	killmails := make([]killfeed.CombinedKillmail, 0, len(batch))
+	messageIDs := make([]string, 0, len(batch))
+
+	for _, message := range batch {
+		messageIDs = append(messageIDs, message.ID)
+
+		killmail, err := killfeed.DecodeStreamMessage(message)
+		if err != nil {
+			// Undecodable entries would block the group forever, so they are skipped and acknowledged
+			log.Error().Str("message-id", message.ID).Err(err).Msg("failed to decode stream message, skipping")
+			continue
+		}
+
+		killmails = append(killmails, killmail)
+	}
+
+	// The consumer ID keeps batches of concurrent archivers from overwriting each other
+	batchID := fmt.Sprintf("%s-%s", batch[0].ID, consumerID)
+
+	if err := arch.WriteBatch(ctx, batchID, killmails); err != nil {
+		return fmt.Errorf("failed to write batch %s: %w", batchID, err)
+	}
+
+	if err := rdb.XAck(ctx, stream.Name, GroupID, messageIDs...).Err(); err != nil {
+		return fmt.Errorf("failed to acknowledge batch %s: %w", batchID, err)
+	}
+
+	log.Info().Str("batch-id", batchID).Int("killmails", len(killmails)).Msg("archived batch")
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type KillmailRef struct {
+	ID   int32
+	Hash string
+}
+
+// loadHistory loads the killmail references of every day between from and to, either from local
+// zKillboard history files named YYYYMMDD.json in historyDir or from the zKillboard history API
+func loadHistory(ctx context.Context, from time.Time, to time.Time, historyDir string) ([]KillmailRef, error) {
+	httpClient := &http.Client{Timeout: 60 * time.Second}
+
+	refs := []KillmailRef{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		var data []byte
+		var err error
+
+		if historyDir != "" {
+			data, err = os.ReadFile(filepath.Join(historyDir, day.Format("20060102")+".json"))
+		} else {
+			data, err = fetchHistory(ctx, httpClient, day)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load history of %s: %w", day.Format(time.DateOnly), err)
+		}
+
+		dayRefs, err := parseHistory(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode history of %s: %w", day.Format(time.DateOnly), err)
+		}
+
+		refs = append(refs, dayRefs...)
+	}
+
+	return refs, nil
+}
+
+func fetchHistory(ctx context.Context, httpClient *http.Client, day time.Time) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://zkillboard.com/api/history/%s.json", day.Format("20060102")), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return body, nil
+}
+
+// parseHistory decodes a zKillboard history file, a JSON object mapping killmail IDs to hashes
+func parseHistory(data []byte) ([]KillmailRef, error) {
+	var history map[string]string
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+
+	refs := make([]KillmailRef, 0, len(history))
+	for rawID, hash := range history {
+		id, err := strconv.ParseInt(rawID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid killmail ID %q", rawID)
+		}
+
+		refs = append(refs, KillmailRef{ID: int32(id), Hash: hash})
+	}
+
+	slices.SortFunc(refs, func(a, b KillmailRef) int { return cmp.Compare(a.ID, b.ID) })
+
+	return refs, nil
+}
+
+// loadList reads killmail references from a file with one "ID hash" pair per line, separated by
+// whitespace or a comma. Empty lines and lines starting with # are ignored.
+func loadList(path string) ([]KillmailRef, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open list: %w", err)
+	}
+
+	defer file.Close()
+
+	refs := []KillmailRef{}
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid list line %d: expected killmail ID and hash", lineNumber)
+		}
+
+		id, err := strconv.ParseInt(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid list line %d: invalid killmail ID %q", lineNumber, fields[0])
+		}
+
+		refs = append(refs, KillmailRef{ID: int32(id), Hash: fields[1]})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read list: %w", err)
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"killfeed"
+	"killfeed/classify"
+	"killfeed/ingest"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	ctx := context.Background()
+
+	fromDate := flag.String("from", "", "first day to backfill from zKillboard history (YYYY-MM-DD)")
+	toDate := flag.String("to", "", "last day to backfill from zKillboard history (YYYY-MM-DD), defaults to -from")
+	historyDir := flag.String("history-dir", "", "read zKillboard history files (YYYYMMDD.json) from this directory instead of downloading them")
+	listPath := flag.String("list", "", "read killmail ID and hash pairs from this file instead of zKillboard history")
+	workers := flag.Int("workers", 4, "number of killmails processed concurrently")
+
+	log.Logger = log.Output(killfeed.LogOut{})
+
+	var config killfeed.BackfillConfig
+	if err := killfeed.Load(&config); err != nil {
+		log.Fatal().Err(err).Msg("failed to read config")
+	}
+
+	killfeed.SetupLogging(config.Log)
+
+	var refs []KillmailRef
+	var err error
+
+	switch {
+	case *listPath != "":
+		refs, err = loadList(*listPath)
+
+	case *fromDate != "":
+		if *toDate == "" {
+			toDate = fromDate
+		}
+
+		from, fromErr := time.Parse(time.DateOnly, *fromDate)
+		to, toErr := time.Parse(time.DateOnly, *toDate)
+		if fromErr != nil || toErr != nil || to.Before(from) {
+			log.Fatal().Msg("invalid date range")
+		}
+
+		refs, err = loadHistory(ctx, from, to, *historyDir)
+
+	default:
+		log.Fatal().Msg("either -list or -from is required")
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load killmails to backfill")
+	}
+
+	if *workers < 1 {
+		log.Fatal().Msg("workers must be at least 1")
+	}
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to redis")
+	}
+
+	defer rdb.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	esiClient := goesi.NewAPIClient(httpClient, fmt.Sprintf("Killfeed/%s (%s)", killfeed.Version, config.EsiContactInformation))
+
+	// The killmail fetches and the lookups of the classifier share the ESI limits
+	limiter := ingest.NewESILimiter()
+	publisher := ingest.NewPublisher(rdb, esiClient, classify.NewESIResolver(esiClient, limiter), limiter, config.BackfillStream)
+
+	log.Info().Int("killmails", len(refs)).Str("stream", config.BackfillStream.Name).Msg("starting backfill")
+
+	var published, failed atomic.Int64
+
+	queue := make(chan KillmailRef)
+
+	var wg sync.WaitGroup
+	for range *workers {
+		wg.Go(func() {
+			for ref := range queue {
+				logger := log.With().Int32("killmail-id", ref.ID).Logger()
+
+				// History only carries the hash, the remaining zkb fields stay empty
+				if err := publisher.Process(ctx, logger, ref.ID, killfeed.KillmailZkb{Hash: ref.Hash}, time.Time{}); err != nil {
+					logger.Error().Err(err).Msg("failed to backfill killmail")
+					failed.Add(1)
+					continue
+				}
+
+				if count := published.Add(1); count%1000 == 0 {
+					log.Info().Int64("published", count).Int("total", len(refs)).Msg("backfill progress")
+				}
+			}
+		})
+	}
+
+	for _, ref := range refs {
+		queue <- ref
+	}
+
+	close(queue)
+	wg.Wait()
+
+	log.Info().Int64("published", published.Load()).Int64("failed", failed.Load()).Msg("backfill finished")
+}
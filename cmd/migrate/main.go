@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"killfeed"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const ChunkSize = 1000
+
+// The migration copies every entry into a temporary stream under its original ID, converting
+// legacy entries to the canonical encoding, and then atomically renames the copy over the
+// original. Keeping the IDs keeps all cursors valid. Entries added while copying are picked up by
+// a final catch-up that is watched, so the rename is retried if the poller adds entries meanwhile.
+func main() {
+	ctx := context.Background()
+
+	streamName := flag.String("stream", "", "stream to migrate, defaults to the configured killmail stream")
+
+	log.Logger = log.Output(killfeed.LogOut{})
+
+	var config killfeed.Config
+	if err := killfeed.Load(&config); err != nil {
+		log.Fatal().Err(err).Msg("failed to read config")
+	}
+
+	killfeed.SetupLogging(config.Log)
+
+	if *streamName == "" {
+		*streamName = config.Stream.Name
+	}
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to redis")
+	}
+
+	defer rdb.Close()
+
+	// The copy is renamed over the stream, which requires both in the same cluster slot
+	tmpName := killfeed.ColocatedKey(*streamName, ":migrate")
+
+	if err := rdb.Del(ctx, tmpName).Err(); err != nil {
+		log.Fatal().Err(err).Msg("failed to remove leftover temporary stream")
+	}
+
+	withMsgpack := config.Stream.MsgpackPayload
+
+	lastID := ""
+	copied := 0
+
+	for {
+		messages, err := readAfter(ctx, rdb, *streamName, lastID, ChunkSize)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read stream")
+		}
+
+		if len(messages) == 0 {
+			break
+		}
+
+		pipe := rdb.Pipeline()
+		for _, message := range messages {
+			copyMessage(ctx, pipe, tmpName, message, withMsgpack)
+		}
+
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Fatal().Err(err).Msg("failed to copy entries")
+		}
+
+		lastID = messages[len(messages)-1].ID
+		copied += len(messages)
+
+		log.Info().Int("copied", copied).Msg("migration progress")
+	}
+
+	for {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			return finish(ctx, tx, *streamName, tmpName, lastID, withMsgpack)
+		}, *streamName)
+
+		if errors.Is(err, redis.TxFailedErr) {
+			log.Info().Msg("stream changed during final catch-up, retrying")
+			continue
+		}
+
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to finish migration")
+		}
+
+		break
+	}
+
+	log.Info().Str("stream", *streamName).Msg("migration finished")
+}
+
+// finish copies the entries added since the bulk copy, recreates the consumer groups on the copy
+// and renames it over the original, all in one transaction
+func finish(ctx context.Context, tx *redis.Tx, streamName string, tmpName string, lastID string, withMsgpack bool) error {
+	remaining := []redis.XMessage{}
+	for {
+		messages, err := readAfter(ctx, tx, streamName, lastID, ChunkSize)
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			break
+		}
+
+		remaining = append(remaining, messages...)
+		lastID = messages[len(messages)-1].ID
+	}
+
+	// An empty or missing stream has nothing to migrate
+	if lastID == "" {
+		return nil
+	}
+
+	groups, err := tx.XInfoGroups(ctx, streamName).Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		return fmt.Errorf("failed to read consumer groups: %w", err)
+	}
+
+	groupStartIDs := map[string]string{}
+	for _, group := range groups {
+		startID := group.LastDeliveredID
+
+		// Pending entries lists cannot be copied, so groups restart before their oldest pending
+		// entry and see those entries again
+		if group.Pending > 0 {
+			pending, err := tx.XPending(ctx, streamName, group.Name).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read pending entries of group %s: %w", group.Name, err)
+			}
+
+			startID = previousID(pending.Lower)
+		}
+
+		groupStartIDs[group.Name] = startID
+	}
+
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, message := range remaining {
+			copyMessage(ctx, pipe, tmpName, message, withMsgpack)
+		}
+
+		for name, startID := range groupStartIDs {
+			pipe.XGroupCreateMkStream(ctx, tmpName, name, startID)
+		}
+
+		pipe.Rename(ctx, tmpName, streamName)
+		return nil
+	})
+
+	return err
+}
+
+func readAfter(ctx context.Context, rdb redis.Cmdable, streamName string, afterID string, count int64) ([]redis.XMessage, error) {
+	start := "-"
+	if afterID != "" {
+		start = "(" + afterID
+	}
+
+	return rdb.XRangeN(ctx, streamName, start, "+", count).Result()
+}
+
+// copyMessage adds an entry to the temporary stream under its original ID, converted to the canonical encoding
+func copyMessage(ctx context.Context, pipe redis.Pipeliner, tmpName string, message redis.XMessage, withMsgpack bool) {
+	values := message.Values
+
+	if killfeed.IsLegacyStreamMessage(message) {
+		killmail, err := killfeed.DecodeStreamMessage(message)
+		if err == nil {
+			values, err = killfeed.EncodeStreamMessage(killmail, withMsgpack)
+		}
+
+		// Entries that cannot be converted are kept as they are rather than dropped
+		if err != nil {
+			log.Warn().Str("message-id", message.ID).Err(err).Msg("failed to convert entry, copying unchanged")
+			values = message.Values
+		}
+	}
+
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: tmpName, ID: message.ID, Values: values})
+}
+
+// previousID returns the stream ID directly before id
+func previousID(id string) string {
+	rawMillis, rawSeq, _ := strings.Cut(id, "-")
+
+	millis, _ := strconv.ParseUint(rawMillis, 10, 64)
+	seq, _ := strconv.ParseUint(rawSeq, 10, 64)
+
+	if seq > 0 {
+		return fmt.Sprintf("%d-%d", millis, seq-1)
+	}
+
+	if millis == 0 {
+		return "0"
+	}
+
+	return fmt.Sprintf("%d-%d", millis-1, uint64(math.MaxUint64))
+}
@@ -2,13 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"killfeed"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -19,32 +17,33 @@ func main() {
 	ctx := context.Background()
 
 	log.Logger = log.Output(killfeed.LogOut{})
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
-	config, err := killfeed.NewConfig()
-	if err != nil {
+	var config killfeed.Config
+	if err := killfeed.Load(&config); err != nil {
 		log.Fatal().Err(err).Msg("failed to read config")
 	}
 
-	rdb := redis.NewClient(&redis.Options{Addr: config.RedisURL})
-	if err := rdb.Ping(ctx).Err(); err != nil {
+	killfeed.SetupLogging(config.Log)
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to connect to redis")
 	}
 
 	defer rdb.Close()
 
-	if err := rdb.XGroupCreate(ctx, killfeed.StreamKillmails, GroupID, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+	if err := rdb.XGroupCreate(ctx, config.Stream.Name, GroupID, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
 		log.Fatal().Err(err).Msg("failed to create consumer group")
 	}
 
-	if err := rdb.XGroupCreateConsumer(ctx, killfeed.StreamKillmails, GroupID, ConsumerID).Err(); err != nil {
+	if err := rdb.XGroupCreateConsumer(ctx, config.Stream.Name, GroupID, ConsumerID).Err(); err != nil {
 		log.Fatal().Err(err).Msg("failed to create consumer")
 	}
 
 	args := &redis.XReadGroupArgs{
 		Group:    GroupID,
 		Consumer: ConsumerID,
-		Streams:  []string{killfeed.StreamKillmails, ">"},
+		Streams:  []string{config.Stream.Name, ">"},
 		Count:    1,
 		Block:    0,
 		NoAck:    true,
@@ -60,8 +59,8 @@ func main() {
 
 		for _, response := range responses {
 			for _, message := range response.Messages {
-				var killmail killfeed.Killmail
-				if err := json.Unmarshal([]byte(message.Values["killmail"].(string)), &killmail); err != nil {
+				killmail, err := killfeed.DecodeStreamMessage(message)
+				if err != nil {
 					log.Error().Str("message-id", message.ID).Err(err).Msg("failed to decode stream message")
 					continue
 				}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"killfeed"
+	"killfeed/ingest"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// lastRedisQFetch holds the Unix nanoseconds of the last successful fetch from RedisQ
+var lastRedisQFetch atomic.Int64
+
+type HealthCheck struct {
+	// LastSuccess is missing until the stage succeeded once
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// WaitingSince is when the oldest killmail still waiting for the stage was received from RedisQ
+	WaitingSince *time.Time `json:"waiting_since,omitempty"`
+	Age          string     `json:"age"`
+	MaxAge       string     `json:"max_age,omitempty"`
+	OK           bool       `json:"ok"`
+}
+
+type HealthResponse struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// health tells whether the stages of the poller keep succeeding. RedisQ is measured from the start
+// of the poller until it succeeds once, so a fresh poller gets the same grace as a running one. ESI
+// fetches and stream adds only happen when RedisQ returns killmails, so they are measured from the
+// first killmail received after their last success and quiet periods do not count against them.
+type health struct {
+	rdb       redis.UniversalClient
+	publisher *ingest.Publisher
+	startedAt time.Time
+	// maxAges is replaced when the configuration is reloaded
+	maxAges atomic.Pointer[map[string]time.Duration]
+
+	mu sync.Mutex
+	// waitingSince holds by stage when the oldest killmail waiting for it was received
+	waitingSince map[string]time.Time
+}
+
+func newHealth(rdb redis.UniversalClient, publisher *ingest.Publisher, config killfeed.PollerConfig) *health {
+	h := &health{
+		rdb:          rdb,
+		publisher:    publisher,
+		startedAt:    time.Now(),
+		waitingSince: map[string]time.Time{},
+	}
+	h.reload(config)
+
+	return h
+}
+
+// reload applies new maximum ages to the following checks
+func (h *health) reload(config killfeed.PollerConfig) {
+	h.maxAges.Store(&map[string]time.Duration{
+		"redisq":     config.HealthRedisQMaxAge,
+		"esi":        config.HealthESIMaxAge,
+		"stream_add": config.HealthStreamAddMaxAge,
+	})
+}
+
+// killmailStages returns the last successes of the stages every killmail received from RedisQ
+// passes through
+func (h *health) killmailStages() map[string]time.Time {
+	return map[string]time.Time{
+		"esi":        h.publisher.LastFetch(),
+		"stream_add": h.publisher.LastAdd(),
+	}
+}
+
+// received records a killmail received from RedisQ at receivedAt, stages that caught up with the
+// previous killmails start waiting for it
+func (h *health) received(receivedAt time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, last := range h.killmailStages() {
+		if !h.waitingSince[name].After(last) {
+			h.waitingSince[name] = receivedAt
+		}
+	}
+}
+
+func (h *health) check(now time.Time) HealthResponse {
+	response := HealthResponse{OK: true, Checks: map[string]HealthCheck{}}
+	maxAges := *h.maxAges.Load()
+
+	lastSuccess := h.killmailStages()
+	lastSuccess["redisq"] = time.Unix(0, lastRedisQFetch.Load())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, last := range lastSuccess {
+		check := HealthCheck{OK: true}
+
+		since := h.startedAt
+		if last.After(h.startedAt) {
+			check.LastSuccess = &last
+			since = last
+		}
+
+		age := now.Sub(since)
+		check.Age = age.Round(time.Second).String()
+
+		// Killmail stages are stale only while a received killmail waits for them
+		stale := age
+		if name != "redisq" {
+			stale = 0
+			if waiting := h.waitingSince[name]; waiting.After(last) {
+				check.WaitingSince = &waiting
+				stale = now.Sub(waiting)
+			}
+		}
+
+		if maxAge := maxAges[name]; maxAge > 0 {
+			check.MaxAge = maxAge.String()
+			check.OK = stale <= maxAge
+		}
+
+		response.Checks[name] = check
+		response.OK = response.OK && check.OK
+	}
+
+	return response
+}
+
+// handleLive fails once a stage has not succeeded within its max age, so a wedged poller is restarted
+func (h *health) handleLive(w http.ResponseWriter, r *http.Request) {
+	response := h.check(time.Now())
+
+	status := http.StatusOK
+	if !response.OK {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, response)
+}
+
+// handleReady fails while Redis is unreachable
+func (h *health) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := h.rdb.Ping(ctx).Err(); err != nil {
+		log.Warn().Err(err).Msg("readiness check failed to reach redis")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "redis is unreachable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warn().Err(err).Msg("failed to write health response")
+	}
+}
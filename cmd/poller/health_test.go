@@ -0,0 +1,53 @@
+package main
+
+import (
+	"killfeed"
+	"killfeed/ingest"
+	"testing"
+	"time"
+)
+
+func TestHealthIgnoresQuietPeriods(t *testing.T) {
+	config := killfeed.PollerConfig{HealthRedisQMaxAge: 2 * time.Minute, HealthESIMaxAge: time.Hour, HealthStreamAddMaxAge: time.Hour}
+	h := newHealth(nil, ingest.NewPublisher(nil, nil, nil, nil, killfeed.StreamConfig{}), config)
+
+	// RedisQ keeps answering without killmails for hours
+	now := h.startedAt.Add(3 * time.Hour)
+	lastRedisQFetch.Store(now.UnixNano())
+	t.Cleanup(func() { lastRedisQFetch.Store(0) })
+
+	if response := h.check(now); !response.OK {
+		t.Fatalf("expected a quiet poller to be healthy, got %+v", response.Checks)
+	}
+
+	// A killmail that is not fetched from ESI and added to the stream makes the poller unhealthy
+	// once it waited for longer than the max age
+	h.received(now)
+
+	lastRedisQFetch.Store(now.Add(30 * time.Minute).UnixNano())
+
+	if response := h.check(now.Add(30 * time.Minute)); !response.OK {
+		t.Fatalf("expected a killmail waiting within the max age to be healthy, got %+v", response.Checks)
+	}
+
+	later := now.Add(2 * time.Hour)
+	lastRedisQFetch.Store(later.UnixNano())
+	h.received(later)
+
+	response := h.check(later)
+	for _, name := range []string{"esi", "stream_add"} {
+		check := response.Checks[name]
+		if check.OK || check.WaitingSince == nil || !check.WaitingSince.Equal(now) {
+			t.Fatalf("expected %s to wait for the first killmail since %s, got %+v", name, now, check)
+		}
+	}
+
+	if !response.Checks["redisq"].OK || response.OK {
+		t.Fatalf("expected only the killmail stages to fail, got %+v", response.Checks)
+	}
+
+	// RedisQ is judged on its own
+	if response := h.check(later.Add(5 * time.Minute)); response.Checks["redisq"].OK {
+		t.Fatalf("expected a stale RedisQ fetch to fail, got %+v", response.Checks["redisq"])
+	}
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"killfeed"
+	"killfeed/classify"
+	"killfeed/ingest"
+	"killfeed/tracing"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/antihax/goesi"
-	"github.com/redis/go-redis/v9"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
@@ -19,58 +26,81 @@ func main() {
 
 	log.Logger = log.Output(killfeed.LogOut{})
 
-	config, err := killfeed.NewConfig()
+	var config killfeed.PollerConfig
+	reloader, err := killfeed.LoadReloadable(&config)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to read config")
 	}
 
-	rdb := redis.NewClient(&redis.Options{Addr: config.RedisURL})
-	if err := rdb.Ping(ctx).Err(); err != nil {
+	killfeed.SetupLogging(config.Log)
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to connect to redis")
 	}
 
 	defer rdb.Close()
 
+	shutdownTracing, err := tracing.Setup(ctx, config.Config, "poller")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+
 	httpClient := &http.Client{Timeout: 10 * time.Second}
 
 	esiClient := goesi.NewAPIClient(httpClient, fmt.Sprintf("Killfeed/%s (%s)", killfeed.Version, config.EsiContactInformation))
 
-	go watchRedisQ(ctx, log.With().Str("source", "redisq").Logger(), rdb, esiClient, config.ZkillboardQueueID)
+	// The killmail fetches and the lookups of the classifier share the ESI limits
+	limiter := ingest.NewESILimiter()
+	publisher := ingest.NewPublisher(rdb, esiClient, classify.NewESIResolver(esiClient, limiter), limiter, config.Stream)
 
-	<-make(chan bool, 1)
-}
+	health := newHealth(rdb, publisher, config)
+	go serveStatus(config.MetricsPort, health)
 
-func processKillmail(ctx context.Context, logger zerolog.Logger, rdb *redis.Client, esiClient *goesi.APIClient, killmailID int32, killmailZkb killfeed.KillmailZkb) {
-	killmail, _, err := esiClient.ESI.KillmailsApi.GetKillmailsKillmailIdKillmailHash(ctx, killmailZkb.Hash, killmailID, nil)
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to fetch killmail from ESI")
-		return
-	}
+	go killfeed.WatchConfig(ctx, reloader, func(next *killfeed.PollerConfig) {
+		killfeed.SetLogLevel(next.Log)
+		publisher.SetRetention(next.Stream.MaxLength, next.Stream.MaxAge)
+		health.reload(*next)
+	})
 
-	encodedKillmail, err := json.Marshal(killmail)
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to encode killmail")
-		return
+	go watchRedisQ(ctx, log.With().Str("source", "redisq").Logger(), publisher, health, config.ZkillboardQueueID)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	// Spans are exported in batches, the last ones would be lost without a flush
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to flush traces")
 	}
+}
+
+func processKillmail(ctx context.Context, logger zerolog.Logger, publisher *ingest.Publisher, killmailID int32, killmailZkb killfeed.KillmailZkb, receivedAt time.Time) {
+	ctx, span := tracing.Tracer().Start(ctx, "killmail.process", trace.WithAttributes(attribute.Int("killmail.id", int(killmailID))))
+
+	err := publisher.Process(ctx, logger, killmailID, killmailZkb, receivedAt)
+	tracing.End(span, err)
 
-	encodedKillmailZkb, err := json.Marshal(killmailZkb)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to encode killmail zkb")
+		killmailsProcessed.WithLabelValues("error").Inc()
+		logger.Error().Err(err).Msg("failed to process killmail")
 		return
 	}
 
-	args := &redis.XAddArgs{
-		Stream: killfeed.StreamKillmails,
-		ID:     "*",
-		MaxLen: killfeed.StreamMaxLength,
-		Approx: true,
-		Values: map[string]any{
-			"killmail":     string(encodedKillmail),
-			"killmail_zkb": string(encodedKillmailZkb),
-		},
-	}
+	killmailsProcessed.WithLabelValues("ok").Inc()
+}
+
+// serveStatus exposes the Prometheus metrics and health checks of the poller on a separate listener
+func serveStatus(port int, h *health) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/livez", h.handleLive)
+	mux.HandleFunc("/readyz", h.handleReady)
+
+	log.Info().Int("port", port).Msg("status listener listening")
 
-	if err := rdb.XAdd(ctx, args).Err(); err != nil {
-		logger.Error().Err(err).Msg("failed to add killmail to queue")
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal().Err(err).Msg("status listener failed")
 	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	redisqFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_redisq_fetches_total",
+		Help: "Fetches from RedisQ by result",
+	}, []string{"result"})
+
+	redisqFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "killfeed_redisq_fetch_duration_seconds",
+		Help:    "Duration of fetches from RedisQ, including the time RedisQ waits for a killmail",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15},
+	})
+
+	redisqEmptyPackages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_redisq_empty_packages_total",
+		Help: "RedisQ responses without a killmail",
+	})
+
+	killmailsDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_killmails_duplicate_total",
+		Help: "Killmails skipped because they were processed recently",
+	})
+
+	killmailsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_killmails_processed_total",
+		Help: "Killmails processed by result",
+	}, []string{"result"})
+)
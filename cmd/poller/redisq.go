@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"io"
 	"killfeed"
+	"killfeed/ingest"
+	"killfeed/tracing"
 	"net/http"
 	"time"
 
-	"github.com/antihax/goesi"
-	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type RedisQPackage struct {
@@ -23,10 +24,22 @@ type RedisQResponse struct {
 	Package *RedisQPackage `json:"package"`
 }
 
-func watchRedisQ(ctx context.Context, logger zerolog.Logger, rdb *redis.Client, esiClient *goesi.APIClient, queueID string) {
+func watchRedisQ(ctx context.Context, logger zerolog.Logger, publisher *ingest.Publisher, health *health, queueID string) {
 	for {
-		response, err := fetchRedisQ(ctx, logger, queueID)
+		start := time.Now()
+		fetchCtx, span := tracing.Tracer().Start(ctx, "redisq.fetch")
+		response, err := fetchRedisQ(fetchCtx, logger, queueID)
+		receivedAt := time.Now()
+		redisqFetchDuration.Observe(receivedAt.Sub(start).Seconds())
+
+		if err == nil && response.Package != nil {
+			span.SetAttributes(attribute.Int("killmail.id", int(response.Package.KillID)))
+		}
+
+		tracing.End(span, err)
+
 		if err != nil {
+			redisqFetches.WithLabelValues("error").Inc()
 			logger.Error().Err(err).Msg("failed to fetch")
 
 			// Sleep with context cancellation
@@ -38,15 +51,23 @@ func watchRedisQ(ctx context.Context, logger zerolog.Logger, rdb *redis.Client,
 			continue
 		}
 
+		redisqFetches.WithLabelValues("ok").Inc()
+		lastRedisQFetch.Store(receivedAt.UnixNano())
+
 		if response.Package == nil {
+			redisqEmptyPackages.Inc()
 			continue
 		}
 
 		if isKillmailCached(response.Package.KillID) {
+			killmailsDuplicate.Inc()
 			continue
 		}
 
-		go processKillmail(ctx, logger.With().Int32("killmail-id", response.Package.KillID).Logger(), rdb, esiClient, response.Package.KillID, response.Package.Zkb)
+		health.received(receivedAt)
+
+		// Processing continues the trace of the fetch that received the killmail
+		go processKillmail(fetchCtx, logger.With().Int32("killmail-id", response.Package.KillID).Logger(), publisher, response.Package.KillID, response.Package.Zkb, receivedAt)
 	}
 }
 
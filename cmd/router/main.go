@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"killfeed"
+	"killfeed/classify"
+	"killfeed/ingest"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const GroupID = "killfeed:router"
+
+const BatchSize = 100
+
+func main() {
+	ctx := context.Background()
+
+	log.Logger = log.Output(killfeed.LogOut{})
+
+	var config killfeed.RouterConfig
+	if err := killfeed.Load(&config); err != nil {
+		log.Fatal().Err(err).Msg("failed to read config")
+	}
+
+	killfeed.SetupLogging(config.Log)
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to redis")
+	}
+
+	defer rdb.Close()
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	esiClient := goesi.NewAPIClient(httpClient, fmt.Sprintf("Killfeed/%s (%s)", killfeed.Version, config.EsiContactInformation))
+
+	resolver := classify.NewESIResolver(esiClient, ingest.NewESILimiter())
+
+	consumerID, err := os.Hostname()
+	if err != nil {
+		consumerID = "any"
+	}
+
+	if err := rdb.XGroupCreateMkStream(ctx, config.Stream.Name, GroupID, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Fatal().Err(err).Msg("failed to create consumer group")
+	}
+
+	if err := rdb.XGroupCreateConsumer(ctx, config.Stream.Name, GroupID, consumerID).Err(); err != nil {
+		log.Fatal().Err(err).Msg("failed to create consumer")
+	}
+
+	// Entries delivered before a restart but never acknowledged are routed first
+	readID := "0"
+
+	for {
+		args := &redis.XReadGroupArgs{
+			Group:    GroupID,
+			Consumer: consumerID,
+			Streams:  []string{config.Stream.Name, readID},
+			Count:    BatchSize,
+			Block:    0,
+		}
+
+		responses, err := rdb.XReadGroup(ctx, args).Result()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read stream")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		received := 0
+		for _, response := range responses {
+			for _, message := range response.Messages {
+				received++
+				routeMessage(ctx, log.With().Str("message-id", message.ID).Logger(), rdb, resolver, config.Stream, message)
+			}
+		}
+
+		if readID == "0" && received == 0 {
+			readID = ">"
+		}
+	}
+}
+
+// routeMessage copies a stream entry into the derived streams of every entity involved in the kill
+// and acknowledges it. Entries that fail to route stay pending and are retried after a restart.
+func routeMessage(ctx context.Context, logger zerolog.Logger, rdb redis.UniversalClient, resolver classify.Resolver, stream killfeed.StreamConfig, message redis.XMessage) {
+	killmail, err := killfeed.DecodeStreamMessage(message)
+	if err != nil {
+		// Undecodable entries would stay pending forever, so they are skipped and acknowledged
+		logger.Error().Err(err).Msg("failed to decode stream message, skipping")
+		if err := rdb.XAck(ctx, stream.Name, GroupID, message.ID).Err(); err != nil {
+			logger.Error().Err(err).Msg("failed to acknowledge stream message")
+		}
+
+		return
+	}
+
+	derived := derivedStreams(stream, killmail)
+
+	// Region routing is best effort, a failed lookup only skips the region stream
+	system, err := resolver.System(ctx, killmail.SolarSystemId)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to resolve region")
+	} else if system.RegionID != 0 {
+		derived = append(derived, stream.Derived(killfeed.DerivedRegion, system.RegionID))
+	}
+
+	pipe := rdb.Pipeline()
+	for _, derivedStream := range derived {
+		derivedStream.Add(ctx, pipe, message.Values)
+	}
+
+	// The pipeline is not a transaction, so the entry is only acknowledged once every add succeeded
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to route killmail to derived streams")
+		return
+	}
+
+	if err := rdb.XAck(ctx, stream.Name, GroupID, message.ID).Err(); err != nil {
+		logger.Error().Err(err).Msg("failed to acknowledge stream message")
+	}
+}
+
+// derivedStreams returns the alliance and corporation streams of everyone on the killmail
+func derivedStreams(stream killfeed.StreamConfig, killmail killfeed.CombinedKillmail) []killfeed.StreamConfig {
+	alliances := map[int32]bool{}
+	corporations := map[int32]bool{}
+
+	alliances[killmail.Victim.AllianceId] = true
+	corporations[killmail.Victim.CorporationId] = true
+
+	for _, attacker := range killmail.Attackers {
+		alliances[attacker.AllianceId] = true
+		corporations[attacker.CorporationId] = true
+	}
+
+	derived := []killfeed.StreamConfig{}
+
+	for allianceID := range alliances {
+		if allianceID != 0 {
+			derived = append(derived, stream.Derived(killfeed.DerivedAlliance, allianceID))
+		}
+	}
+
+	for corporationID := range corporations {
+		if corporationID != 0 {
+			derived = append(derived, stream.Derived(killfeed.DerivedCorporation, corporationID))
+		}
+	}
+
+	return derived
+}
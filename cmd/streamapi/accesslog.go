@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// accessLog logs every request once it completes and gives handlers a logger that carries the
+// request ID, which middleware.RequestID takes from X-Request-Id or generates. The ID is returned
+// in the same header so clients can quote it. Authenticated requests also log their client, see
+// logClient. Query strings are left out, they may hold API keys.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := middleware.GetReqID(r.Context())
+		logger := log.With().Str("request-id", requestID).Logger()
+
+		w.Header().Set(middleware.RequestIDHeader, requestID)
+
+		// Handlers log through the logger of the context, which authenticate extends with the client
+		ctx := logger.WithContext(r.Context())
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		// Websockets are hijacked after the upgrade, which bypasses the wrapped writer
+		if status == 0 && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			status = http.StatusSwitchingProtocols
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+
+		event := zerolog.Ctx(ctx).Info()
+
+		// URL parameters are known once the request was routed
+		if queueID := chi.URLParam(r, "queueID"); queueID != "" {
+			event = event.Str("queue-id", queueID)
+		}
+
+		event.
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("route", routePattern(r)).
+			Str("remote-addr", r.RemoteAddr).
+			Int("status", status).
+			Int("bytes", ww.BytesWritten()).
+			Dur("latency", time.Since(start)).
+			Msg("http request")
+	})
+}
+
+// logClient adds the authenticated client to the logger of the request, so the access log and the
+// events of the handlers name it. The default logger is left alone outside of accessLog, extending
+// it would name the client in every event of the process.
+func logClient(ctx context.Context, subject string) {
+	if logger := zerolog.Ctx(ctx); logger != zerolog.DefaultContextLogger {
+		logger.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str("client", subject)
+		})
+	}
+}
+
+// routePattern returns the pattern of the matched route, or an empty string for unmatched requests
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		return rctx.RoutePattern()
+	}
+
+	return ""
+}
+
+// websocketLogger returns the logger of the request that opened a websocket for a queue
+func websocketLogger(r *http.Request, queueID string) zerolog.Logger {
+	return zerolog.Ctx(r.Context()).With().Str("queue-id", queueID).Logger()
+}
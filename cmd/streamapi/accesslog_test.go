@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"killfeed/apikey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestAccessLogNamesClient(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+
+	keys := apikey.NewStore(rdb)
+	key, raw, err := keys.Create(context.Background(), "test", []string{apikey.ScopeReadStream}, apikey.DefaultTier)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	var out bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&out)
+	t.Cleanup(func() { log.Logger = logger })
+
+	handler := middleware.RequestID(accessLog(authenticate(keys, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zerolog.Ctx(r.Context()).Info().Msg("handler event")
+	}))))
+
+	for _, header := range []string{"Bearer " + raw, ""} {
+		out.Reset()
+
+		r := httptest.NewRequest(http.MethodGet, "/killmails", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected the handler event and the access log, got %q", out.String())
+		}
+
+		for _, line := range lines {
+			var event map[string]any
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("invalid log line %q: %v", line, err)
+			}
+
+			client, ok := event["client"]
+			if header == "" && ok {
+				t.Fatalf("anonymous request logged with client %v", client)
+			}
+
+			if header != "" && client != "key:"+key.ID {
+				t.Fatalf("expected client key:%s, got %v in %q", key.ID, client, line)
+			}
+		}
+	}
+
+	// The client of one request does not leak into the default logger
+	if strings.Contains(out.String(), "key:") {
+		t.Fatalf("client logged for a later anonymous request: %q", out.String())
+	}
+}
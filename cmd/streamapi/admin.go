@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"killfeed"
+	"killfeed/httperror"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/olahol/melody"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+type ConsumerGroupStatus struct {
+	Name            string `json:"name"`
+	Consumers       int64  `json:"consumers"`
+	Pending         int64  `json:"pending"`
+	LastDeliveredID string `json:"last_delivered_id"`
+	// Lag is missing when Redis cannot determine it, e.g. after entries were deleted
+	Lag *int64 `json:"lag,omitempty"`
+}
+
+type StreamStatus struct {
+	Name            string                `json:"name"`
+	Length          int64                 `json:"length"`
+	FirstEntryID    string                `json:"first_entry_id,omitempty"`
+	LastEntryID     string                `json:"last_entry_id,omitempty"`
+	LastGeneratedID string                `json:"last_generated_id"`
+	EntriesAdded    int64                 `json:"entries_added"`
+	Groups          []ConsumerGroupStatus `json:"groups"`
+}
+
+type StatusResponse struct {
+	Version string         `json:"version"`
+	Streams []StreamStatus `json:"streams"`
+	// WebsocketSessions counts the sessions of the instance answering the request
+	WebsocketSessions int `json:"websocket_sessions"`
+}
+
+type QueueStatus struct {
+	QueueID   string `json:"queue_id"`
+	Transport string `json:"transport"`
+	Cursor    string `json:"cursor"`
+	// CursorTime is when the entry at the cursor was added to the stream
+	CursorTime *time.Time `json:"cursor_time,omitempty"`
+	Owner      string     `json:"owner,omitempty"`
+	ExpiresIn  string     `json:"expires_in"`
+	// Sessions counts the sessions of the instance answering the request
+	Sessions int `json:"sessions"`
+}
+
+type SessionStatus struct {
+	ID          string         `json:"id"`
+	QueueID     string         `json:"queue_id"`
+	Stream      string         `json:"stream"`
+	Subject     string         `json:"subject"`
+	RemoteAddr  string         `json:"remote_addr"`
+	Format      string         `json:"format"`
+	Envelope    bool           `json:"envelope"`
+	Private     bool           `json:"private"`
+	Cursor      string         `json:"cursor"`
+	Paused      bool           `json:"paused"`
+	Subscribed  bool           `json:"subscribed"`
+	Filter      *CommandFilter `json:"filter,omitempty"`
+	Sent        int64          `json:"sent"`
+	Skipped     int64          `json:"skipped"`
+	ConnectedAt time.Time      `json:"connected_at"`
+	// Lag is the last measured lag, it is measured periodically while the session reads
+	Lag LagData `json:"lag"`
+}
+
+type ResetCursorRequest struct {
+	Transport string `json:"transport"`
+	// Cursor is a stream ID to continue after, "0" to replay the stream or "$" to skip to new entries
+	Cursor string `json:"cursor"`
+}
+
+func handleAdminStatus(rdb redis.UniversalClient, config killfeed.Config, m *melody.Melody) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		response := StatusResponse{Version: killfeed.Version, Streams: []StreamStatus{}, WebsocketSessions: m.Len()}
+
+		for _, name := range []string{config.Stream.Name, config.BackfillStream.Name} {
+			status, ok, err := streamStatus(r.Context(), rdb, name)
+			if err != nil {
+				return httperror.InternalServerError("failed to read stream status", err)
+			}
+
+			if ok {
+				response.Streams = append(response.Streams, status)
+			}
+		}
+
+		render.JSON(w, r, response)
+		return nil
+	}
+}
+
+// streamStatus describes a stream and its consumer groups, it reports false for missing streams
+func streamStatus(ctx context.Context, rdb redis.UniversalClient, name string) (StreamStatus, bool, error) {
+	exists, err := rdb.Exists(ctx, name).Result()
+	if err != nil || exists == 0 {
+		return StreamStatus{}, false, err
+	}
+
+	info, err := rdb.XInfoStream(ctx, name).Result()
+	if err != nil {
+		return StreamStatus{}, false, fmt.Errorf("failed to get info of stream %s: %w", name, err)
+	}
+
+	groups, err := rdb.XInfoGroups(ctx, name).Result()
+	if err != nil {
+		return StreamStatus{}, false, fmt.Errorf("failed to get consumer groups of stream %s: %w", name, err)
+	}
+
+	status := StreamStatus{
+		Name:            name,
+		Length:          info.Length,
+		FirstEntryID:    info.FirstEntry.ID,
+		LastEntryID:     info.LastEntry.ID,
+		LastGeneratedID: info.LastGeneratedID,
+		EntriesAdded:    info.EntriesAdded,
+		Groups:          make([]ConsumerGroupStatus, len(groups)),
+	}
+
+	for i, group := range groups {
+		status.Groups[i] = ConsumerGroupStatus{
+			Name:            group.Name,
+			Consumers:       group.Consumers,
+			Pending:         group.Pending,
+			LastDeliveredID: group.LastDeliveredID,
+		}
+
+		if group.Lag >= 0 {
+			status.Groups[i].Lag = &group.Lag
+		}
+	}
+
+	return status, true, nil
+}
+
+// handleAdminQueues lists the queues of the live stream that have a stored cursor
+func handleAdminQueues(rdb redis.UniversalClient, stream killfeed.StreamConfig, guard *queueGuard) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx := r.Context()
+		queues := []QueueStatus{}
+
+		for _, transport := range []string{TransportWebsocket, TransportPoll} {
+			prefix := stream.Key(transport, "")
+
+			matches, err := scanKeys(ctx, rdb, prefix+"*")
+			if err != nil {
+				return httperror.InternalServerError("failed to list queues", err)
+			}
+
+			// Keys kept next to a cursor, like its epoch, have a colon no queue ID has
+			keys := []string{}
+			for _, key := range matches {
+				if queueIDPattern.MatchString(strings.TrimPrefix(key, prefix)) {
+					keys = append(keys, key)
+				}
+			}
+
+			pipe := rdb.Pipeline()
+			cursors := make([]*redis.StringCmd, len(keys))
+			ttls := make([]*redis.DurationCmd, len(keys))
+			owners := make([]*redis.StringCmd, len(keys))
+
+			for i, key := range keys {
+				queueID := strings.TrimPrefix(key, prefix)
+
+				cursors[i] = pipe.Get(ctx, key)
+				ttls[i] = pipe.TTL(ctx, key)
+				owners[i] = pipe.Get(ctx, stream.Key("owner", queueID))
+			}
+
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				return httperror.InternalServerError("failed to read queues", err)
+			}
+
+			for i, key := range keys {
+				queue := QueueStatus{
+					QueueID:   strings.TrimPrefix(key, prefix),
+					Transport: transport,
+					Cursor:    cursors[i].Val(),
+					Owner:     owners[i].Val(),
+					ExpiresIn: ttls[i].Val().Round(time.Second).String(),
+					Sessions:  guard.sessionCount(key),
+				}
+
+				if added := killfeed.StreamIDTime(queue.Cursor); !added.IsZero() {
+					queue.CursorTime = &added
+				}
+
+				queues = append(queues, queue)
+			}
+		}
+
+		sort.Slice(queues, func(i, j int) bool {
+			if queues[i].QueueID != queues[j].QueueID {
+				return queues[i].QueueID < queues[j].QueueID
+			}
+
+			return queues[i].Transport < queues[j].Transport
+		})
+
+		render.JSON(w, r, queues)
+		return nil
+	}
+}
+
+// scanKeys returns the keys matching pattern. A cluster spreads keys across its masters, which
+// are scanned one after another.
+func scanKeys(ctx context.Context, rdb redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := rdb.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, rdb, pattern)
+	}
+
+	var mu sync.Mutex
+	keys := []string{}
+
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanNode(ctx, node, pattern)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		keys = append(keys, nodeKeys...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func scanNode(ctx context.Context, rdb redis.Cmdable, pattern string) ([]string, error) {
+	keys := []string{}
+
+	iter := rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// handleResetCursor moves the cursor of a queue and closes its sessions, which would otherwise keep
+// reading from their old position
+func handleResetCursor(rdb redis.UniversalClient, stream killfeed.StreamConfig, guard *queueGuard) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx := r.Context()
+
+		queueID, httpErr := queueIDParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		var request ResetCursorRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return httperror.BadRequestWithError("invalid request body", err)
+		}
+
+		if request.Transport != TransportWebsocket && request.Transport != TransportPoll {
+			return httperror.BadRequest(fmt.Sprintf("transport must be %s or %s", TransportWebsocket, TransportPoll))
+		}
+
+		if request.Cursor != "$" && request.Cursor != "0" && !streamIDPattern.MatchString(request.Cursor) {
+			return httperror.BadRequest("cursor must be a stream ID, \"0\" or \"$\"")
+		}
+
+		key := stream.Key(request.Transport, queueID)
+
+		// Queues without a cursor start at the end of the stream
+		cursor := request.Cursor
+		switch cursor {
+		case "$":
+			cursor = ""
+		case "0":
+			cursor = "0-0"
+		}
+
+		// The reset bumps the epoch of the cursor, so sessions still reading from the old position
+		// cannot overwrite it while they are being closed
+		if err := resetCursor(ctx, rdb, key, cursor); err != nil {
+			return httperror.InternalServerError("failed to reset queue cursor", err)
+		}
+
+		if err := guard.evictQueue(ctx, key, evictCursorReset); err != nil {
+			return httperror.InternalServerError("failed to close queue sessions", err)
+		}
+
+		zerolog.Ctx(r.Context()).Info().Str("queue-id", queueID).Str("transport", request.Transport).Str("cursor", request.Cursor).Msg("reset queue cursor")
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// handleAdminSessions lists the websocket sessions of this instance, optionally of a single queue
+func handleAdminSessions(m *melody.Melody) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		sessions, err := m.Sessions()
+		if err != nil {
+			return httperror.InternalServerError("failed to list websocket sessions", err)
+		}
+
+		queueID := r.URL.Query().Get("queue_id")
+		response := []SessionStatus{}
+
+		for _, s := range sessions {
+			client, ok := s.Keys["client"].(*websocketClient)
+			if !ok || (queueID != "" && client.queueID != queueID) {
+				continue
+			}
+
+			response = append(response, client.status(s))
+		}
+
+		sort.Slice(response, func(i, j int) bool {
+			return response[i].ConnectedAt.Before(response[j].ConnectedAt)
+		})
+
+		render.JSON(w, r, response)
+		return nil
+	}
+}
+
+// handleDisconnectSession closes a session on whichever instance holds it. The session is closed
+// asynchronously, so the request is only accepted.
+func handleDisconnectSession(guard *queueGuard) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		sessionID := chi.URLParam(r, "sessionID")
+
+		if err := guard.evictSession(r.Context(), sessionID, evictDisconnect); err != nil {
+			return httperror.InternalServerError("failed to disconnect session", err)
+		}
+
+		zerolog.Ctx(r.Context()).Info().Str("session-id", sessionID).Msg("disconnecting session")
+
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+}
+
+func (c *websocketClient) status(s *melody.Session) SessionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return SessionStatus{
+		ID:          c.id,
+		QueueID:     c.queueID,
+		Stream:      c.stream.Name,
+		Subject:     c.subject,
+		RemoteAddr:  s.Request.RemoteAddr,
+		Format:      c.format,
+		Envelope:    c.envelope,
+		Private:     c.private,
+		Cursor:      c.cursor,
+		Paused:      c.paused,
+		Subscribed:  !c.unsubscribed,
+		Filter:      c.filter,
+		Sent:        c.sent,
+		Skipped:     c.skipped,
+		ConnectedAt: c.connectedAt.UTC(),
+		Lag:         c.lag,
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"killfeed"
+	"killfeed/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+	"github.com/redis/go-redis/v9"
+)
+
+// newAdminTestRouter serves the admin endpoints like main, without authentication. Evictions are
+// delivered to the sessions registered with the returned guard.
+func newAdminTestRouter(t *testing.T, rdb *redis.Client, numSub func(channels ...string) map[string]int) (*Router, *queueGuard) {
+	t.Helper()
+
+	config := killfeed.Config{
+		Stream:         killfeed.StreamConfig{Name: killfeed.StreamKillmails},
+		BackfillStream: killfeed.StreamConfig{Name: killfeed.StreamKillmails + ":backfill"},
+	}
+
+	guard := newQueueGuard(rdb, ratelimit.New(rdb), killfeed.StreamAPIConfig{QueueSessionPolicy: killfeed.QueueSessionFanout})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go guard.watchEvictions(ctx)
+	waitForSubscriber(t, numSub)
+
+	r := NewRouter()
+	r.Get("/admin/status", handleAdminStatus(rdb, config, melody.New()))
+	r.Get("/admin/queues", handleAdminQueues(rdb, config.Stream, guard))
+	r.Put("/admin/queues/{queueID}/cursor", handleResetCursor(rdb, config.Stream, guard))
+	r.Delete("/admin/sessions/{sessionID}", handleDisconnectSession(guard))
+
+	return r, guard
+}
+
+func TestAdminStatus(t *testing.T) {
+	rdb, server := newTestRedis(t)
+	router, _ := newAdminTestRouter(t, rdb, server.PubSubNumSub)
+
+	addEntries(t, rdb, killfeed.StreamKillmails, 1, 3)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var status StatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid status %s: %v", w.Body, err)
+	}
+
+	// The backfill stream does not exist yet and is left out
+	if len(status.Streams) != 1 || status.Streams[0].Name != killfeed.StreamKillmails || status.Streams[0].Length != 3 {
+		t.Fatalf("expected the live stream with 3 entries, got %+v", status.Streams)
+	}
+
+	if status.Version != killfeed.Version {
+		t.Fatalf("expected version %s, got %s", killfeed.Version, status.Version)
+	}
+}
+
+func TestAdminQueues(t *testing.T) {
+	rdb, server := newTestRedis(t)
+	router, guard := newAdminTestRouter(t, rdb, server.PubSubNumSub)
+	ctx := context.Background()
+	stream := killfeed.StreamConfig{Name: killfeed.StreamKillmails}
+
+	for key, cursor := range map[string]string{
+		stream.Key(TransportWebsocket, "b"): "1700000000000-0",
+		stream.Key(TransportPoll, "a"):      "1700000000000-1",
+		stream.Key(TransportWebsocket, "a"): "1700000000000-2",
+	} {
+		if err := storeCursor(ctx, rdb, key, cursor, "0"); err != nil {
+			t.Fatalf("failed to store cursor: %v", err)
+		}
+	}
+
+	server.Set(stream.Key("owner", "a"), "key:owner")
+	// Keys of other streams are not listed
+	server.Set("stream:other:websocket:c", "1-0")
+
+	_, leave, httpErr := guard.join(ctx, stream.Key(TransportWebsocket, "a"), "session", func(eviction) {})
+	if httpErr != nil {
+		t.Fatalf("failed to join queue: %v", httpErr)
+	}
+
+	defer leave()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/queues", nil))
+
+	var queues []QueueStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &queues); err != nil {
+		t.Fatalf("invalid queues %s: %v", w.Body, err)
+	}
+
+	expected := []QueueStatus{
+		{QueueID: "a", Transport: TransportPoll, Cursor: "1700000000000-1", Owner: "key:owner"},
+		{QueueID: "a", Transport: TransportWebsocket, Cursor: "1700000000000-2", Owner: "key:owner", Sessions: 1},
+		{QueueID: "b", Transport: TransportWebsocket, Cursor: "1700000000000-0"},
+	}
+
+	if len(queues) != len(expected) {
+		t.Fatalf("expected %d queues, got %+v", len(expected), queues)
+	}
+
+	for i, queue := range queues {
+		want := expected[i]
+		if queue.QueueID != want.QueueID || queue.Transport != want.Transport || queue.Cursor != want.Cursor || queue.Owner != want.Owner || queue.Sessions != want.Sessions {
+			t.Fatalf("queue %d: expected %+v, got %+v", i, want, queue)
+		}
+
+		if queue.CursorTime == nil || !queue.CursorTime.Equal(time.UnixMilli(1700000000000)) {
+			t.Fatalf("queue %d: expected the cursor time, got %v", i, queue.CursorTime)
+		}
+	}
+}
+
+func TestAdminResetCursor(t *testing.T) {
+	rdb, server := newTestRedis(t)
+	router, guard := newAdminTestRouter(t, rdb, server.PubSubNumSub)
+	ctx := context.Background()
+	key := killfeed.StreamConfig{Name: killfeed.StreamKillmails}.Key(TransportWebsocket, "queue")
+
+	if err := storeCursor(ctx, rdb, key, "5-0", "0"); err != nil {
+		t.Fatalf("failed to store cursor: %v", err)
+	}
+
+	_, epoch, err := loadCursor(ctx, rdb, key)
+	if err != nil {
+		t.Fatalf("failed to load cursor: %v", err)
+	}
+
+	evicted := make(evictions, 1)
+	_, leave, httpErr := guard.join(ctx, key, "session", evicted.evict)
+	if httpErr != nil {
+		t.Fatalf("failed to join queue: %v", httpErr)
+	}
+
+	defer leave()
+
+	for body, status := range map[string]int{
+		`{"transport":"carrier-pigeon","cursor":"0"}`: http.StatusBadRequest,
+		`{"transport":"websocket","cursor":"latest"}`: http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/queues/queue/cursor", strings.NewReader(body)))
+
+		if w.Code != status {
+			t.Fatalf("expected %d for %s, got %d", status, body, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/queues/queue/cursor", strings.NewReader(`{"transport":"websocket","cursor":"0"}`)))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	cursor, resetEpoch, err := loadCursor(ctx, rdb, key)
+	if err != nil || cursor != "0-0" {
+		t.Fatalf("expected the cursor to replay the stream, got %q: %v", cursor, err)
+	}
+
+	if resetEpoch == epoch {
+		t.Fatalf("epoch %s not bumped by the reset", epoch)
+	}
+
+	// The session still reading from the old position can neither keep reading nor store its cursor
+	select {
+	case e := <-evicted:
+		if e != evictCursorReset {
+			t.Fatalf("expected the cursor reset eviction, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session of the queue was not evicted")
+	}
+
+	if err := storeCursor(ctx, rdb, key, "6-0", epoch); !errors.Is(err, errCursorReset) {
+		t.Fatalf("expected errCursorReset for the old epoch, got %v", err)
+	}
+}
+
+func TestAdminDisconnectSession(t *testing.T) {
+	rdb, server := newTestRedis(t)
+	router, guard := newAdminTestRouter(t, rdb, server.PubSubNumSub)
+	ctx := context.Background()
+
+	disconnected := make(evictions, 1)
+	_, leaveFirst, httpErr := guard.join(ctx, "stream:websocket:queue", "first", disconnected.evict)
+	if httpErr != nil {
+		t.Fatalf("failed to join queue: %v", httpErr)
+	}
+
+	defer leaveFirst()
+
+	other := make(evictions, 1)
+	_, leaveSecond, httpErr := guard.join(ctx, "stream:websocket:queue", "second", other.evict)
+	if httpErr != nil {
+		t.Fatalf("failed to join queue: %v", httpErr)
+	}
+
+	defer leaveSecond()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/sessions/first", nil))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+
+	select {
+	case e := <-disconnected:
+		if e != evictDisconnect {
+			t.Fatalf("expected the disconnect eviction, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not disconnected")
+	}
+
+	select {
+	case e := <-other:
+		t.Fatalf("other session of the queue evicted: %+v", e)
+	default:
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"killfeed/apikey"
+	"killfeed/httperror"
+	"killfeed/sso"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+type contextKey string
+
+const (
+	apiKeyContextKey  contextKey = "apikey"
+	sessionContextKey contextKey = "session"
+	slotContextKey    contextKey = "slot"
+)
+
+// authenticate resolves the API key or SSO session of a request and stores it in the request
+// context. Credentials are sent as a bearer token or X-API-Key header, websocket upgrades may also
+// use the api_key query parameter since browsers cannot set headers on websockets. Requests without
+// credentials pass through, requireScope decides whether a route needs them.
+func authenticate(keys *apikey.Store, sessions *sso.SessionStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := requestAPIKey(r)
+			if raw == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, httpErr := authenticateRequest(r.Context(), keys, sessions, raw)
+			if httpErr != nil {
+				render.Render(w, r, httpErr)
+				zerolog.Ctx(r.Context()).Warn().Err(httpErr).Int("status", httpErr.Code).Msg("request failed")
+				return
+			}
+
+			r = r.WithContext(ctx)
+			logClient(ctx, clientSubject(r))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func authenticateRequest(ctx context.Context, keys *apikey.Store, sessions *sso.SessionStore, raw string) (context.Context, *httperror.HTTPError) {
+	// Sessions act as keys that may read the stream and manage their own subscriptions, restricted
+	// to the kills of the pilot's corporation and alliance
+	if sessions != nil && strings.HasPrefix(raw, sso.TokenPrefix) {
+		session, err := sessions.Get(ctx, raw)
+		if errors.Is(err, sso.ErrSessionNotFound) {
+			return nil, httperror.Unauthorized("invalid or expired session")
+		}
+
+		if err != nil {
+			return nil, httperror.InternalServerError("failed to read session", err)
+		}
+
+		key := apikey.Key{
+			ID:     fmt.Sprintf("sso:%d", session.CharacterID),
+			Name:   session.CharacterName,
+			Scopes: []string{apikey.ScopeReadStream, apikey.ScopeManageSubscriptions},
+		}
+
+		ctx = context.WithValue(ctx, apiKeyContextKey, key)
+		return context.WithValue(ctx, sessionContextKey, session), nil
+	}
+
+	key, err := keys.Authenticate(ctx, raw)
+	if errors.Is(err, apikey.ErrInvalidKey) {
+		return nil, httperror.Unauthorized("invalid API key")
+	}
+
+	if err != nil {
+		return nil, httperror.InternalServerError("failed to authenticate API key", err)
+	}
+
+	return context.WithValue(ctx, apiKeyContextKey, key), nil
+}
+
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r.URL.Query().Get("api_key")
+	}
+
+	return ""
+}
+
+// requestKey returns the authenticated API key of a request, if any
+func requestKey(r *http.Request) (apikey.Key, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey).(apikey.Key)
+	return key, ok
+}
+
+// clientSubject identifies the client of a request by API key or session, falling back to its IP
+func clientSubject(r *http.Request) string {
+	if key, ok := requestKey(r); ok {
+		return "key:" + key.ID
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return "ip:" + ip
+}
+
+// requestSession returns the SSO session of a request, if any. Everything a session reads is
+// restricted to kills involving the pilot's corporation or alliance.
+func requestSession(r *http.Request) *sso.Session {
+	session, ok := r.Context().Value(sessionContextKey).(sso.Session)
+	if !ok {
+		return nil
+	}
+
+	return &session
+}
+
+// requireScope rejects requests whose key lacks scope. With authentication disabled only the admin
+// scope is enforced, so the admin API is never open.
+func requireScope(enabled bool, scope string, handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		if !enabled && scope != apikey.ScopeAdmin {
+			return handlerFn(w, r)
+		}
+
+		key, ok := requestKey(r)
+		if !ok {
+			return httperror.Unauthorized("missing API key")
+		}
+
+		if !key.HasScope(scope) {
+			return httperror.Forbidden("API key lacks the " + scope + " scope")
+		}
+
+		return handlerFn(w, r)
+	}
+}
+
+// canManageSubscriptions reports whether a request may send websocket commands that change its subscription
+func canManageSubscriptions(enabled bool, r *http.Request) bool {
+	if !enabled {
+		return true
+	}
+
+	key, ok := requestKey(r)
+	return ok && key.HasScope(apikey.ScopeManageSubscriptions)
+}
+
+type CreateKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Tier is the rate limit tier, it defaults to the default tier
+	Tier string `json:"tier,omitempty"`
+}
+
+type CreateKeyResponse struct {
+	apikey.Key
+	// Secret is the key string clients authenticate with, it is only returned once
+	Secret string `json:"key"`
+}
+
+type ListKeysResponse struct {
+	Keys []apikey.Key `json:"keys"`
+}
+
+func handleCreateKey(keys *apikey.Store, limits *rateLimits) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		var request CreateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return httperror.BadRequestWithError("invalid request body", err)
+		}
+
+		if request.Name == "" {
+			return httperror.BadRequest("missing name")
+		}
+
+		if len(request.Scopes) == 0 {
+			return httperror.BadRequest("missing scopes")
+		}
+
+		for _, scope := range request.Scopes {
+			if !apikey.IsScope(scope) {
+				return httperror.BadRequest("unknown scope " + scope)
+			}
+		}
+
+		// Tiers can change with a config reload
+		if _, ok := limits.config.Load().RateLimitTiers[request.Tier]; request.Tier != "" && !ok {
+			return httperror.BadRequest("unknown tier " + request.Tier)
+		}
+
+		key, raw, err := keys.Create(r.Context(), request.Name, request.Scopes, request.Tier)
+		if err != nil {
+			return httperror.InternalServerError("failed to create API key", err)
+		}
+
+		if admin, ok := requestKey(r); ok {
+			zerolog.Ctx(r.Context()).Info().Str("key-id", key.ID).Str("created-by", admin.ID).Strs("scopes", key.Scopes).Msg("created API key")
+		}
+
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, CreateKeyResponse{Key: key, Secret: raw})
+		return nil
+	}
+}
+
+func handleListKeys(keys *apikey.Store) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		list, err := keys.List(r.Context())
+		if err != nil {
+			return httperror.InternalServerError("failed to list API keys", err)
+		}
+
+		render.JSON(w, r, ListKeysResponse{Keys: list})
+		return nil
+	}
+}
+
+func handleRevokeKey(keys *apikey.Store) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		keyID := chi.URLParam(r, "keyID")
+
+		err := keys.Revoke(r.Context(), keyID)
+		if errors.Is(err, apikey.ErrNotFound) {
+			return httperror.NotFound("API key not found")
+		}
+
+		if err != nil {
+			return httperror.InternalServerError("failed to revoke API key", err)
+		}
+
+		zerolog.Ctx(r.Context()).Info().Str("key-id", keyID).Msg("revoked API key")
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
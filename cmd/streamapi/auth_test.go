@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"killfeed/apikey"
+	"killfeed/httperror"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newAuthTestRouter serves a stream route and admin-scoped routes like main, with authentication of
+// the stream route switched by enabled
+func newAuthTestRouter(keys *apikey.Store, enabled bool) *Router {
+	ok := func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	r := NewRouter()
+	r.Use(authenticate(keys, nil))
+	r.Get("/killmails", requireScope(enabled, apikey.ScopeReadStream, ok))
+	r.Get("/websocket/{queueID}", requireScope(enabled, apikey.ScopeReadStream, ok))
+	r.Get("/metrics", requireScope(enabled, apikey.ScopeAdmin, ok))
+	r.Get("/admin/keys", requireScope(enabled, apikey.ScopeAdmin, handleListKeys(keys)))
+	r.Get("/admin/status", requireScope(enabled, apikey.ScopeAdmin, ok))
+
+	return r
+}
+
+func serve(handler http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestAuthenticateCredentials(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	keys := apikey.NewStore(rdb)
+
+	_, raw, err := keys.Create(context.Background(), "reader", []string{apikey.ScopeReadStream}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	router := newAuthTestRouter(keys, true)
+
+	tests := []struct {
+		name    string
+		path    string
+		header  string
+		value   string
+		upgrade bool
+		status  int
+	}{
+		{name: "bearer token", path: "/killmails", header: "Authorization", value: "Bearer " + raw, status: http.StatusOK},
+		{name: "X-API-Key header", path: "/killmails", header: "X-API-Key", value: raw, status: http.StatusOK},
+		{name: "no credentials", path: "/killmails", status: http.StatusUnauthorized},
+		{name: "invalid bearer token", path: "/killmails", header: "Authorization", value: "Bearer kf_000000000000_invalid", status: http.StatusUnauthorized},
+		{name: "invalid X-API-Key header", path: "/killmails", header: "X-API-Key", value: "invalid", status: http.StatusUnauthorized},
+		{name: "token without bearer scheme", path: "/killmails", header: "Authorization", value: raw, status: http.StatusUnauthorized},
+		// Query parameters end up in access logs and browser history, so they are only accepted
+		// where headers cannot be set
+		{name: "query parameter on a websocket upgrade", path: "/websocket/queue?api_key=" + raw, upgrade: true, status: http.StatusOK},
+		{name: "query parameter without upgrade", path: "/websocket/queue?api_key=" + raw, status: http.StatusUnauthorized},
+		{name: "query parameter on a plain request", path: "/killmails?api_key=" + raw, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+
+			if test.upgrade {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			}
+
+			if status := serve(router, r); status != test.status {
+				t.Fatalf("expected %d, got %d", test.status, status)
+			}
+		})
+	}
+
+	// The bearer token takes precedence over the X-API-Key header, which takes precedence over the
+	// query parameter, so a valid key does not hide an invalid one of higher precedence
+	r := httptest.NewRequest(http.MethodGet, "/websocket/queue?api_key="+raw, nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("X-API-Key", "invalid")
+
+	if status := serve(router, r); status != http.StatusUnauthorized {
+		t.Fatalf("expected the X-API-Key header to take precedence, got %d", status)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+raw)
+
+	if status := serve(router, r); status != http.StatusOK {
+		t.Fatalf("expected the bearer token to take precedence, got %d", status)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	keys := apikey.NewStore(rdb)
+
+	_, read, err := keys.Create(context.Background(), "reader", []string{apikey.ScopeReadStream}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	_, admin, err := keys.Create(context.Background(), "admin", []string{apikey.ScopeAdmin}, "")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	for _, enabled := range []bool{true, false} {
+		router := newAuthTestRouter(keys, enabled)
+
+		for _, path := range []string{"/metrics", "/admin/keys", "/admin/status"} {
+			tests := []struct {
+				key    string
+				status int
+			}{
+				// The admin scope is required even with authentication disabled
+				{key: "", status: http.StatusUnauthorized},
+				{key: read, status: http.StatusForbidden},
+				{key: admin, status: http.StatusOK},
+			}
+
+			for _, test := range tests {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if test.key != "" {
+					r.Header.Set("Authorization", "Bearer "+test.key)
+				}
+
+				if status := serve(router, r); status != test.status {
+					t.Fatalf("expected %d for %s with authentication enabled %v, got %d", test.status, path, enabled, status)
+				}
+			}
+		}
+
+		// Admin keys read the stream as well, anonymous clients only with authentication disabled
+		anonymous := http.StatusUnauthorized
+		if !enabled {
+			anonymous = http.StatusOK
+		}
+
+		for key, status := range map[string]int{"": anonymous, read: http.StatusOK, admin: http.StatusOK} {
+			r := httptest.NewRequest(http.MethodGet, "/killmails", nil)
+			if key != "" {
+				r.Header.Set("X-API-Key", key)
+			}
+
+			if got := serve(router, r); got != status {
+				t.Fatalf("expected %d for the stream with authentication enabled %v, got %d", status, enabled, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"killfeed"
+	"killfeed/apikey"
+	"killfeed/classify"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/olahol/melody"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Commands clients can send as JSON text frames
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandPause       = "pause"
+	CommandResume      = "resume"
+	CommandSeek        = "seek"
+	CommandStats       = "stats"
+)
+
+// Error kinds of command errors
+const (
+	ErrorInvalidCommand = "invalid_command"
+	ErrorUnknownCommand = "unknown_command"
+	ErrorInvalidFilter  = "invalid_filter"
+	ErrorInvalidCursor  = "invalid_cursor"
+	ErrorForbidden      = "forbidden"
+	ErrorInternal       = "internal"
+)
+
+var streamIDPattern = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+// Command is a message sent by a client. ID is optional and echoed in the reply so clients can
+// match replies to commands.
+type Command struct {
+	Command string         `json:"command"`
+	ID      string         `json:"id,omitempty"`
+	Filter  *CommandFilter `json:"filter,omitempty"`
+	// Cursor is a stream ID, "0" for the oldest retained killmail or "$" for only new killmails
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// CommandFilter selects the killmails delivered to a subscription, zero values match everything
+type CommandFilter struct {
+	CharacterID   int32   `json:"character_id,omitempty"`
+	CorporationID int32   `json:"corporation_id,omitempty"`
+	AllianceID    int32   `json:"alliance_id,omitempty"`
+	SystemID      int32   `json:"system_id,omitempty"`
+	RegionID      int32   `json:"region_id,omitempty"`
+	MinValue      float64 `json:"min_value,omitempty"`
+	MaxValue      float64 `json:"max_value,omitempty"`
+	// Tags must all be present on a killmail
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (f *CommandFilter) validate() error {
+	for name, value := range map[string]int32{
+		"character_id":   f.CharacterID,
+		"corporation_id": f.CorporationID,
+		"alliance_id":    f.AllianceID,
+		"system_id":      f.SystemID,
+		"region_id":      f.RegionID,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s must be a positive integer", name)
+		}
+	}
+
+	if f.MinValue < 0 || f.MaxValue < 0 {
+		return fmt.Errorf("min_value and max_value must be non-negative numbers")
+	}
+
+	if f.MaxValue != 0 && f.MinValue > f.MaxValue {
+		return fmt.Errorf("min_value must not exceed max_value")
+	}
+
+	if slices.Contains(f.Tags, "") {
+		return fmt.Errorf("tags must not be empty")
+	}
+
+	return nil
+}
+
+func (f *CommandFilter) match(ctx context.Context, resolver classify.Resolver, killmail killfeed.CombinedKillmail) (bool, error) {
+	for _, tag := range f.Tags {
+		if !slices.Contains(killmail.Tags, tag) {
+			return false, nil
+		}
+	}
+
+	filter := killmailFilter{
+		characterID:   f.CharacterID,
+		corporationID: f.CorporationID,
+		allianceID:    f.AllianceID,
+		systemID:      f.SystemID,
+		regionID:      f.RegionID,
+		minValue:      f.MinValue,
+		maxValue:      f.MaxValue,
+	}
+
+	return filter.match(ctx, resolver, killmail)
+}
+
+type AckData struct {
+	Command string         `json:"command"`
+	ID      string         `json:"id,omitempty"`
+	Filter  *CommandFilter `json:"filter,omitempty"`
+	Cursor  string         `json:"cursor,omitempty"`
+}
+
+type StatsData struct {
+	ID          string         `json:"id,omitempty"`
+	QueueID     string         `json:"queue_id"`
+	Stream      string         `json:"stream"`
+	Cursor      string         `json:"cursor"`
+	Paused      bool           `json:"paused"`
+	Subscribed  bool           `json:"subscribed"`
+	Filter      *CommandFilter `json:"filter,omitempty"`
+	Sent        int64          `json:"sent"`
+	Skipped     int64          `json:"skipped"`
+	ConnectedAt time.Time      `json:"connected_at"`
+	// Lag is the last measured lag, it is measured periodically while the session reads
+	Lag LagData `json:"lag"`
+}
+
+// commandError is a validation failure reported to the client, the connection stays open
+type commandError struct {
+	kind    string
+	message string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+func invalid(kind string, format string, args ...any) *commandError {
+	return &commandError{kind: kind, message: fmt.Sprintf(format, args...)}
+}
+
+// handleCommand runs a command sent by a client. Replies are always wrapped in envelopes, also for
+// clients that did not opt in to the envelope protocol, since only protocol aware clients send commands.
+func handleCommand(ctx context.Context, logger zerolog.Logger, rdb redis.UniversalClient, s *melody.Session, client *websocketClient, raw []byte) {
+	var command Command
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	reply, err := Envelope{}, error(nil)
+	if decodeErr := decoder.Decode(&command); decodeErr != nil {
+		err = invalid(ErrorInvalidCommand, "malformed command: %s", decodeErr)
+	} else {
+		reply, err = client.runCommand(ctx, rdb, command)
+	}
+
+	if err != nil {
+		data := ErrorData{Code: http.StatusBadRequest, Error: ErrorInternal, Message: err.Error(), Command: command.Command, ID: command.ID}
+
+		if cmdErr, ok := err.(*commandError); ok {
+			data.Error = cmdErr.kind
+		} else {
+			logger.Error().Err(err).Str("command", command.Command).Msg("failed to run websocket command")
+			data.Code = http.StatusInternalServerError
+			data.Message = "internal server error"
+		}
+
+		reply = Envelope{Type: EnvelopeError, Data: data}
+	}
+
+	if err := client.reply(s, reply); err != nil {
+		logger.Error().Err(err).Msg("failed to write command reply")
+	}
+}
+
+func (c *websocketClient) runCommand(ctx context.Context, rdb redis.UniversalClient, command Command) (Envelope, error) {
+	ack := AckData{Command: command.Command, ID: command.ID}
+
+	if command.Filter != nil && command.Command != CommandSubscribe {
+		return Envelope{}, invalid(ErrorInvalidCommand, "filter is only allowed on %s", CommandSubscribe)
+	}
+
+	if command.Cursor != "" && command.Command != CommandSeek {
+		return Envelope{}, invalid(ErrorInvalidCommand, "cursor is only allowed on %s", CommandSeek)
+	}
+
+	if !c.canManage && command.Command != CommandStats {
+		return Envelope{}, invalid(ErrorForbidden, "API key lacks the %s scope", apikey.ScopeManageSubscriptions)
+	}
+
+	switch command.Command {
+	case CommandSubscribe:
+		if command.Filter != nil {
+			if err := command.Filter.validate(); err != nil {
+				return Envelope{}, invalid(ErrorInvalidFilter, "%s", err)
+			}
+		}
+
+		c.mu.Lock()
+		c.unsubscribed = false
+		c.filter = command.Filter
+		c.mu.Unlock()
+
+		ack.Filter = command.Filter
+
+	case CommandUnsubscribe:
+		c.mu.Lock()
+		c.unsubscribed = true
+		c.mu.Unlock()
+
+	case CommandPause:
+		c.mu.Lock()
+		if !c.paused {
+			c.paused = true
+			c.resumed = make(chan struct{})
+		}
+		c.mu.Unlock()
+
+	case CommandResume:
+		c.mu.Lock()
+		if c.paused {
+			c.paused = false
+			close(c.resumed)
+		}
+		c.mu.Unlock()
+
+	case CommandSeek:
+		cursor, err := c.resolveCursor(ctx, rdb, command.Cursor)
+		if err != nil {
+			return Envelope{}, err
+		}
+
+		c.mu.Lock()
+		err = c.setCursor(ctx, rdb, cursor)
+		c.generation++
+		c.mu.Unlock()
+
+		if err != nil {
+			return Envelope{}, err
+		}
+
+		ack.Cursor = cursor
+
+	case CommandStats:
+		return Envelope{Type: EnvelopeStats, Data: c.stats(command.ID)}, nil
+
+	case "":
+		return Envelope{}, invalid(ErrorInvalidCommand, "missing command")
+
+	default:
+		return Envelope{}, invalid(ErrorUnknownCommand, "unknown command %q", command.Command)
+	}
+
+	return Envelope{Type: EnvelopeAck, Data: ack}, nil
+}
+
+// resolveCursor turns a seek target into a stream ID to read after
+func (c *websocketClient) resolveCursor(ctx context.Context, rdb redis.UniversalClient, cursor string) (string, error) {
+	switch {
+	case cursor == "":
+		return "", invalid(ErrorInvalidCursor, "missing cursor")
+
+	case cursor == "$":
+		return lastStreamID(ctx, rdb, c.stream)
+
+	case cursor == "0":
+		return "0-0", nil
+
+	case streamIDPattern.MatchString(cursor):
+		return cursor, nil
+
+	default:
+		return "", invalid(ErrorInvalidCursor, "cursor must be a stream ID, \"0\" or \"$\"")
+	}
+}
+
+func (c *websocketClient) stats(id string) StatsData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return StatsData{
+		ID:          id,
+		QueueID:     c.queueID,
+		Stream:      c.stream.Name,
+		Cursor:      c.cursor,
+		Paused:      c.paused,
+		Subscribed:  !c.unsubscribed,
+		Filter:      c.filter,
+		Sent:        c.sent,
+		Skipped:     c.skipped,
+		ConnectedAt: c.connectedAt.UTC(),
+		Lag:         c.lag,
+	}
+}
+
+// reply writes an envelope regardless of whether the client opted in to envelopes
+func (c *websocketClient) reply(s *melody.Session, envelope Envelope) error {
+	frame, err := encodeEnvelope(c.format, envelope)
+	if err != nil {
+		return err
+	}
+
+	return c.send(s, frame)
+}
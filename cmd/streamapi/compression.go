@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// writeCompressed writes a response body, compressed with the best encoding the client accepts
+func writeCompressed(w http.ResponseWriter, r *http.Request, enabled bool, contentType string, body []byte) error {
+	encoding := ""
+	if enabled {
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+
+	var buf bytes.Buffer
+
+	switch encoding {
+	case "br":
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err := bw.Write(body); err != nil {
+			return err
+		}
+
+		if err := bw.Close(); err != nil {
+			return err
+		}
+
+	case "gzip":
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(body); err != nil {
+			return err
+		}
+
+		if err := gw.Close(); err != nil {
+			return err
+		}
+
+	default:
+		encoding = "identity"
+		buf.Write(body)
+	}
+
+	pollPayloadBytes.Add(float64(len(body)))
+	pollWireBytes.WithLabelValues(encoding).Add(float64(buf.Len()))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if encoding != "identity" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// negotiateEncoding picks br over gzip when the client accepts both, ignoring quality values other than 0
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	default:
+		return ""
+	}
+}
+
+// countingResponseWriter hands out connections counting the bytes written to them when hijacked,
+// which is how websocket traffic after compression is measured
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return countingConn{Conn: conn}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	websocketWireBytes.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errCursorReset is returned when a session stores a cursor after an admin reset the queue's
+// cursor, the session is being evicted and its position is stale
+var errCursorReset = errors.New("queue cursor was reset")
+
+// storeCursorScript stores a queue cursor unless the epoch of the queue changed since the session
+// loaded its cursor. Resets bump the epoch, so writes of sessions they evict are rejected even when
+// they arrive after the reset.
+var storeCursorScript = redis.NewScript(`
+if (redis.call("GET", KEYS[2]) or "0") ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+redis.call("PEXPIRE", KEYS[2], ARGV[3])
+return 1
+`)
+
+// cursorEpochKey is the key of the reset counter of a cursor, it is in the same cluster slot as the cursor
+func cursorEpochKey(key string) string {
+	return killfeed.ColocatedKey(key, ":epoch")
+}
+
+// loadCursor returns the stored cursor of a queue, empty for new queues, and the epoch to store it with
+func loadCursor(ctx context.Context, rdb redis.UniversalClient, key string) (string, string, error) {
+	values, err := rdb.MGet(ctx, key, cursorEpochKey(key)).Result()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get latest ID from redis: %w", err)
+	}
+
+	cursor, _ := values[0].(string)
+
+	epoch, ok := values[1].(string)
+	if !ok {
+		epoch = "0"
+	}
+
+	return cursor, epoch, nil
+}
+
+// storeCursor stores the cursor of a queue, it returns errCursorReset when the cursor was reset
+// after it was loaded with epoch
+func storeCursor(ctx context.Context, rdb redis.UniversalClient, key string, cursor string, epoch string) error {
+	stored, err := storeCursorScript.Run(ctx, rdb, []string{key, cursorEpochKey(key)}, cursor, epoch, queueClaimTTL.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to store latest ID to redis: %w", err)
+	}
+
+	if stored == 0 {
+		return errCursorReset
+	}
+
+	return nil
+}
+
+// resetCursor moves the cursor of a queue and bumps its epoch, so sessions that loaded the old
+// cursor can no longer store theirs. An empty cursor removes it, the queue starts at the end of the
+// stream again.
+func resetCursor(ctx context.Context, rdb redis.UniversalClient, key string, cursor string) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, cursorEpochKey(key))
+		pipe.Expire(ctx, cursorEpochKey(key), queueClaimTTL)
+
+		if cursor == "" {
+			pipe.Del(ctx, key)
+		} else {
+			pipe.Set(ctx, key, cursor, queueClaimTTL)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset queue cursor: %w", err)
+	}
+
+	return nil
+}
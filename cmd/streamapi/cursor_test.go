@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCursorReset(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+
+	ctx := context.Background()
+	key := "stream:websocket:queue"
+
+	cursor, epoch, err := loadCursor(ctx, rdb, key)
+	if err != nil || cursor != "" {
+		t.Fatalf("expected no cursor for a new queue, got %q: %v", cursor, err)
+	}
+
+	if err := storeCursor(ctx, rdb, key, "1-0", epoch); err != nil {
+		t.Fatalf("failed to store cursor: %v", err)
+	}
+
+	// A session still reading from before the reset cannot overwrite the reset cursor
+	if err := resetCursor(ctx, rdb, key, "0-0"); err != nil {
+		t.Fatalf("failed to reset cursor: %v", err)
+	}
+
+	if err := storeCursor(ctx, rdb, key, "2-0", epoch); !errors.Is(err, errCursorReset) {
+		t.Fatalf("expected errCursorReset, got %v", err)
+	}
+
+	cursor, epoch, err = loadCursor(ctx, rdb, key)
+	if err != nil || cursor != "0-0" {
+		t.Fatalf("expected the reset cursor, got %q: %v", cursor, err)
+	}
+
+	// Sessions that loaded the reset cursor store theirs as usual
+	if err := storeCursor(ctx, rdb, key, "3-0", epoch); err != nil {
+		t.Fatalf("failed to store cursor after reset: %v", err)
+	}
+
+	// Resetting to the end of the stream removes the cursor
+	if err := resetCursor(ctx, rdb, key, ""); err != nil {
+		t.Fatalf("failed to reset cursor: %v", err)
+	}
+
+	if cursor, _, _ := loadCursor(ctx, rdb, key); cursor != "" {
+		t.Fatalf("expected no cursor, got %q", cursor)
+	}
+}
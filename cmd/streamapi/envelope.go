@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"killfeed"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// EnvelopeVersion is the version of the websocket envelope protocol, clients opt in with ?protocol=1
+const EnvelopeVersion = 1
+
+// Envelope types sent to websocket clients
+const (
+	EnvelopeKillmail   = "killmail"
+	EnvelopeKillmails  = "killmails"
+	EnvelopeSubscribed = "subscribed"
+	EnvelopeHeartbeat  = "heartbeat"
+	EnvelopeError      = "error"
+	EnvelopeLag        = "lag"
+	EnvelopeGap        = "gap"
+	EnvelopeShutdown   = "shutdown"
+	EnvelopeAck        = "ack"
+	EnvelopeStats      = "stats"
+)
+
+// Envelope frames every message of the envelope protocol. Cursor is the stream ID of the last
+// killmail in data and is only set on killmail frames.
+type Envelope struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Cursor  string `json:"cursor,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type SubscribedData struct {
+	QueueID   string `json:"queue_id"`
+	Stream    string `json:"stream"`
+	Format    string `json:"format"`
+	BatchSize int    `json:"batch_size"`
+}
+
+type HeartbeatData struct {
+	Time time.Time `json:"time"`
+}
+
+// ErrorData describes a failure. Command errors carry the error kind and the failed command,
+// errors that close the connection only carry a code and message.
+type ErrorData struct {
+	Code    int    `json:"code"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+	Command string `json:"command,omitempty"`
+	ID      string `json:"id,omitempty"`
+}
+
+// LagData tells how far a queue is behind the head of its stream. EntriesBehind stops counting at
+// lagCountLimit, which is flagged with EntriesCapped.
+type LagData struct {
+	SecondsBehind int64 `json:"seconds_behind"`
+	EntriesBehind int64 `json:"entries_behind"`
+	EntriesCapped bool  `json:"entries_capped,omitempty"`
+}
+
+// GapData reports that entries after the cursor From were trimmed from the stream before they were
+// delivered, delivery continues at To, the oldest retained entry
+type GapData struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type ShutdownData struct {
+	Reason string `json:"reason"`
+}
+
+// encodeEnvelope encodes an envelope in the client's format
+func encodeEnvelope(format string, envelope Envelope) ([]byte, error) {
+	envelope.Version = EnvelopeVersion
+
+	if format != killfeed.FormatMsgpack {
+		return json.Marshal(envelope)
+	}
+
+	var buf bytes.Buffer
+
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+
+	if err := encoder.Encode(envelope); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// rawData embeds an already encoded killmail as envelope data without decoding it
+func rawData(format string, payload []byte) any {
+	if format == killfeed.FormatMsgpack {
+		return msgpack.RawMessage(payload)
+	}
+
+	return json.RawMessage(payload)
+}
+
+// rawDataList embeds already encoded killmails as a list in envelope data
+func rawDataList(format string, payloads [][]byte) any {
+	if format == killfeed.FormatMsgpack {
+		raw := make([]msgpack.RawMessage, len(payloads))
+		for i, payload := range payloads {
+			raw[i] = payload
+		}
+
+		return raw
+	}
+
+	raw := make([]json.RawMessage, len(payloads))
+	for i, payload := range payloads {
+		raw[i] = payload
+	}
+
+	return raw
+}
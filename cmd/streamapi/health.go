@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"killfeed/httperror"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/redis/go-redis/v9"
+)
+
+// readinessTimeout bounds the Redis checks, so a hanging Redis fails the probe instead of stalling it
+const readinessTimeout = 2 * time.Second
+
+// handleLive only tells that the process serves requests, dependencies are checked by handleReady
+func handleLive() HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		render.JSON(w, r, map[string]bool{"ok": true})
+		return nil
+	}
+}
+
+// handleReady fails while Redis is unreachable or the killmail stream does not exist, so no traffic
+// is routed to an instance that cannot serve it. withoutStream accepts a missing stream, which a
+// fresh deployment has until the poller added the first killmail.
+func handleReady(rdb redis.UniversalClient, stream string, withoutStream bool) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			return httperror.ServiceUnavailable("redis is unreachable", err)
+		}
+
+		if !withoutStream {
+			exists, err := rdb.Exists(ctx, stream).Result()
+			if err != nil {
+				return httperror.ServiceUnavailable("failed to check killmail stream", err)
+			}
+
+			if exists == 0 {
+				return httperror.ServiceUnavailable("killmail stream does not exist", errors.New(stream))
+			}
+		}
+
+		render.JSON(w, r, map[string]bool{"ok": true})
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func ready(handler HTTPHandlerWithErr) int {
+	if httpErr := handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil)); httpErr != nil {
+		return httpErr.Code
+	}
+
+	return http.StatusOK
+}
+
+func TestHandleReady(t *testing.T) {
+	rdb, server := newTestRedis(t)
+
+	// The killmail stream does not exist before the poller added the first killmail
+	if status := ready(handleReady(rdb, "killmails", false)); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a killmail stream, got %d", status)
+	}
+
+	if status := ready(handleReady(rdb, "killmails", true)); status != http.StatusOK {
+		t.Fatalf("expected a fresh deployment to be ready when allowed, got %d", status)
+	}
+
+	if err := rdb.XAdd(context.Background(), &redis.XAddArgs{Stream: "killmails", Values: map[string]any{"payload": "{}"}}).Err(); err != nil {
+		t.Fatalf("failed to add entry: %v", err)
+	}
+
+	if status := ready(handleReady(rdb, "killmails", false)); status != http.StatusOK {
+		t.Fatalf("expected ready with a killmail stream, got %d", status)
+	}
+
+	// Without retries the closed server fails the probe right away
+	unreachable := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { unreachable.Close() })
+	server.Close()
+
+	for _, withoutStream := range []bool{false, true} {
+		if status := ready(handleReady(unreachable, "killmails", withoutStream)); status != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 while redis is unreachable, got %d", status)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+	"killfeed/archive"
+	"killfeed/classify"
+	"killfeed/httperror"
+	"killfeed/sso"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+	searchMaxRange     = 31 * 24 * time.Hour
+)
+
+type KillmailSearchResponse struct {
+	Killmails []killfeed.CombinedKillmail `json:"killmails"`
+	// NextCursor is set until the range is exhausted, pages of selective searches can hold fewer
+	// killmails than the limit or none at all
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// killmailFilter holds the optional search criteria, zero values match everything
+type killmailFilter struct {
+	characterID   int32
+	corporationID int32
+	allianceID    int32
+	systemID      int32
+	regionID      int32
+	minValue      float64
+	maxValue      float64
+	// session restricts matches to the kills of a logged in pilot
+	session *sso.Session
+}
+
+func (f killmailFilter) match(ctx context.Context, resolver classify.Resolver, killmail killfeed.CombinedKillmail) (bool, error) {
+	if f.session != nil && !f.session.Involved(killmail) {
+		return false, nil
+	}
+
+	if f.systemID != 0 && killmail.SolarSystemId != f.systemID {
+		return false, nil
+	}
+
+	if f.minValue != 0 && killmail.Zkb.TotalValue < f.minValue {
+		return false, nil
+	}
+
+	if f.maxValue != 0 && killmail.Zkb.TotalValue > f.maxValue {
+		return false, nil
+	}
+
+	if !involves(killmail, f.characterID, f.corporationID, f.allianceID) {
+		return false, nil
+	}
+
+	if f.regionID != 0 {
+		system, err := resolver.System(ctx, killmail.SolarSystemId)
+		if err != nil {
+			return false, err
+		}
+
+		if system.RegionID != f.regionID {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// query describes the criteria, search cursors are bound to it so they cannot be reused with others
+func (f killmailFilter) query() string {
+	query := fmt.Sprintf("character=%d corporation=%d alliance=%d system=%d region=%d min=%g max=%g", f.characterID, f.corporationID, f.allianceID, f.systemID, f.regionID, f.minValue, f.maxValue)
+
+	if f.session != nil {
+		query += fmt.Sprintf(" session=%d:%d:%d", f.session.CharacterID, f.session.CorporationID, f.session.AllianceID)
+	}
+
+	return query
+}
+
+// involves reports whether every given entity appears on the killmail, as victim or attacker
+func involves(killmail killfeed.CombinedKillmail, characterID int32, corporationID int32, allianceID int32) bool {
+	if characterID == 0 && corporationID == 0 && allianceID == 0 {
+		return true
+	}
+
+	matches := func(character int32, corporation int32, alliance int32) bool {
+		return (characterID == 0 || character == characterID) &&
+			(corporationID == 0 || corporation == corporationID) &&
+			(allianceID == 0 || alliance == allianceID)
+	}
+
+	if matches(killmail.Victim.CharacterId, killmail.Victim.CorporationId, killmail.Victim.AllianceId) {
+		return true
+	}
+
+	for _, attacker := range killmail.Attackers {
+		if matches(attacker.CharacterId, attacker.CorporationId, attacker.AllianceId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseInt32Param(r *http.Request, name string) (int32, *httperror.HTTPError) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil || value <= 0 {
+		return 0, httperror.BadRequest(fmt.Sprintf("%s must be a positive integer", name))
+	}
+
+	return int32(value), nil
+}
+
+func parseFloatParam(r *http.Request, name string) (float64, *httperror.HTTPError) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 {
+		return 0, httperror.BadRequest(fmt.Sprintf("%s must be a non-negative number", name))
+	}
+
+	return value, nil
+}
+
+func parseTimeParam(r *http.Request, name string) (time.Time, *httperror.HTTPError) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return time.Time{}, httperror.BadRequest(fmt.Sprintf("missing %s", name))
+	}
+
+	value, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, httperror.BadRequest(fmt.Sprintf("%s must be an RFC 3339 timestamp", name))
+	}
+
+	return value, nil
+}
+
+func handleKillmailSearch(arch *archive.Archive, resolver classify.Resolver) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx := r.Context()
+
+		if arch == nil {
+			return httperror.NotFound("killmail archive is not configured")
+		}
+
+		filter := killmailFilter{session: requestSession(r)}
+		var httpErr *httperror.HTTPError
+
+		for name, target := range map[string]*int32{
+			"character_id":   &filter.characterID,
+			"corporation_id": &filter.corporationID,
+			"alliance_id":    &filter.allianceID,
+			"system_id":      &filter.systemID,
+			"region_id":      &filter.regionID,
+		} {
+			if *target, httpErr = parseInt32Param(r, name); httpErr != nil {
+				return httpErr
+			}
+		}
+
+		if filter.minValue, httpErr = parseFloatParam(r, "min_value"); httpErr != nil {
+			return httpErr
+		}
+
+		if filter.maxValue, httpErr = parseFloatParam(r, "max_value"); httpErr != nil {
+			return httpErr
+		}
+
+		limit := searchDefaultLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil || value <= 0 || value > searchMaxLimit {
+				return httperror.BadRequest(fmt.Sprintf("limit must be between 1 and %d", searchMaxLimit))
+			}
+
+			limit = value
+		}
+
+		killmailID, httpErr := parseInt32Param(r, "killmail_id")
+		if httpErr != nil {
+			return httpErr
+		}
+
+		// A killmail ID pins down a single killmail, so the index is used instead of scanning
+		if killmailID != 0 {
+			response := KillmailSearchResponse{Killmails: []killfeed.CombinedKillmail{}}
+
+			killmail, err := arch.Get(ctx, killmailID)
+			if err != nil && !errors.Is(err, archive.ErrKillmailNotFound) {
+				return httperror.InternalServerError("failed to read killmail from archive", err)
+			}
+
+			if err == nil {
+				ok, err := filter.match(ctx, resolver, killmail)
+				if err != nil {
+					return httperror.InternalServerError("failed to filter killmail", err)
+				}
+
+				if ok {
+					response.Killmails = append(response.Killmails, killmail)
+				}
+			}
+
+			render.JSON(w, r, response)
+			return nil
+		}
+
+		from, httpErr := parseTimeParam(r, "from")
+		if httpErr != nil {
+			return httpErr
+		}
+
+		to, httpErr := parseTimeParam(r, "to")
+		if httpErr != nil {
+			return httpErr
+		}
+
+		if to.Before(from) {
+			return httperror.BadRequest("to must not be before from")
+		}
+
+		if to.Sub(from) > searchMaxRange {
+			return httperror.BadRequest(fmt.Sprintf("time range must not exceed %s", searchMaxRange))
+		}
+
+		match := func(killmail killfeed.CombinedKillmail) (bool, error) {
+			return filter.match(ctx, resolver, killmail)
+		}
+
+		killmails, nextCursor, err := arch.Search(ctx, from, to, filter.query(), r.URL.Query().Get("cursor"), limit, match)
+		if errors.Is(err, archive.ErrInvalidCursor) {
+			return httperror.BadRequestWithError("invalid cursor", err)
+		}
+
+		if err != nil {
+			return httperror.InternalServerError("failed to search archive", err)
+		}
+
+		render.JSON(w, r, KillmailSearchResponse{Killmails: killmails, NextCursor: nextCursor})
+		return nil
+	}
+}
+
+// handleKillmailLookup looks a killmail up in the live stream first and falls back to the archive
+// once it has been trimmed from the stream
+func handleKillmailLookup(rdb redis.UniversalClient, stream killfeed.StreamConfig, arch *archive.Archive) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx := r.Context()
+
+		rawID, err := strconv.ParseInt(chi.URLParam(r, "killmailID"), 10, 32)
+		if err != nil || rawID <= 0 {
+			return httperror.BadRequest("killmail ID must be a positive integer")
+		}
+
+		killmailID := int32(rawID)
+
+		messageID, err := rdb.Get(ctx, stream.KillmailIDKey(killmailID)).Result()
+		if err != nil && err != redis.Nil {
+			return httperror.InternalServerError("failed to get killmail stream ID from redis", err)
+		}
+
+		if messageID != "" {
+			messages, err := rdb.XRange(ctx, stream.Name, messageID, messageID).Result()
+			if err != nil {
+				return httperror.InternalServerError("failed to read from redis stream", err)
+			}
+
+			if len(messages) > 0 {
+				killmail, err := killfeed.DecodeStreamMessage(messages[0])
+				if err != nil {
+					return httperror.InternalServerError("failed to decode stream message", err)
+				}
+
+				return renderKillmail(w, r, killmail)
+			}
+		}
+
+		if arch == nil {
+			return httperror.NotFound("killmail not found")
+		}
+
+		killmail, err := arch.Get(ctx, killmailID)
+		if errors.Is(err, archive.ErrKillmailNotFound) {
+			return httperror.NotFound("killmail not found")
+		}
+
+		if err != nil {
+			return httperror.InternalServerError("failed to read killmail from archive", err)
+		}
+
+		return renderKillmail(w, r, killmail)
+	}
+}
+
+// renderKillmail writes a looked up killmail, hiding it from sessions it does not concern
+func renderKillmail(w http.ResponseWriter, r *http.Request, killmail killfeed.CombinedKillmail) *httperror.HTTPError {
+	if session := requestSession(r); session != nil && !session.Involved(killmail) {
+		return httperror.NotFound("killmail not found")
+	}
+
+	render.JSON(w, r, killmail)
+	return nil
+}
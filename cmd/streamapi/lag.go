@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// lagCheckInterval is how often the lag of a queue is measured, measuring counts entries in
+	// Redis, so it is not repeated on every read of a client catching up
+	lagCheckInterval = 30 * time.Second
+	// lagCountLimit bounds the entries counted to measure lag. The count runs in Redis and blocks
+	// other clients while it walks the stream, larger lags are reported as capped.
+	lagCountLimit = 10000
+)
+
+// countAfterScript counts the entries after an ID without sending them over the network
+var countAfterScript = redis.NewScript(`
+local count = 0
+local start = "(" .. ARGV[1]
+local limit = tonumber(ARGV[2])
+while count < limit do
+	local entries = redis.call("XRANGE", KEYS[1], start, "+", "COUNT", math.min(1000, limit - count))
+	if #entries == 0 then
+		break
+	end
+	count = count + #entries
+	start = "(" .. entries[#entries][1]
+end
+return count
+`)
+
+// lagCheck is the result of the last check of a queue
+type lagCheck struct {
+	at  time.Time
+	lag LagData
+}
+
+// lagMonitor measures how far queues are behind the head of their stream and detects cursors
+// that were trimmed away before their entries were delivered. Gaps are checked on every read,
+// the lag of a queue is measured at most once per lagCheckInterval.
+type lagMonitor struct {
+	rdb         redis.UniversalClient
+	warnAfter   atomic.Int64
+	warnEntries atomic.Int64
+
+	mu        sync.Mutex
+	checks    map[string]lagCheck
+	lastSweep time.Time
+}
+
+func newLagMonitor(rdb redis.UniversalClient, config killfeed.StreamAPIConfig) *lagMonitor {
+	l := &lagMonitor{rdb: rdb, checks: map[string]lagCheck{}}
+	l.reload(config)
+
+	return l
+}
+
+// reload applies new warning thresholds to the following checks
+func (l *lagMonitor) reload(config killfeed.StreamAPIConfig) {
+	l.warnAfter.Store(int64(config.LagWarningThreshold))
+	l.warnEntries.Store(config.LagWarningEntries)
+}
+
+// check measures the lag of a queue after a read that continued after cursor and returned the
+// entries first to last, and reports a gap when the read skipped trimmed entries. full tells
+// whether the read returned as many entries as it asked for, a short read reached the head of the
+// stream. Between measurements the last lag of the queue is returned and checked is false.
+func (l *lagMonitor) check(ctx context.Context, queueKey string, stream string, cursor string, first string, last string, full bool) (LagData, *GapData, bool, error) {
+	gap, gapErr := l.gap(ctx, stream, cursor, first)
+	lag, checked, lagErr := l.lag(ctx, queueKey, stream, last, full)
+
+	return lag, gap, checked, errors.Join(gapErr, lagErr)
+}
+
+// gap compares a read with the oldest entry retained by the stream. Reading the first entry is
+// cheap, so unlike the lag it is done for every read and no trimmed cursor goes unnoticed.
+func (l *lagMonitor) gap(ctx context.Context, stream string, cursor string, first string) (*GapData, error) {
+	// Replays from the start of the stream cannot miss anything
+	if killfeed.CompareStreamIDs(cursor, "0-0") == 0 {
+		return nil, nil
+	}
+
+	oldest, err := l.rdb.XRangeN(ctx, stream, "-", "+", 1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read oldest stream entry: %w", err)
+	}
+
+	if len(oldest) == 0 {
+		return nil, nil
+	}
+
+	return readGap(oldest[0].ID, cursor, first), nil
+}
+
+// lag measures the lag of a queue once per lagCheckInterval and returns the last measurement in between
+func (l *lagMonitor) lag(ctx context.Context, queueKey string, stream string, last string, full bool) (lag LagData, checked bool, err error) {
+	now := time.Now()
+
+	previous, ok := l.due(queueKey, now)
+	if !ok {
+		return previous.lag, false, nil
+	}
+
+	// Failed measurements count as well, so a failing Redis is not asked again on every read
+	defer func() {
+		l.mu.Lock()
+		l.checks[queueKey] = lagCheck{at: now, lag: lag}
+		l.mu.Unlock()
+	}()
+
+	// A short read reached the head of the stream
+	if !full {
+		return LagData{}, true, nil
+	}
+
+	newest, err := l.rdb.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+	if err != nil {
+		return LagData{}, true, fmt.Errorf("failed to read newest stream entry: %w", err)
+	}
+
+	if len(newest) == 0 {
+		return LagData{}, true, nil
+	}
+
+	if lag, err = l.measure(ctx, stream, newest[0].ID, last); err != nil {
+		return LagData{}, true, err
+	}
+
+	return lag, true, nil
+}
+
+// due reports whether a queue is due for a check, otherwise it returns the last check
+func (l *lagMonitor) due(queueKey string, now time.Time) (lagCheck, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Checks of queues that are no longer read are dropped once they are stale
+	if now.Sub(l.lastSweep) > lagCheckInterval {
+		for key, check := range l.checks {
+			if now.Sub(check.at) > lagCheckInterval {
+				delete(l.checks, key)
+			}
+		}
+
+		l.lastSweep = now
+	}
+
+	last, ok := l.checks[queueKey]
+	if ok && now.Sub(last.at) <= lagCheckInterval {
+		return last, false
+	}
+
+	return last, true
+}
+
+// measure returns the lag of a queue whose last read entry is cursor behind the newest entry head
+func (l *lagMonitor) measure(ctx context.Context, stream string, head string, cursor string) (LagData, error) {
+	if killfeed.CompareStreamIDs(cursor, head) >= 0 {
+		return LagData{}, nil
+	}
+
+	entries, err := countAfterScript.Run(ctx, l.rdb, []string{stream}, cursor, lagCountLimit).Int64()
+	if err != nil {
+		return LagData{}, fmt.Errorf("failed to count entries behind: %w", err)
+	}
+
+	lag := LagData{EntriesBehind: entries, EntriesCapped: entries >= lagCountLimit}
+
+	if cursorTime := killfeed.StreamIDTime(cursor); !cursorTime.IsZero() {
+		lag.SecondsBehind = int64(killfeed.StreamIDTime(head).Sub(cursorTime).Seconds())
+	}
+
+	return lag, nil
+}
+
+// exceeds reports whether a lag is worth a warning
+func (l *lagMonitor) exceeds(lag LagData) bool {
+	warnAfter, warnEntries := time.Duration(l.warnAfter.Load()), l.warnEntries.Load()
+
+	return (warnEntries > 0 && lag.EntriesBehind >= warnEntries) ||
+		(warnAfter > 0 && time.Duration(lag.SecondsBehind)*time.Second >= warnAfter)
+}
+
+// readGap checks whether a read continued at the oldest retained entry because the entries after
+// cursor were trimmed. first is the first entry the read returned. The entry at cursor itself may
+// be the only one trimmed, so a gap means killmails may have been missed rather than that they were.
+// A trim after the read moves the oldest entry past first, which is not mistaken for a gap.
+func readGap(oldest string, cursor string, first string) *GapData {
+	if oldest != first || killfeed.CompareStreamIDs(cursor, first) >= 0 {
+		return nil
+	}
+
+	return &GapData{
+		From:    cursor,
+		To:      first,
+		Message: "entries after the cursor were trimmed from the stream before delivery, killmails may have been missed",
+	}
+}
+
+// setLagHeaders reports lag and gaps of a poll in response headers, the body stays a bare list
+func setLagHeaders(w http.ResponseWriter, lag LagData, gap *GapData) {
+	w.Header().Set("X-Killfeed-Lag-Entries", strconv.FormatInt(lag.EntriesBehind, 10))
+	w.Header().Set("X-Killfeed-Lag-Seconds", strconv.FormatInt(lag.SecondsBehind, 10))
+
+	if gap != nil {
+		w.Header().Set("X-Killfeed-Gap-From", gap.From)
+		w.Header().Set("X-Killfeed-Gap-To", gap.To)
+	}
+}
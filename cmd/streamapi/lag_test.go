@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"killfeed"
+	"killfeed/apikey"
+	"killfeed/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func addEntries(t *testing.T, rdb *redis.Client, stream string, from int, to int) {
+	t.Helper()
+
+	values, err := killfeed.EncodeStreamMessage(killfeed.CombinedKillmail{}, false)
+	if err != nil {
+		t.Fatalf("failed to encode entry: %v", err)
+	}
+
+	for i := from; i <= to; i++ {
+		if err := rdb.XAdd(context.Background(), &redis.XAddArgs{Stream: stream, ID: fmt.Sprintf("%d-0", i), Values: values}).Err(); err != nil {
+			t.Fatalf("failed to add entry: %v", err)
+		}
+	}
+}
+
+func TestLagMonitorReportsGapsBetweenMeasurements(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	lags := newLagMonitor(rdb, killfeed.StreamAPIConfig{})
+	ctx := context.Background()
+
+	addEntries(t, rdb, "killmails", 1, 10)
+
+	// The first read measures the lag: 8 entries after 2-0
+	lag, gap, checked, err := lags.check(ctx, "queue", "killmails", "1-0", "2-0", "2-0", true)
+	if err != nil || gap != nil || !checked {
+		t.Fatalf("unexpected first check: gap %+v, checked %t: %v", gap, checked, err)
+	}
+
+	if lag.EntriesBehind != 8 {
+		t.Fatalf("expected 8 entries behind, got %d", lag.EntriesBehind)
+	}
+
+	// The stream is trimmed past the cursor before the next read, within the same interval
+	if err := rdb.XTrimMaxLen(ctx, "killmails", 5).Err(); err != nil {
+		t.Fatalf("failed to trim stream: %v", err)
+	}
+
+	lag, gap, checked, err = lags.check(ctx, "queue", "killmails", "2-0", "6-0", "6-0", true)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	if gap == nil || gap.From != "2-0" || gap.To != "6-0" {
+		t.Fatalf("expected a gap from 2-0 to 6-0, got %+v", gap)
+	}
+
+	// The lag is not measured again until the interval passed
+	if checked || lag.EntriesBehind != 8 {
+		t.Fatalf("expected the previous lag without a measurement, got %+v, checked %t", lag, checked)
+	}
+
+	// Reads continuing right after their cursor have no gap
+	if _, gap, _, _ := lags.check(ctx, "queue", "killmails", "6-0", "7-0", "7-0", true); gap != nil {
+		t.Fatalf("unexpected gap %+v", gap)
+	}
+}
+
+func TestReadGap(t *testing.T) {
+	for name, test := range map[string]struct {
+		oldest, cursor, first string
+		gap                   bool
+	}{
+		"continues after the cursor": {oldest: "1-0", cursor: "4-0", first: "5-0"},
+		"cursor trimmed":             {oldest: "5-0", cursor: "2-0", first: "5-0", gap: true},
+		"trimmed after the read":     {oldest: "7-0", cursor: "2-0", first: "5-0"},
+		"cursor is the oldest entry": {oldest: "2-0", cursor: "2-0", first: "3-0"},
+	} {
+		if gap := readGap(test.oldest, test.cursor, test.first); (gap != nil) != test.gap {
+			t.Errorf("%s: expected gap %t, got %+v", name, test.gap, gap)
+		}
+	}
+}
+
+func TestPollReportsGap(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	config := killfeed.StreamAPIConfig{QueueSessionPolicy: killfeed.QueueSessionReject}
+	limiter := ratelimit.New(rdb)
+	stream := killfeed.StreamConfig{Name: killfeed.StreamKillmails}
+
+	r := NewRouter()
+	r.Get("/poll/{queueID}", handlePoll(rdb, liveStream(stream), false, newQueueGuard(rdb, limiter, config), newRateLimits(rdb, apikey.NewStore(rdb), limiter, config), newLagMonitor(rdb, config)))
+
+	// The queue read up to 2-0 before the stream was trimmed to 6-0
+	addEntries(t, rdb, stream.Name, 1, 10)
+
+	if err := storeCursor(ctx, rdb, stream.Key(TransportPoll, "queue"), "2-0", "0"); err != nil {
+		t.Fatalf("failed to store cursor: %v", err)
+	}
+
+	if err := rdb.XTrimMaxLen(ctx, stream.Name, 5).Err(); err != nil {
+		t.Fatalf("failed to trim stream: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/poll/queue", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if from, to := w.Header().Get("X-Killfeed-Gap-From"), w.Header().Get("X-Killfeed-Gap-To"); from != "2-0" || to != "6-0" {
+		t.Fatalf("expected a gap from 2-0 to 6-0, got %q to %q", from, to)
+	}
+
+	// The poll read everything that is left, so the next one has no gap
+	addEntries(t, rdb, stream.Name, 11, 11)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/poll/queue", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Killfeed-Gap-From") != "" {
+		t.Fatalf("expected a poll without gap, got %d with gap from %q", w.Code, w.Header().Get("X-Killfeed-Gap-From"))
+	}
+
+	if entries := w.Header().Get("X-Killfeed-Lag-Entries"); entries != "0" {
+		t.Fatalf("expected the queue to have caught up, got %s entries behind", entries)
+	}
+}
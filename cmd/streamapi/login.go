@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"killfeed/httperror"
+	"killfeed/sso"
+	"net/http"
+
+	"github.com/antihax/goesi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+type LoginResponse struct {
+	sso.Session
+	// Token authenticates requests like an API key until the session expires
+	Token string `json:"token"`
+}
+
+// handleLogin redirects the pilot to EVE SSO
+func handleLogin(provider *sso.Provider, sessions *sso.SessionStore) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		state, err := sessions.CreateState(r.Context())
+		if err != nil {
+			return httperror.InternalServerError("failed to create login state", err)
+		}
+
+		http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusFound)
+		return nil
+	}
+}
+
+// handleLoginCallback completes the login and issues a session token bound to the pilot's
+// corporation and alliance
+func handleLoginCallback(provider *sso.Provider, sessions *sso.SessionStore, esiClient *goesi.APIClient) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		ctx := r.Context()
+
+		if reason := r.URL.Query().Get("error"); reason != "" {
+			return httperror.Unauthorized("login failed: " + reason)
+		}
+
+		ok, err := sessions.ConsumeState(ctx, r.URL.Query().Get("state"))
+		if err != nil {
+			return httperror.InternalServerError("failed to check login state", err)
+		}
+
+		if !ok {
+			return httperror.BadRequest("invalid or expired login state")
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			return httperror.BadRequest("missing code")
+		}
+
+		character, err := provider.Exchange(ctx, code)
+		if errors.Is(err, sso.ErrInvalidToken) {
+			return httperror.New(http.StatusUnauthorized, "invalid SSO token", err)
+		}
+
+		if err != nil {
+			return httperror.New(http.StatusBadGateway, "failed to complete SSO login", err)
+		}
+
+		corporationID, allianceID, err := sso.LookupAffiliation(ctx, esiClient, character.ID)
+		if err != nil {
+			return httperror.New(http.StatusBadGateway, "failed to look up character affiliation", err)
+		}
+
+		session, token, err := sessions.Create(ctx, character, corporationID, allianceID)
+		if err != nil {
+			return httperror.InternalServerError("failed to create session", err)
+		}
+
+		zerolog.Ctx(ctx).Info().Int32("character-id", character.ID).Int32("corporation-id", corporationID).Int32("alliance-id", allianceID).Msg("pilot logged in")
+
+		render.JSON(w, r, LoginResponse{Session: session, Token: token})
+		return nil
+	}
+}
+
+func handleSession() HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		session := requestSession(r)
+		if session == nil {
+			return httperror.Unauthorized("missing session")
+		}
+
+		render.JSON(w, r, session)
+		return nil
+	}
+}
+
+func handleLogout(sessions *sso.SessionStore) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		if requestSession(r) == nil {
+			return httperror.Unauthorized("missing session")
+		}
+
+		if err := sessions.Delete(r.Context(), requestAPIKey(r)); err != nil {
+			return httperror.InternalServerError("failed to end session", err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -2,290 +2,250 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"killfeed"
+	"killfeed/apikey"
+	"killfeed/archive"
+	"killfeed/classify"
 	"killfeed/httperror"
+	"killfeed/ingest"
+	"killfeed/ratelimit"
+	"killfeed/sso"
+	"killfeed/tracing"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/go-chi/chi/v5"
+	"github.com/antihax/goesi"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/olahol/melody"
-	"github.com/redis/go-redis/v9"
-	"github.com/rs/zerolog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 )
 
+const ShutdownTimeout = 10 * time.Second
+
 func main() {
 	ctx := context.Background()
 
 	log.Logger = log.Output(killfeed.LogOut{})
 
-	config, err := killfeed.NewConfig()
+	var config killfeed.StreamAPIConfig
+	reloader, err := killfeed.LoadReloadable(&config)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to read config")
 	}
 
-	rdb := redis.NewClient(&redis.Options{Addr: config.RedisURL})
-	if err := rdb.Ping(ctx).Err(); err != nil {
+	killfeed.SetupLogging(config.Log)
+
+	rdb, err := killfeed.NewRedisClient(ctx, config.Redis)
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to connect to redis")
 	}
 
 	defer rdb.Close()
 
+	shutdownTracing, err := tracing.Setup(ctx, config.Config, "streamapi")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	esiClient := goesi.NewAPIClient(httpClient, fmt.Sprintf("Killfeed/%s (%s)", killfeed.Version, config.EsiContactInformation))
+
+	resolver := classify.NewESIResolver(esiClient, ingest.NewESILimiter())
+
+	// The archive is optional, without it only killmails still retained in the stream can be looked up
+	var arch *archive.Archive
+	if config.ArchiveURL != "" {
+		arch, err = archive.NewFromConfig(config.ArchiveConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open archive")
+		}
+	}
+
 	m := melody.New()
 
 	// No limit on messages
 	m.Config.MaxMessageSize = 0
 	m.Config.WriteWait = 5 * time.Second
 
-	r := NewRouter()
-	r.Use(middleware.Logger)
+	// Negotiates permessage-deflate with clients that offer it
+	m.Upgrader.EnableCompression = config.WebsocketCompression
 
-	r.Get("/_healthz", func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
-		w.WriteHeader(http.StatusOK)
-		return nil
+	keys := apikey.NewStore(rdb)
+	limiter := ratelimit.New(rdb)
+	limits := newRateLimits(rdb, keys, limiter, config)
+
+	guard := newQueueGuard(rdb, limiter, config)
+	go guard.watchEvictions(ctx)
+
+	lags := newLagMonitor(rdb, config)
+
+	go killfeed.WatchConfig(ctx, reloader, func(next *killfeed.StreamAPIConfig) {
+		killfeed.SetLogLevel(next.Log)
+		limits.reload(*next)
+		guard.reload(*next)
+		lags.reload(*next)
 	})
 
+	// SSO logins are optional, without them only API keys authenticate
+	var provider *sso.Provider
+	var sessions *sso.SessionStore
+	if config.SSOClientID != "" {
+		provider = sso.NewProvider(httpClient, sso.Config{
+			ClientID:     config.SSOClientID,
+			ClientSecret: config.SSOClientSecret,
+			CallbackURL:  config.SSOCallbackURL,
+			Issuer:       config.SSOIssuer,
+		})
+		sessions = sso.NewSessionStore(rdb, config.SSOSessionTTL)
+	}
+
+	if !config.AuthEnabled {
+		log.Warn().Msg("authentication is disabled, stream endpoints are open to everyone")
+	}
+
+	r := NewRouter()
+	// Behind a proxy the client IP used for rate limiting comes from X-Forwarded-For
+	if config.TrustProxyHeaders {
+		r.Use(middleware.RealIP)
+	}
+
+	r.Use(middleware.RequestID)
+	r.Use(accessLog)
+	r.Use(authenticate(keys, sessions))
+
+	// _healthz predates the split into liveness and readiness and is kept for existing probes
+	r.Get("/_healthz", handleLive())
+	r.Get("/livez", handleLive())
+	r.Get("/readyz", handleReady(rdb, config.Stream.Name, config.ReadyWithoutStream))
+
 	r.Get("/version", func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
 		w.Write([]byte(killfeed.Version))
 		w.WriteHeader(http.StatusOK)
 		return nil
 	})
 
+	prometheus.MustRegister(newStreamCollector(rdb, config.Stream.Name))
+
+	// Metrics reveal queue and client activity, so they need an admin key like the admin endpoints
+	metrics := promhttp.Handler()
+	r.Get("/metrics", requireScope(config.AuthEnabled, apikey.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		metrics.ServeHTTP(w, r)
+		return nil
+	}))
+
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
 		render.HTML(w, r, "<html><body>Hello</body></html>")
 		return nil
 	})
 
-	r.Get("/websocket/{queueID}", func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
-		queueID := chi.URLParam(r, "queueID")
-		if len(queueID) > 128 {
-			return httperror.BadRequest("queue ID must be 128 characters or less")
-		}
+	// Stream endpoints need the read scope and count against the client's rate limit, websockets and
+	// long polls also hold one of its connection slots. The handlers limit the queue on top of that.
+	read := func(handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+		return requireScope(config.AuthEnabled, apikey.ScopeReadStream, limits.requests(handlerFn))
+	}
 
-		m.HandleRequestWithKeys(w, r, map[string]any{"queueID": queueID})
-		return nil
-	})
+	connect := func(handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+		return read(limits.connections(handlerFn))
+	}
 
-	r.Get("/poll/{queueID}", func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
-		ctx := r.Context()
+	r.Get("/killmails", read(handleKillmailSearch(arch, resolver)))
+	r.Get("/killmails/{killmailID}", read(handleKillmailLookup(rdb, config.Stream, arch)))
 
-		queueID := chi.URLParam(r, "queueID")
-		if len(queueID) > 128 {
-			return httperror.BadRequest("queue ID must be 128 characters or less")
-		}
+	r.Get("/websocket/{queueID}", connect(handleWebsocketRequest(m, liveStream(config.Stream), config.AuthEnabled, guard, limits)))
+	r.Get("/poll/{queueID}", connect(observePoll(handlePoll(rdb, liveStream(config.Stream), config.PollCompression, guard, limits, lags))))
 
-		latestIDKey := fmt.Sprintf("stream:poll:%s", queueID)
+	r.Get("/streams/{kind}/{entityID}/websocket/{queueID}", connect(handleWebsocketRequest(m, derivedStream(config.Stream), config.AuthEnabled, guard, limits)))
+	r.Get("/streams/{kind}/{entityID}/poll/{queueID}", connect(observePoll(handlePoll(rdb, derivedStream(config.Stream), config.PollCompression, guard, limits, lags))))
 
-		latestID, err := rdb.Get(ctx, latestIDKey).Result()
-		if err != nil && err != redis.Nil {
-			return httperror.InternalServerError("failed to get latest ID from redis", err)
-		}
+	if provider != nil {
+		r.Get("/auth/login", handleLogin(provider, sessions))
+		r.Get("/auth/callback", handleLoginCallback(provider, sessions, esiClient))
+		r.Get("/auth/session", handleSession())
+		r.Post("/auth/logout", handleLogout(sessions))
+	}
 
-		if latestID == "" {
-			latestID = "$"
-		}
+	r.Post("/admin/keys", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleCreateKey(keys, limits)))
+	r.Get("/admin/keys", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleListKeys(keys)))
+	r.Delete("/admin/keys/{keyID}", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleRevokeKey(keys)))
 
-		killmails := []killfeed.CombinedKillmail{}
+	r.Get("/admin/status", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleAdminStatus(rdb, config.Config, m)))
+	r.Get("/admin/queues", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleAdminQueues(rdb, config.Stream, guard)))
+	r.Put("/admin/queues/{queueID}/cursor", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleResetCursor(rdb, config.Stream, guard)))
+	r.Get("/admin/sessions", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleAdminSessions(m)))
+	r.Delete("/admin/sessions/{sessionID}", requireScope(config.AuthEnabled, apikey.ScopeAdmin, handleDisconnectSession(guard)))
 
-		args := &redis.XReadArgs{
-			ID:      latestID,
-			Streams: []string{killfeed.StreamKillmails},
-			Count:   100,
-			Block:   60 * time.Second,
-		}
+	m.HandleConnect(func(s *melody.Session) {
+		client := s.Keys["client"].(*websocketClient)
 
-		streams, err := rdb.XRead(ctx, args).Result()
-		if err == redis.Nil {
-			render.JSON(w, r, killmails)
-			return nil
-		}
+		websocketConnections.Inc()
+		websocketSessions.Inc()
 
-		if err != nil {
-			return httperror.InternalServerError("failed to read from redis stream", err)
-		}
+		logger := websocketLogger(s.Request, client.queueID)
+		logger.Info().Str("stream", client.stream.Name).Bool("envelope", client.envelope).Msg("new websocket connection")
 
-		for _, stream := range streams {
-			for _, message := range stream.Messages {
-				latestID = message.ID
-
-				encodedKillmail, ok := message.Values["killmail"].(string)
-				if !ok {
-					return httperror.InternalServerError(fmt.Sprintf("invalid killmail message %s", message.ID), err)
-				}
-
-				encodedKillmailZkb, ok := message.Values["killmail_zkb"].(string)
-				if !ok {
-					return httperror.InternalServerError(fmt.Sprintf("invalid killmail message %s, missing zkb fields", message.ID), err)
-				}
-
-				var killmail killfeed.Killmail
-				if err := json.Unmarshal([]byte(encodedKillmail), &killmail); err != nil {
-					return httperror.InternalServerError(fmt.Sprintf("failed to decode killmail message %s", message.ID), err)
-				}
-
-				var killmailZkb killfeed.KillmailZkb
-				if err := json.Unmarshal([]byte(encodedKillmailZkb), &killmailZkb); err != nil {
-					return httperror.InternalServerError(fmt.Sprintf("failed to decode killmail message %s zkb fields", message.ID), err)
-				}
-
-				killmails = append(killmails, killfeed.CombinedKillmail{
-					Attackers:     killmail.Attackers,
-					KillmailId:    killmail.KillmailId,
-					KillmailTime:  killmail.KillmailTime,
-					MoonId:        killmail.MoonId,
-					SolarSystemId: killmail.SolarSystemId,
-					Victim:        killmail.Victim,
-					WarId:         killmail.WarId,
-					Zkb:           killmailZkb,
-				})
-			}
-		}
+		go handleWebsocket(s.Request.Context(), logger, rdb, resolver, lags, s, client)
+	})
 
-		if err := rdb.Set(ctx, latestIDKey, latestID, 24*time.Hour).Err(); err != nil {
-			return httperror.InternalServerError("failed to store latest ID to redis", err)
-		}
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		client := s.Keys["client"].(*websocketClient)
 
-		render.JSON(w, r, killmails)
-		return nil
+		handleCommand(s.Request.Context(), websocketLogger(s.Request, client.queueID), rdb, s, client, msg)
 	})
 
-	m.HandleConnect(func(s *melody.Session) {
-		queueID := s.Keys["queueID"].(string)
-
-		log.Info().Str("queueID", queueID).Msg("new websocket connection")
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
+		client := s.Keys["client"].(*websocketClient)
 
-		go handleWebsocket(s.Request.Context(), log.With().Str("queue-id", queueID).Logger(), rdb, s, queueID)
+		if err := client.reply(s, Envelope{Type: EnvelopeError, Data: ErrorData{Code: http.StatusBadRequest, Error: ErrorInvalidCommand, Message: "commands must be sent as JSON text frames"}}); err != nil {
+			logger := websocketLogger(s.Request, client.queueID)
+			logger.Error().Err(err).Msg("failed to write command reply")
+		}
 	})
 
 	m.HandleDisconnect(func(s *melody.Session) {
 		queueID := s.Keys["queueID"].(string)
 
-		log.Info().Str("queueID", queueID).Msg("closed websocket connection")
+		websocketSessions.Dec()
+
+		logger := websocketLogger(s.Request, queueID)
+		logger.Info().Msg("closed websocket connection")
 	})
 
 	log.Info().Int("port", config.Port).Msg("http server listening")
 
 	srv := &http.Server{Addr: fmt.Sprintf(":%d", config.Port), Handler: r}
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal().Err(err).Msg("http listener failed")
-	}
-}
 
-func handleWebsocket(ctx context.Context, logger zerolog.Logger, rdb *redis.Client, s *melody.Session, queueID string) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-
-		default:
-			messages, err := fetchWebsocketKillmails(ctx, rdb, queueID)
-			if err != nil {
-				if errors.Is(err, context.Canceled) && s.IsClosed() {
-					return
-				}
-
-				logger.Error().Err(err).Msg("failed to fetch websocket killmails")
-				if err := s.CloseWithMsg(melody.FormatCloseMessage(melody.CloseInternalServerErr, "internal server error")); err != nil {
-					logger.Error().Err(err).Msg("failed to close websocket after fetch error")
-				}
-
-				return
-			}
-
-			for _, message := range messages {
-				if err := s.WriteWithDeadline(message, 0); err != nil {
-					logger.Error().Err(err).Msg("failed to write to websocket")
-					if err := s.CloseWithMsg(melody.FormatCloseMessage(melody.CloseAbnormalClosure, "write failed")); err != nil {
-						logger.Error().Err(err).Msg("failed to close websocket after write error")
-					}
-				}
-			}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("http listener failed")
 		}
-	}
-}
+	}()
 
-func fetchWebsocketKillmails(ctx context.Context, rdb *redis.Client, queueID string) ([][]byte, error) {
-	latestIDKey := fmt.Sprintf("stream:websocket:%s", queueID)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
 
-	latestID, err := rdb.Get(ctx, latestIDKey).Result()
-	if err != nil && err != redis.Nil {
-		return nil, fmt.Errorf("failed to get latest ID from redis: %w", err)
-	}
+	log.Info().Msg("shutting down")
 
-	if latestID == "" {
-		latestID = "$"
-	}
+	// Hijacked websocket connections are not tracked by the server, so clients are told and closed first
+	notifyShutdown(log.Logger, m)
 
-	killmails := [][]byte{}
+	shutdownCtx, cancel := context.WithTimeout(ctx, ShutdownTimeout)
+	defer cancel()
 
-	args := &redis.XReadArgs{
-		ID:      latestID,
-		Streams: []string{killfeed.StreamKillmails},
-		Count:   10,
-		Block:   0,
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("failed to shut down http server")
 	}
 
-	streams, err := rdb.XRead(ctx, args).Result()
-	if err == redis.Nil {
-		return killmails, nil
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("failed to flush traces")
 	}
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from redis stream: %w", err)
-	}
-
-	for _, stream := range streams {
-		for _, message := range stream.Messages {
-			latestID = message.ID
-
-			encodedKillmail, ok := message.Values["killmail"].(string)
-			if !ok {
-				return nil, fmt.Errorf("invalid killmail message %s", message.ID)
-			}
-
-			encodedKillmailZkb, ok := message.Values["killmail_zkb"].(string)
-			if !ok {
-				return nil, fmt.Errorf("invalid killmail message %s, missing zkb fields", message.ID)
-			}
-
-			var killmail killfeed.Killmail
-			if err := json.Unmarshal([]byte(encodedKillmail), &killmail); err != nil {
-				return nil, fmt.Errorf("failed to decode killmail message %s: %w", message.ID, err)
-			}
-
-			var killmailZkb killfeed.KillmailZkb
-			if err := json.Unmarshal([]byte(encodedKillmailZkb), &killmailZkb); err != nil {
-				return nil, fmt.Errorf("failed to decode killmail message %s zkb fields: %w", message.ID, err)
-			}
-
-			combinedKillmail := killfeed.CombinedKillmail{
-				Attackers:     killmail.Attackers,
-				KillmailId:    killmail.KillmailId,
-				KillmailTime:  killmail.KillmailTime,
-				MoonId:        killmail.MoonId,
-				SolarSystemId: killmail.SolarSystemId,
-				Victim:        killmail.Victim,
-				WarId:         killmail.WarId,
-				Zkb:           killmailZkb,
-			}
-
-			payload, err := json.Marshal(combinedKillmail)
-			if err != nil {
-				return nil, fmt.Errorf("failed to encode combined killmail %s: %w", message.ID, err)
-			}
-
-			killmails = append(killmails, payload)
-		}
-	}
-
-	if err := rdb.Set(ctx, latestIDKey, latestID, 24*time.Hour).Err(); err != nil {
-		return nil, fmt.Errorf("failed to store latest ID to redis: %w", err)
-	}
-
-	return killmails, nil
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"killfeed"
+	"killfeed/httperror"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	websocketPayloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_websocket_payload_bytes_total",
+		Help: "Bytes of killmail payloads written to websockets before compression",
+	})
+
+	websocketWireBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_websocket_wire_bytes_total",
+		Help: "Bytes written to websocket connections, including framing and compression",
+	})
+
+	pollPayloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_poll_payload_bytes_total",
+		Help: "Bytes of poll response bodies before compression",
+	})
+
+	pollWireBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_poll_wire_bytes_total",
+		Help: "Bytes of poll response bodies as sent, by content encoding",
+	}, []string{"encoding"})
+)
+
+var (
+	websocketSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "killfeed_websocket_sessions",
+		Help: "Open websocket sessions",
+	})
+
+	websocketConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_websocket_connections_total",
+		Help: "Websocket connections accepted",
+	})
+
+	killmailsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_killmails_delivered_total",
+		Help: "Killmails delivered to clients, by transport",
+	}, []string{"transport"})
+
+	pollDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "killfeed_poll_duration_seconds",
+		Help:    "Duration of long polls, by status class",
+		Buckets: []float64{0.01, 0.05, 0.25, 1, 5, 15, 30, 60, 90},
+	}, []string{"status"})
+
+	// Every stage is observed per delivered killmail, so the distribution is the one clients see
+	deliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "killfeed_delivery_latency_seconds",
+		Help:    "Latency of killmails through the pipeline, by stage",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 16),
+	}, []string{"stage"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_rate_limited_total",
+		Help: "Requests rejected by a rate limit, by limit",
+	}, []string{"limit"})
+
+	// Lag is observed whenever a queue measures it, sessions that keep up observe zero
+	queueLagSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "killfeed_queue_lag_seconds",
+		Help:    "Time between the entry at a queue's cursor and the head of the stream, by transport",
+		Buckets: []float64{0, 1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	}, []string{"transport"})
+
+	// Counts stop at lagCountLimit, so the last bucket holds every queue that far behind
+	queueLagEntries = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "killfeed_queue_lag_entries",
+		Help:    "Entries between a queue's cursor and the head of the stream, by transport",
+		Buckets: []float64{0, 10, 100, 1000, lagCountLimit},
+	}, []string{"transport"})
+
+	queueGaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_queue_gaps_total",
+		Help: "Reads that skipped entries trimmed from the stream before delivery, by transport",
+	}, []string{"transport"})
+)
+
+func observeLag(transport string, lag LagData) {
+	queueLagSeconds.WithLabelValues(transport).Observe(float64(lag.SecondsBehind))
+	queueLagEntries.WithLabelValues(transport).Observe(float64(lag.EntriesBehind))
+}
+
+// observePoll records how long a poll blocked and how it ended
+func observePoll(handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		start := time.Now()
+		httpErr := handlerFn(w, r)
+
+		status := "2xx"
+		if httpErr != nil {
+			status = fmt.Sprintf("%dxx", httpErr.Code/100)
+		}
+
+		pollDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+		return httpErr
+	}
+}
+
+// observeDelivery records the latency stages of killmails written to a client. Stages whose
+// timestamps were not recorded, e.g. of backfilled killmails, are skipped.
+func observeDelivery(messages []redis.XMessage, deliveredAt time.Time) {
+	for _, message := range messages {
+		timings := killfeed.StreamTimings(message)
+
+		for _, stage := range []struct {
+			name     string
+			from, to time.Time
+		}{
+			{"killmail_to_redisq", timings.KillmailTime, timings.ReceivedAt},
+			{"redisq_to_stream", timings.ReceivedAt, timings.AddedAt},
+			{"stream_to_client", timings.AddedAt, deliveredAt},
+		} {
+			if !stage.from.IsZero() && !stage.to.IsZero() {
+				deliveryLatency.WithLabelValues(stage.name).Observe(stage.to.Sub(stage.from).Seconds())
+			}
+		}
+	}
+}
+
+// streamCollector reports the length of the killmail stream and how far its consumer groups are
+// behind. It reads Redis on every scrape, so the values are never stale.
+type streamCollector struct {
+	rdb    redis.UniversalClient
+	stream string
+
+	length  *prometheus.Desc
+	lag     *prometheus.Desc
+	pending *prometheus.Desc
+}
+
+func newStreamCollector(rdb redis.UniversalClient, stream string) *streamCollector {
+	return &streamCollector{
+		rdb:     rdb,
+		stream:  stream,
+		length:  prometheus.NewDesc("killfeed_stream_length", "Entries retained in the killmail stream", nil, nil),
+		lag:     prometheus.NewDesc("killfeed_consumer_group_lag", "Stream entries not yet delivered to a consumer group", []string{"group"}, nil),
+		pending: prometheus.NewDesc("killfeed_consumer_group_pending", "Entries delivered to a consumer group but not acknowledged", []string{"group"}, nil),
+	}
+}
+
+func (c *streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.length
+	ch <- c.lag
+	ch <- c.pending
+}
+
+func (c *streamCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	length, err := c.rdb.XLen(ctx, c.stream).Result()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get stream length for metrics")
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.length, prometheus.GaugeValue, float64(length))
+
+	groups, err := c.rdb.XInfoGroups(ctx, c.stream).Result()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get consumer groups for metrics")
+		return
+	}
+
+	for _, group := range groups {
+		// Redis reports -1 when the lag cannot be determined, e.g. after entries were deleted
+		if group.Lag >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.lag, prometheus.GaugeValue, float64(group.Lag), group.Name)
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(group.Pending), group.Name)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"killfeed"
+	"killfeed/httperror"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// streamSelector picks the stream a request reads from
+type streamSelector func(r *http.Request) (killfeed.StreamConfig, *httperror.HTTPError)
+
+func liveStream(stream killfeed.StreamConfig) streamSelector {
+	return func(r *http.Request) (killfeed.StreamConfig, *httperror.HTTPError) {
+		return stream, nil
+	}
+}
+
+// derivedStream selects the per-entity stream named by the kind and entityID URL parameters
+func derivedStream(stream killfeed.StreamConfig) streamSelector {
+	return func(r *http.Request) (killfeed.StreamConfig, *httperror.HTTPError) {
+		kind := chi.URLParam(r, "kind")
+		if !killfeed.IsDerivedKind(kind) {
+			return killfeed.StreamConfig{}, httperror.NotFound("unknown stream kind")
+		}
+
+		entityID, err := strconv.ParseInt(chi.URLParam(r, "entityID"), 10, 32)
+		if err != nil || entityID <= 0 {
+			return killfeed.StreamConfig{}, httperror.BadRequest("entity ID must be a positive integer")
+		}
+
+		return stream.Derived(kind, int32(entityID)), nil
+	}
+}
+
+// formatParam returns the payload format requested with the format query parameter
+func formatParam(r *http.Request) (string, *httperror.HTTPError) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		return killfeed.FormatJSON, nil
+	}
+
+	if !killfeed.IsFormat(format) {
+		return "", httperror.BadRequest(fmt.Sprintf("format must be %s or %s", killfeed.FormatJSON, killfeed.FormatMsgpack))
+	}
+
+	return format, nil
+}
+
+// timingsParam reports whether the client asked for pipeline timings with the timings query parameter
+func timingsParam(r *http.Request) (bool, *httperror.HTTPError) {
+	raw := r.URL.Query().Get("timings")
+	if raw == "" {
+		return false, nil
+	}
+
+	timings, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, httperror.BadRequest("timings must be a boolean")
+	}
+
+	return timings, nil
+}
+
+// entryPayload encodes a stream entry for a client, with its timings when the client asked for them
+func entryPayload(message redis.XMessage, format string, timings bool) ([]byte, error) {
+	if timings {
+		return killfeed.StreamPayloadWithTimings(message, format, time.Now())
+	}
+
+	return killfeed.StreamPayloadFormat(message, format)
+}
+
+func handlePoll(rdb redis.UniversalClient, selectStream streamSelector, compress bool, guard *queueGuard, limits *rateLimits, lags *lagMonitor) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		queueID, httpErr := queueIDParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		stream, httpErr := selectStream(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		format, httpErr := formatParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		timings, httpErr := timingsParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		if httpErr := guard.claim(r, stream, queueID); httpErr != nil {
+			return httpErr
+		}
+
+		latestIDKey := stream.Key(TransportPoll, queueID)
+
+		sessionID, err := connectionID()
+		if err != nil {
+			return httperror.InternalServerError("failed to create session ID", err)
+		}
+
+		// An eviction cancels this poll
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		var evicted atomic.Pointer[eviction]
+		evict := func(e eviction) {
+			evicted.Store(&e)
+			cancel()
+		}
+
+		onSlotLost(r, evict)
+
+		release, httpErr := limits.queue(r, stream, queueID, evict)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		defer release()
+
+		primary, leave, httpErr := guard.join(ctx, latestIDKey, sessionID, evict)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		defer leave()
+
+		latestID, epoch, err := loadCursor(ctx, rdb, latestIDKey)
+		if err != nil {
+			return httperror.InternalServerError("failed to load cursor", err)
+		}
+
+		if latestID == "" {
+			latestID = "$"
+		}
+
+		// Payloads are passed through as stored instead of being decoded and encoded again
+		killmails := [][]byte{}
+
+		args := &redis.XReadArgs{
+			ID:      latestID,
+			Streams: []string{stream.Name},
+			Count:   100,
+			Block:   60 * time.Second,
+		}
+
+		readStart := time.Now()
+		streams, err := rdb.XRead(ctx, args).Result()
+		traceRead(ctx, stream.Name, readStart, streams, err)
+
+		if err == redis.Nil {
+			return writePollResponse(w, r, format, compress, killmails)
+		}
+
+		if e := evicted.Load(); err != nil && e != nil {
+			return httperror.New(e.Code, e.Reason, errors.New(e.Reason))
+		}
+
+		if err != nil {
+			return httperror.InternalServerError("failed to read from redis stream", err)
+		}
+
+		session := requestSession(r)
+		delivered := []redis.XMessage{}
+		cursor := latestID
+		read := []redis.XMessage{}
+
+		for _, stream := range streams {
+			read = append(read, stream.Messages...)
+
+			for _, message := range stream.Messages {
+				latestID = message.ID
+
+				if session != nil {
+					killmail, err := killfeed.DecodeStreamMessage(message)
+					if err != nil {
+						return httperror.InternalServerError("failed to decode stream message", err)
+					}
+
+					if !session.Involved(killmail) {
+						continue
+					}
+				}
+
+				payload, err := entryPayload(message, format, timings)
+				if err != nil {
+					return httperror.InternalServerError("failed to decode stream message", err)
+				}
+
+				killmails = append(killmails, payload)
+				delivered = append(delivered, message)
+			}
+		}
+
+		killmailsDelivered.WithLabelValues(TransportPoll).Add(float64(len(killmails)))
+
+		// Fanned out sessions read along without moving the shared cursor
+		if primary {
+			err := storeCursor(ctx, rdb, latestIDKey, latestID, epoch)
+			if errors.Is(err, errCursorReset) {
+				return httperror.New(evictCursorReset.Code, evictCursorReset.Reason, err)
+			}
+
+			if err != nil {
+				return httperror.InternalServerError("failed to store cursor", err)
+			}
+		}
+
+		lag, gap := pollLag(ctx, lags, latestIDKey, stream.Name, cursor, read, args.Count)
+		setLagHeaders(w, lag, gap)
+
+		writeStart := time.Now()
+		if httpErr := writePollResponse(w, r, format, compress, killmails); httpErr != nil {
+			traceDelivery(TransportPoll, queueID, delivered, writeStart, httpErr)
+			return httpErr
+		}
+
+		traceDelivery(TransportPoll, queueID, delivered, writeStart, nil)
+		observeDelivery(delivered, time.Now())
+		return nil
+	}
+}
+
+// pollLag checks a poll that continued after cursor for a gap and measures its lag. Failures are only
+// logged, the killmails are delivered regardless.
+func pollLag(ctx context.Context, lags *lagMonitor, queueKey string, stream string, cursor string, read []redis.XMessage, count int64) (LagData, *GapData) {
+	// Polls of new queues start at the end of the stream and have nothing to compare
+	if cursor == "$" || len(read) == 0 {
+		return LagData{}, nil
+	}
+
+	lag, gap, checked, err := lags.check(ctx, queueKey, stream, cursor, read[0].ID, read[len(read)-1].ID, int64(len(read)) == count)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to check poll lag")
+	}
+
+	if gap != nil {
+		queueGaps.WithLabelValues(TransportPoll).Inc()
+	}
+
+	if checked {
+		observeLag(TransportPoll, lag)
+	}
+
+	return lag, gap
+}
+
+func writePollResponse(w http.ResponseWriter, r *http.Request, format string, compress bool, payloads [][]byte) *httperror.HTTPError {
+	var body []byte
+	var err error
+
+	contentType := "application/json"
+
+	if format == killfeed.FormatMsgpack {
+		contentType = "application/msgpack"
+		body, err = killfeed.EncodeMsgpackArray(payloads)
+	} else {
+		killmails := make([]json.RawMessage, len(payloads))
+		for i, payload := range payloads {
+			killmails[i] = payload
+		}
+
+		body, err = json.Marshal(killmails)
+	}
+
+	if err != nil {
+		return httperror.InternalServerError("failed to encode response", err)
+	}
+
+	if err := writeCompressed(w, r, compress, contentType, body); err != nil {
+		zerolog.Ctx(r.Context()).Warn().Err(err).Msg("failed to write poll response")
+	}
+
+	return nil
+}
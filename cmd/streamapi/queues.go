@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"killfeed"
+	"killfeed/httperror"
+	"killfeed/ratelimit"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/olahol/melody"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// queueClaimTTL matches the lifetime of queue cursors, an idle queue can be claimed by anyone again
+const queueClaimTTL = 24 * time.Hour
+
+// queueClaimRefreshInterval is how often open websocket sessions refresh the claim of their queue
+const queueClaimRefreshInterval = time.Hour
+
+// refreshClaimScript extends a queue claim only if it is still held by the owner, a claim that
+// expired and was taken by another client is left alone
+var refreshClaimScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+
+// Transports of a queue, each keeps its own cursor
+const (
+	TransportWebsocket = "websocket"
+	TransportPoll      = "poll"
+)
+
+// sessionEvictChannel tells every streamapi instance to close sessions, e.g. of a taken over queue
+const sessionEvictChannel = "killfeed:session-evict"
+
+// eviction tells a session why the server closes it
+type eviction struct {
+	Code      int    `json:"code"`
+	Reason    string `json:"reason"`
+	CloseCode int    `json:"close_code"`
+}
+
+var (
+	evictTakeover    = eviction{Code: http.StatusConflict, Reason: "queue was taken over by another session", CloseCode: melody.ClosePolicyViolation}
+	evictDisconnect  = eviction{Code: http.StatusGone, Reason: "session was disconnected by an administrator", CloseCode: melody.ClosePolicyViolation}
+	evictCursorReset = eviction{Code: http.StatusConflict, Reason: "queue cursor was reset, reconnect to continue", CloseCode: melody.CloseServiceRestart}
+	evictSlotLost    = eviction{Code: http.StatusServiceUnavailable, Reason: "connection slot was lost, reconnect to continue", CloseCode: melody.CloseTryAgainLater}
+)
+
+// evictMessage selects the sessions to evict on every instance. Without a session ID all sessions
+// of the queue except keep are evicted, without a queue key the session is looked up in all queues.
+type evictMessage struct {
+	QueueKey  string   `json:"queue_key,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	Keep      string   `json:"keep,omitempty"`
+	Eviction  eviction `json:"eviction"`
+}
+
+// Queue IDs are used inside Redis keys, so separators are not allowed
+var queueIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+func queueIDParam(r *http.Request) (string, *httperror.HTTPError) {
+	queueID := chi.URLParam(r, "queueID")
+	if !queueIDPattern.MatchString(queueID) {
+		return "", httperror.BadRequest("queue ID must be 1 to 128 letters, digits, dots, dashes or underscores")
+	}
+
+	return queueID, nil
+}
+
+// queueGuard protects queues from other clients and decides what happens when the owner opens a
+// second session on a queue it is already reading
+type queueGuard struct {
+	rdb     redis.UniversalClient
+	limiter *ratelimit.Limiter
+
+	mu sync.Mutex
+	// ownership and policy change when the configuration is reloaded
+	ownership bool
+	policy    string
+	// sessions holds the evict functions of the sessions on this instance by queue key and session ID
+	sessions map[string]map[string]func(eviction)
+}
+
+func newQueueGuard(rdb redis.UniversalClient, limiter *ratelimit.Limiter, config killfeed.StreamAPIConfig) *queueGuard {
+	return &queueGuard{
+		rdb:       rdb,
+		limiter:   limiter,
+		ownership: config.QueueOwnership,
+		policy:    config.QueueSessionPolicy,
+		sessions:  map[string]map[string]func(eviction){},
+	}
+}
+
+// reload applies new ownership and session settings to the following requests, existing claims and
+// sessions are left alone
+func (g *queueGuard) reload(config killfeed.StreamAPIConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.ownership = config.QueueOwnership
+	g.policy = config.QueueSessionPolicy
+}
+
+// settings returns the current ownership and session policy
+func (g *queueGuard) settings() (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.ownership, g.policy
+}
+
+// claim makes the client of the request the owner of an unclaimed queue and rejects clients that
+// do not own a claimed one
+func (g *queueGuard) claim(r *http.Request, stream killfeed.StreamConfig, queueID string) *httperror.HTTPError {
+	if ownership, _ := g.settings(); !ownership {
+		return nil
+	}
+
+	ctx := r.Context()
+	owner := clientSubject(r)
+	key := stream.Key("owner", queueID)
+
+	previous, err := g.rdb.SetArgs(ctx, key, owner, redis.SetArgs{Mode: "NX", TTL: queueClaimTTL, Get: true}).Result()
+	if err != nil && err != redis.Nil {
+		return httperror.InternalServerError("failed to claim queue", err)
+	}
+
+	if previous != "" && previous != owner {
+		return httperror.Forbidden("queue is owned by another client")
+	}
+
+	if previous == owner {
+		if err := g.rdb.Expire(ctx, key, queueClaimTTL).Err(); err != nil {
+			return httperror.InternalServerError("failed to refresh queue claim", err)
+		}
+	}
+
+	return nil
+}
+
+// holdClaim keeps the claim of owner on a queue alive while a long-lived session is open, claims
+// are otherwise only refreshed when a client connects. The returned function stops the refresh.
+func (g *queueGuard) holdClaim(ctx context.Context, stream killfeed.StreamConfig, queueID string, owner string) func() {
+	done := make(chan struct{})
+	key := stream.Key("owner", queueID)
+
+	go func() {
+		ticker := time.NewTicker(queueClaimRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ownership, _ := g.settings(); !ownership {
+					continue
+				}
+
+				if _, err := g.refreshClaim(context.Background(), key, owner); err != nil {
+					zerolog.Ctx(ctx).Warn().Err(err).Str("queue-id", queueID).Msg("failed to refresh queue claim")
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// refreshClaim extends the claim stored at key, it reports whether owner still held it
+func (g *queueGuard) refreshClaim(ctx context.Context, key string, owner string) (bool, error) {
+	refreshed, err := refreshClaimScript.Run(ctx, g.rdb, []string{key}, owner, queueClaimTTL.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to refresh queue claim: %w", err)
+	}
+
+	return refreshed == 1, nil
+}
+
+// join registers a session on a queue according to the session policy. It reports whether the
+// session is the primary one, which advances the shared cursor, and returns a function that must be
+// called when the session ends. evict is called when the session has to be closed, e.g. when a later
+// session takes the queue over.
+func (g *queueGuard) join(ctx context.Context, queueKey string, sessionID string, evict func(eviction)) (bool, func(), *httperror.HTTPError) {
+	subject := "queue:" + queueKey
+
+	acquired, err := g.limiter.Acquire(ctx, subject, sessionID, 1)
+	if err != nil {
+		return false, nil, httperror.InternalServerError("failed to register queue session", err)
+	}
+
+	if !acquired {
+		switch _, policy := g.settings(); policy {
+		case killfeed.QueueSessionReject:
+			return false, nil, httperror.Conflict("queue is in use by another session")
+
+		case killfeed.QueueSessionFanout:
+			// Additional sessions read along with a private cursor and leave the shared one alone
+			return false, g.register(queueKey, sessionID, evict), nil
+
+		case killfeed.QueueSessionTakeover:
+			if err := g.limiter.Force(ctx, subject, sessionID); err != nil {
+				return false, nil, httperror.InternalServerError("failed to take over queue", err)
+			}
+
+			if err := g.publish(ctx, evictMessage{QueueKey: queueKey, Keep: sessionID, Eviction: evictTakeover}); err != nil {
+				return false, nil, httperror.InternalServerError("failed to announce queue takeover", err)
+			}
+		}
+	}
+
+	release := g.limiter.Hold(subject, sessionID, 1, func(err error) {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("queue", queueKey).Msg("failed to maintain queue session")
+
+		// Another session may have become the primary one in the meantime
+		if errors.Is(err, ratelimit.ErrSlotLost) {
+			evict(evictSlotLost)
+		}
+	})
+
+	unregister := g.register(queueKey, sessionID, evict)
+
+	return true, func() {
+		unregister()
+		release()
+	}, nil
+}
+
+func (g *queueGuard) register(queueKey string, sessionID string, evict func(eviction)) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.sessions[queueKey] == nil {
+		g.sessions[queueKey] = map[string]func(eviction){}
+	}
+
+	g.sessions[queueKey][sessionID] = evict
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		delete(g.sessions[queueKey], sessionID)
+		if len(g.sessions[queueKey]) == 0 {
+			delete(g.sessions, queueKey)
+		}
+	}
+}
+
+// evictQueue closes every session of a queue on all instances
+func (g *queueGuard) evictQueue(ctx context.Context, queueKey string, e eviction) error {
+	return g.publish(ctx, evictMessage{QueueKey: queueKey, Eviction: e})
+}
+
+// evictSession closes a session on whichever instance holds it
+func (g *queueGuard) evictSession(ctx context.Context, sessionID string, e eviction) error {
+	return g.publish(ctx, evictMessage{SessionID: sessionID, Eviction: e})
+}
+
+// sessionCount returns the number of sessions of a queue on this instance
+func (g *queueGuard) sessionCount(queueKey string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.sessions[queueKey])
+}
+
+func (g *queueGuard) publish(ctx context.Context, message evictMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode eviction: %w", err)
+	}
+
+	if err := g.rdb.Publish(ctx, sessionEvictChannel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish eviction: %w", err)
+	}
+
+	return nil
+}
+
+// watchEvictions closes the local sessions selected by evictions published on any instance
+func (g *queueGuard) watchEvictions(ctx context.Context) {
+	pubsub := g.rdb.Subscribe(ctx, sessionEvictChannel)
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		var evict evictMessage
+		if err := json.Unmarshal([]byte(message.Payload), &evict); err != nil {
+			log.Warn().Err(err).Msg("failed to decode eviction")
+			continue
+		}
+
+		evicted := g.selectEvicted(evict)
+		for _, fn := range evicted {
+			fn(evict.Eviction)
+		}
+
+		if len(evicted) > 0 {
+			log.Info().Str("queue", evict.QueueKey).Str("session", evict.SessionID).Str("reason", evict.Eviction.Reason).Int("sessions", len(evicted)).Msg("evicted sessions")
+		}
+	}
+}
+
+func (g *queueGuard) selectEvicted(evict evictMessage) []func(eviction) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	evicted := []func(eviction){}
+
+	for queueKey, sessions := range g.sessions {
+		if evict.QueueKey != "" && queueKey != evict.QueueKey {
+			continue
+		}
+
+		for id, fn := range sessions {
+			if id == evict.Keep || (evict.SessionID != "" && id != evict.SessionID) {
+				continue
+			}
+
+			evicted = append(evicted, fn)
+		}
+	}
+
+	return evicted
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"killfeed"
+	"killfeed/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshClaim(t *testing.T) {
+	rdb, server := newTestRedis(t)
+
+	guard := newQueueGuard(rdb, nil, killfeed.StreamAPIConfig{QueueOwnership: true})
+	ctx := context.Background()
+	key := "stream:owner:queue"
+
+	server.Set(key, "owner")
+	server.SetTTL(key, time.Minute)
+
+	if refreshed, err := guard.refreshClaim(ctx, key, "owner"); err != nil || !refreshed {
+		t.Fatalf("claim of the owner not refreshed: %v", err)
+	}
+
+	if ttl := server.TTL(key); ttl != queueClaimTTL {
+		t.Fatalf("expected the claim to live for %s, got %s", queueClaimTTL, ttl)
+	}
+
+	// A claim taken by another client after it expired is not extended for the previous owner
+	server.Set(key, "other")
+	server.SetTTL(key, time.Minute)
+
+	if refreshed, err := guard.refreshClaim(ctx, key, "owner"); err != nil || refreshed {
+		t.Fatalf("claim of another client refreshed: %v", err)
+	}
+
+	if ttl := server.TTL(key); ttl != time.Minute {
+		t.Fatalf("claim of another client changed to %s", ttl)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	rdb, server := newTestRedis(t)
+
+	guard := newQueueGuard(rdb, nil, killfeed.StreamAPIConfig{QueueOwnership: true})
+	stream := killfeed.StreamConfig{Name: killfeed.StreamKillmails}
+
+	owner := httptest.NewRequest(http.MethodGet, "/poll/queue", nil)
+	owner.RemoteAddr = "192.0.2.1:1234"
+
+	other := httptest.NewRequest(http.MethodGet, "/poll/queue", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+
+	if httpErr := guard.claim(owner, stream, "queue"); httpErr != nil {
+		t.Fatalf("failed to claim unclaimed queue: %v", httpErr)
+	}
+
+	if claimed, _ := server.Get(stream.Key("owner", "queue")); claimed != "ip:192.0.2.1" {
+		t.Fatalf("expected the queue to be claimed by ip:192.0.2.1, got %q", claimed)
+	}
+
+	if httpErr := guard.claim(owner, stream, "queue"); httpErr != nil {
+		t.Fatalf("owner rejected from its own queue: %v", httpErr)
+	}
+
+	if httpErr := guard.claim(other, stream, "queue"); httpErr == nil || httpErr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another client, got %v", httpErr)
+	}
+
+	// Without ownership every client may use every queue
+	guard.reload(killfeed.StreamAPIConfig{QueueOwnership: false})
+
+	if httpErr := guard.claim(other, stream, "queue"); httpErr != nil {
+		t.Fatalf("claim enforced with ownership disabled: %v", httpErr)
+	}
+}
+
+// evictions records the evictions of a session
+type evictions chan eviction
+
+func (e evictions) evict(ev eviction) {
+	e <- ev
+}
+
+func TestJoinReject(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+
+	guard := newQueueGuard(rdb, ratelimit.New(rdb), killfeed.StreamAPIConfig{QueueSessionPolicy: killfeed.QueueSessionReject})
+	ctx := context.Background()
+
+	primary, leave, httpErr := guard.join(ctx, "stream:poll:queue", "first", func(eviction) {})
+	if httpErr != nil || !primary {
+		t.Fatalf("first session not joined as primary: %v", httpErr)
+	}
+
+	if _, _, httpErr := guard.join(ctx, "stream:poll:queue", "second", func(eviction) {}); httpErr == nil || httpErr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a second session, got %v", httpErr)
+	}
+
+	// Other queues and transports are separate
+	_, leaveOther, httpErr := guard.join(ctx, "stream:websocket:queue", "other", func(eviction) {})
+	if httpErr != nil {
+		t.Fatalf("session of another transport rejected: %v", httpErr)
+	}
+
+	leaveOther()
+
+	leave()
+
+	if guard.sessionCount("stream:poll:queue") != 0 {
+		t.Fatal("session still registered after leaving")
+	}
+
+	primary, leave, httpErr = guard.join(ctx, "stream:poll:queue", "second", func(eviction) {})
+	if httpErr != nil || !primary {
+		t.Fatalf("session rejected after the first one left: %v", httpErr)
+	}
+
+	leave()
+}
+
+func TestJoinFanout(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+
+	guard := newQueueGuard(rdb, ratelimit.New(rdb), killfeed.StreamAPIConfig{QueueSessionPolicy: killfeed.QueueSessionFanout})
+	ctx := context.Background()
+
+	primary, leaveFirst, httpErr := guard.join(ctx, "stream:poll:queue", "first", func(eviction) {})
+	if httpErr != nil || !primary {
+		t.Fatalf("first session not joined as primary: %v", httpErr)
+	}
+
+	// Later sessions read along with a private cursor
+	primary, leaveSecond, httpErr := guard.join(ctx, "stream:poll:queue", "second", func(eviction) {})
+	if httpErr != nil || primary {
+		t.Fatalf("expected the second session to join without the shared cursor, primary %t: %v", primary, httpErr)
+	}
+
+	if count := guard.sessionCount("stream:poll:queue"); count != 2 {
+		t.Fatalf("expected 2 sessions, got %d", count)
+	}
+
+	leaveSecond()
+	leaveFirst()
+
+	if count := guard.sessionCount("stream:poll:queue"); count != 0 {
+		t.Fatalf("expected no sessions after leaving, got %d", count)
+	}
+}
+
+func TestJoinTakeover(t *testing.T) {
+	rdb, server := newTestRedis(t)
+
+	limiter := ratelimit.New(rdb)
+	guard := newQueueGuard(rdb, limiter, killfeed.StreamAPIConfig{QueueSessionPolicy: killfeed.QueueSessionTakeover})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go guard.watchEvictions(ctx)
+	waitForSubscriber(t, server.PubSubNumSub)
+
+	first := make(evictions, 1)
+	primary, leaveFirst, httpErr := guard.join(ctx, "stream:websocket:queue", "first", first.evict)
+	if httpErr != nil || !primary {
+		t.Fatalf("first session not joined as primary: %v", httpErr)
+	}
+
+	second := make(evictions, 1)
+	primary, leaveSecond, httpErr := guard.join(ctx, "stream:websocket:queue", "second", second.evict)
+	if httpErr != nil || !primary {
+		t.Fatalf("expected the second session to take the queue over, primary %t: %v", primary, httpErr)
+	}
+
+	defer leaveSecond()
+
+	select {
+	case e := <-first:
+		if e != evictTakeover {
+			t.Fatalf("expected the takeover eviction, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first session was not evicted")
+	}
+
+	select {
+	case e := <-second:
+		t.Fatalf("new session evicted: %+v", e)
+	default:
+	}
+
+	// The first session lost the queue slot and cannot take it back on a refresh
+	leaveFirst()
+
+	if acquired, err := limiter.Acquire(ctx, "queue:stream:websocket:queue", "first", 1); err != nil || acquired {
+		t.Fatalf("evicted session acquired the queue again: %v", err)
+	}
+}
+
+// waitForSubscriber waits until watchEvictions subscribed, evictions published before are lost
+func waitForSubscriber(t *testing.T, numSub func(channels ...string) map[string]int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for numSub(sessionEvictChannel)[sessionEvictChannel] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("evictions were not subscribed")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"killfeed"
+	"killfeed/apikey"
+	"killfeed/httperror"
+	"killfeed/ratelimit"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// rateLimits applies the limits of a client's tier. Clients are identified by API key, SSO
+// session or IP, in that order. Queues are limited as well with the tier of their owner, since a
+// fanout queue can be read by several sessions and, without ownership, by several clients.
+type rateLimits struct {
+	rdb     redis.UniversalClient
+	keys    *apikey.Store
+	limiter *ratelimit.Limiter
+	// config is replaced as a whole when the configuration is reloaded
+	config atomic.Pointer[killfeed.RateLimitConfig]
+}
+
+func newRateLimits(rdb redis.UniversalClient, keys *apikey.Store, limiter *ratelimit.Limiter, config killfeed.StreamAPIConfig) *rateLimits {
+	l := &rateLimits{rdb: rdb, keys: keys, limiter: limiter}
+	l.reload(config)
+
+	return l
+}
+
+// reload applies new limits, requests and connections in flight keep the tier they started with
+func (l *rateLimits) reload(config killfeed.StreamAPIConfig) {
+	l.config.Store(&config.RateLimitConfig)
+}
+
+// client returns the subject limits are counted against and its tier
+func (l *rateLimits) client(r *http.Request, tiers map[string]killfeed.RateLimitTier) (string, killfeed.RateLimitTier) {
+	if key, ok := requestKey(r); ok {
+		tier, ok := tiers[key.Tier]
+		if !ok {
+			tier = tiers[killfeed.RateLimitTierDefault]
+		}
+
+		return clientSubject(r), tier
+	}
+
+	return clientSubject(r), tiers[killfeed.RateLimitTierAnonymous]
+}
+
+// owner returns the tier of the client owning a queue. Unclaimed queues, e.g. with ownership
+// disabled, use the tier of the requesting client.
+func (l *rateLimits) owner(r *http.Request, stream killfeed.StreamConfig, queueID string, tiers map[string]killfeed.RateLimitTier) (killfeed.RateLimitTier, error) {
+	owner, err := l.rdb.Get(r.Context(), stream.Key("owner", queueID)).Result()
+	if err == redis.Nil || owner == clientSubject(r) {
+		_, tier := l.client(r, tiers)
+		return tier, nil
+	}
+
+	if err != nil {
+		return killfeed.RateLimitTier{}, fmt.Errorf("failed to read queue owner: %w", err)
+	}
+
+	keyID, ok := strings.CutPrefix(owner, "key:")
+	if !ok {
+		return tiers[killfeed.RateLimitTierAnonymous], nil
+	}
+
+	// SSO sessions and keys that were revoked since they claimed the queue use the default tier
+	tierName := killfeed.RateLimitTierDefault
+	if !strings.HasPrefix(keyID, "sso:") {
+		key, err := l.keys.Get(r.Context(), keyID)
+		if err != nil && !errors.Is(err, apikey.ErrNotFound) {
+			return killfeed.RateLimitTier{}, err
+		}
+
+		if err == nil {
+			tierName = key.Tier
+		}
+	}
+
+	tier, ok := tiers[tierName]
+	if !ok {
+		tier = tiers[killfeed.RateLimitTierDefault]
+	}
+
+	return tier, nil
+}
+
+// queue counts a request against the queue and holds one of the queue's connection slots until the
+// returned function is called. It is used by handlers once they know the stream of the queue, evict
+// closes the session when the slot is lost.
+func (l *rateLimits) queue(r *http.Request, stream killfeed.StreamConfig, queueID string, evict func(eviction)) (func(), *httperror.HTTPError) {
+	config := l.config.Load()
+	if !config.RateLimitEnabled {
+		return func() {}, nil
+	}
+
+	tier, err := l.owner(r, stream, queueID, config.RateLimitTiers)
+	if err != nil {
+		return nil, httperror.InternalServerError("failed to look up queue tier", err)
+	}
+
+	// Sessions of a queue are counted across transports, unlike the session policy of join
+	subject := "queue:" + stream.Key("queue", queueID)
+
+	allowed, retryAfter, err := l.limiter.Allow(r.Context(), subject, tier.Requests, tier.Window)
+	if err != nil {
+		return nil, httperror.InternalServerError("failed to check queue rate limit", err)
+	}
+
+	if !allowed {
+		rateLimited.WithLabelValues("queue_requests").Inc()
+		return nil, httperror.TooManyRequests("queue rate limit exceeded", retryAfter)
+	}
+
+	id, err := connectionID()
+	if err != nil {
+		return nil, httperror.InternalServerError("failed to create connection ID", err)
+	}
+
+	acquired, err := l.limiter.Acquire(r.Context(), subject, id, tier.Connections)
+	if err != nil {
+		return nil, httperror.InternalServerError("failed to acquire queue connection slot", err)
+	}
+
+	if !acquired {
+		rateLimited.WithLabelValues("queue_connections").Inc()
+		return nil, httperror.TooManyRequests(fmt.Sprintf("queue connection limit of %d exceeded", tier.Connections), ratelimit.LeaseTTL/3)
+	}
+
+	return l.limiter.Hold(subject, id, tier.Connections, func(err error) {
+		zerolog.Ctx(r.Context()).Warn().Err(err).Str("queue-id", queueID).Msg("failed to maintain queue connection slot")
+
+		if errors.Is(err, ratelimit.ErrSlotLost) {
+			evict(evictSlotLost)
+		}
+	}), nil
+}
+
+// requests rejects clients that exceed the request rate of their tier
+func (l *rateLimits) requests(handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		config := l.config.Load()
+		if !config.RateLimitEnabled {
+			return handlerFn(w, r)
+		}
+
+		subject, tier := l.client(r, config.RateLimitTiers)
+
+		allowed, retryAfter, err := l.limiter.Allow(r.Context(), subject, tier.Requests, tier.Window)
+		if err != nil {
+			return httperror.InternalServerError("failed to check rate limit", err)
+		}
+
+		if !allowed {
+			rateLimited.WithLabelValues("requests").Inc()
+			return httperror.TooManyRequests("rate limit exceeded", retryAfter)
+		}
+
+		return handlerFn(w, r)
+	}
+}
+
+// connections holds one of the client's connection slots while the handler runs, which lasts as
+// long as a websocket is open or a long poll blocks
+func (l *rateLimits) connections(handlerFn HTTPHandlerWithErr) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		config := l.config.Load()
+		if !config.RateLimitEnabled {
+			return handlerFn(w, r)
+		}
+
+		subject, tier := l.client(r, config.RateLimitTiers)
+
+		id, err := connectionID()
+		if err != nil {
+			return httperror.InternalServerError("failed to create connection ID", err)
+		}
+
+		acquired, err := l.limiter.Acquire(r.Context(), subject, id, tier.Connections)
+		if err != nil {
+			return httperror.InternalServerError("failed to acquire connection slot", err)
+		}
+
+		if !acquired {
+			rateLimited.WithLabelValues("connections").Inc()
+			return httperror.TooManyRequests(fmt.Sprintf("connection limit of %d exceeded", tier.Connections), ratelimit.LeaseTTL/3)
+		}
+
+		// Without a slot the connection is closed, by the handler's eviction if it registered one
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		slot := &heldSlot{evict: func(eviction) { cancel() }}
+		r = r.WithContext(context.WithValue(ctx, slotContextKey, slot))
+
+		release := l.limiter.Hold(subject, id, tier.Connections, func(err error) {
+			zerolog.Ctx(r.Context()).Warn().Err(err).Str("subject", subject).Msg("failed to maintain connection slot")
+
+			if errors.Is(err, ratelimit.ErrSlotLost) {
+				slot.lost()
+			}
+		})
+		defer release()
+
+		return handlerFn(w, r)
+	}
+}
+
+// heldSlot closes the connection of a request once its connection slot is lost
+type heldSlot struct {
+	mu    sync.Mutex
+	evict func(eviction)
+}
+
+func (s *heldSlot) lost() {
+	s.mu.Lock()
+	evict := s.evict
+	s.mu.Unlock()
+
+	evict(evictSlotLost)
+}
+
+// onSlotLost makes a lost connection slot evict the session of the request, so the client is told
+// why it is closed. Requests without a slot, e.g. with rate limits disabled, are left alone.
+func onSlotLost(r *http.Request, evict func(eviction)) {
+	slot, ok := r.Context().Value(slotContextKey).(*heldSlot)
+	if !ok {
+		return
+	}
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	slot.evict = evict
+}
+
+func connectionID() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
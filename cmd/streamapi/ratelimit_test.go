@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"killfeed"
+	"killfeed/apikey"
+	"killfeed/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueueLimitUsesOwnerTier(t *testing.T) {
+	rdb, server := newTestRedis(t)
+	keys := apikey.NewStore(rdb)
+
+	config := killfeed.StreamAPIConfig{RateLimitConfig: killfeed.RateLimitConfig{
+		RateLimitEnabled: true,
+		RateLimitTiers: map[string]killfeed.RateLimitTier{
+			killfeed.RateLimitTierAnonymous: {Requests: 100, Window: time.Minute, Connections: 1},
+			killfeed.RateLimitTierDefault:   {Requests: 100, Window: time.Minute, Connections: 2},
+			"partner":                       {Requests: 100, Window: time.Minute, Connections: 3},
+		},
+	}}
+
+	limits := newRateLimits(rdb, keys, ratelimit.New(rdb), config)
+	stream := killfeed.StreamConfig{Name: killfeed.StreamKillmails}
+
+	owner, _, err := keys.Create(context.Background(), "owner", []string{apikey.ScopeReadStream}, "partner")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+
+	server.Set(stream.Key("owner", "shared"), "key:"+owner.ID)
+
+	// Anonymous sessions on the queue are limited by the tier of its owner, not their own
+	request := httptest.NewRequest(http.MethodGet, "/poll/shared", nil)
+
+	releases := []func(){}
+	for i := 0; i < 3; i++ {
+		release, httpErr := limits.queue(request, stream, "shared", func(eviction) {})
+		if httpErr != nil {
+			t.Fatalf("session %d within the owner's limit was rejected: %v", i+1, httpErr)
+		}
+
+		releases = append(releases, release)
+	}
+
+	if _, httpErr := limits.queue(request, stream, "shared", func(eviction) {}); httpErr == nil || httpErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the owner's connection limit, got %v", httpErr)
+	}
+
+	releases[0]()
+
+	if _, httpErr := limits.queue(request, stream, "shared", func(eviction) {}); httpErr != nil {
+		t.Fatalf("released slot was not reusable: %v", httpErr)
+	}
+
+	// Unclaimed queues use the tier of the requesting client
+	if _, httpErr := limits.queue(request, stream, "unclaimed", func(eviction) {}); httpErr != nil {
+		t.Fatalf("first anonymous session was rejected: %v", httpErr)
+	}
+
+	if _, httpErr := limits.queue(request, stream, "unclaimed", func(eviction) {}); httpErr == nil || httpErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the anonymous connection limit, got %v", httpErr)
+	}
+}
+
+func TestLostSlotEvictsSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slot := &heldSlot{evict: func(eviction) { cancel() }}
+	request := httptest.NewRequest(http.MethodGet, "/websocket/queue", nil)
+	request = request.WithContext(context.WithValue(ctx, slotContextKey, slot))
+
+	var evicted *eviction
+	onSlotLost(request, func(e eviction) { evicted = &e })
+
+	slot.lost()
+
+	if evicted == nil || *evicted != evictSlotLost {
+		t.Fatalf("expected the session to be evicted for the lost slot, got %v", evicted)
+	}
+
+	// The connection itself is closed by the handler's eviction
+	if ctx.Err() != nil {
+		t.Fatal("request context canceled although the handler evicted the session")
+	}
+
+	// Without a registered eviction the request is canceled
+	slot = &heldSlot{evict: func(eviction) { cancel() }}
+	slot.lost()
+
+	if ctx.Err() == nil {
+		t.Fatal("request context not canceled for the lost slot")
+	}
+
+	// Requests without a slot have nothing to watch
+	onSlotLost(httptest.NewRequest(http.MethodGet, "/poll/queue", nil), func(eviction) {})
+}
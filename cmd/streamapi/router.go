@@ -6,7 +6,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 )
 
 type HTTPHandlerWithErr func(http.ResponseWriter, *http.Request) *httperror.HTTPError
@@ -25,7 +25,7 @@ func (rt *Router) handler(handlerFn HTTPHandlerWithErr) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := handlerFn(w, r); err != nil {
 			render.Render(w, r, err)
-			log.Warn().Err(err).Int("status", err.Code).Msg("request failed")
+			zerolog.Ctx(r.Context()).Warn().Err(err).Int("status", err.Code).Msg("request failed")
 		}
 	}
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"killfeed/tracing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRead records a read from a stream that started at start. Reads that timed out without
+// entries are not recorded, idle websockets would otherwise export a span every few seconds.
+func traceRead(ctx context.Context, stream string, start time.Time, streams []redis.XStream, err error) {
+	if err == redis.Nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	entries := 0
+	for _, stream := range streams {
+		entries += len(stream.Messages)
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "stream.read", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String("stream", stream),
+		attribute.Int("stream.entries", entries),
+	))
+
+	tracing.End(span, err)
+}
+
+// traceDelivery continues the trace of every delivered killmail with a span covering the write to
+// the client. Entries without a trace context were added before tracing and are skipped.
+func traceDelivery(transport string, queueID string, messages []redis.XMessage, start time.Time, err error) {
+	for _, message := range messages {
+		ctx := tracing.Extract(context.Background(), message)
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			continue
+		}
+
+		_, span := tracing.Tracer().Start(ctx, "killmail.deliver", trace.WithTimestamp(start), trace.WithAttributes(
+			attribute.String("transport", transport),
+			attribute.String("queue.id", queueID),
+			attribute.String("stream.entry_id", message.ID),
+		))
+
+		tracing.End(span, err)
+	}
+}
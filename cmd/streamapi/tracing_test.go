@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTraceRead(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	ctx := context.Background()
+	start := time.Now().Add(-time.Second)
+
+	// Reads that timed out or were canceled without entries are not recorded
+	traceRead(ctx, "killmails", start, nil, redis.Nil)
+	traceRead(ctx, "killmails", start, nil, context.Canceled)
+
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("expected no spans for empty reads, got %d", len(spans))
+	}
+
+	traceRead(ctx, "killmails", start, []redis.XStream{{Stream: "killmails", Messages: []redis.XMessage{{ID: "1-0"}, {ID: "2-0"}}}}, nil)
+	traceRead(ctx, "killmails", start, nil, errors.New("connection reset"))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	if !spans[0].StartTime().Equal(start) {
+		t.Fatalf("span does not start with the read: %s", spans[0].StartTime())
+	}
+
+	for _, attribute := range spans[0].Attributes() {
+		if attribute.Key == "stream.entries" && attribute.Value.AsInt64() != 2 {
+			t.Fatalf("expected 2 entries, got %d", attribute.Value.AsInt64())
+		}
+	}
+
+	if spans[1].Status().Description != "connection reset" {
+		t.Fatalf("failed read not marked as failed: %+v", spans[1].Status())
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"killfeed"
+	"killfeed/classify"
+	"killfeed/httperror"
+	"killfeed/sso"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/olahol/melody"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+const (
+	websocketHeartbeatInterval = 30 * time.Second
+	websocketMaxBatchSize      = 100
+	websocketReadCount         = 10
+	websocketReadBlock         = 5 * time.Second
+)
+
+// websocketClient holds the options a websocket was opened with and the state clients change
+// through commands. The fields below mu are shared between the read loop and the command handler.
+type websocketClient struct {
+	// id identifies the session to administrators
+	id      string
+	queueID string
+	// subject is the client the rate limits and queue ownership are counted against
+	subject string
+	stream  killfeed.StreamConfig
+	format  string
+	// envelope wraps every frame in an Envelope, otherwise frames are bare killmails
+	envelope bool
+	// batchSize is the maximum number of killmails per frame, only used with envelopes
+	batchSize int
+	// timings includes the pipeline timings in every killmail
+	timings bool
+	// canManage allows commands that change the subscription, stats is always allowed
+	canManage bool
+	// session restricts the feed to the kills of a logged in pilot
+	session *sso.Session
+	// private sessions share a queue under the fanout policy and do not store their cursor
+	private bool
+	// evicted holds why the server closes the session, e.g. because the queue was taken over
+	evicted     atomic.Pointer[eviction]
+	connectedAt time.Time
+
+	mu sync.Mutex
+	// cursor is the ID of the last entry delivered, reads continue after it
+	cursor string
+	// epoch is the reset counter of the stored cursor as of loading it
+	epoch string
+	// generation changes on every seek, so reads started before a seek are discarded
+	generation int
+	paused     bool
+	// resumed is closed when a paused client resumes
+	resumed      chan struct{}
+	unsubscribed bool
+	filter       *CommandFilter
+	sent         int64
+	skipped      int64
+	// lag is the last measured lag of the session
+	lag LagData
+}
+
+// streamEntry is a killmail payload together with its stream ID
+type streamEntry struct {
+	id      string
+	payload []byte
+	message redis.XMessage
+}
+
+func handleWebsocketRequest(m *melody.Melody, selectStream streamSelector, authEnabled bool, guard *queueGuard, limits *rateLimits) HTTPHandlerWithErr {
+	return func(w http.ResponseWriter, r *http.Request) *httperror.HTTPError {
+		queueID, httpErr := queueIDParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		stream, httpErr := selectStream(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		format, httpErr := formatParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		timings, httpErr := timingsParam(r)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		client := &websocketClient{
+			queueID:     queueID,
+			stream:      stream,
+			format:      format,
+			batchSize:   1,
+			timings:     timings,
+			canManage:   canManageSubscriptions(authEnabled, r),
+			session:     requestSession(r),
+			connectedAt: time.Now(),
+		}
+
+		switch protocol := r.URL.Query().Get("protocol"); protocol {
+		case "":
+		case strconv.Itoa(EnvelopeVersion):
+			client.envelope = true
+		default:
+			return httperror.BadRequest(fmt.Sprintf("unsupported protocol version %q", protocol))
+		}
+
+		if raw := r.URL.Query().Get("batch"); raw != "" {
+			batchSize, err := strconv.Atoi(raw)
+			if err != nil || batchSize < 1 || batchSize > websocketMaxBatchSize {
+				return httperror.BadRequest(fmt.Sprintf("batch must be between 1 and %d", websocketMaxBatchSize))
+			}
+
+			if !client.envelope {
+				return httperror.BadRequest("batch requires the envelope protocol")
+			}
+
+			client.batchSize = batchSize
+		}
+
+		if httpErr := guard.claim(r, stream, queueID); httpErr != nil {
+			return httpErr
+		}
+
+		sessionID, err := connectionID()
+		if err != nil {
+			return httperror.InternalServerError("failed to create session ID", err)
+		}
+
+		client.id = sessionID
+		client.subject = clientSubject(r)
+
+		// An eviction cancels the context of the session, which closes it
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		evict := func(e eviction) {
+			client.evicted.Store(&e)
+			cancel()
+		}
+
+		onSlotLost(r, evict)
+
+		release, httpErr := limits.queue(r, stream, queueID, evict)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		defer release()
+
+		primary, leave, httpErr := guard.join(ctx, stream.Key(TransportWebsocket, queueID), sessionID, evict)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		defer leave()
+
+		// Websockets can stay open for longer than a claim lives
+		defer guard.holdClaim(ctx, stream, queueID, client.subject)()
+
+		client.private = !primary
+
+		// Blocks until the websocket is closed
+		m.HandleRequestWithKeys(countingResponseWriter{ResponseWriter: w}, r.WithContext(ctx), map[string]any{"queueID": queueID, "client": client})
+		return nil
+	}
+}
+
+// send writes a frame, as text for JSON and binary for MessagePack
+func (c *websocketClient) send(s *melody.Session, frame []byte) error {
+	if c.format == killfeed.FormatMsgpack {
+		return s.WriteBinaryWithDeadline(frame, 0)
+	}
+
+	return s.WriteWithDeadline(frame, 0)
+}
+
+// sendEnvelope writes a control message, it is a no-op for clients without envelopes
+func (c *websocketClient) sendEnvelope(s *melody.Session, envelope Envelope) error {
+	if !c.envelope {
+		return nil
+	}
+
+	return c.reply(s, envelope)
+}
+
+// sendEntries writes killmails, bare or batched into envelopes
+func (c *websocketClient) sendEntries(s *melody.Session, entries []streamEntry) error {
+	if !c.envelope {
+		for _, entry := range entries {
+			websocketPayloadBytes.Add(float64(len(entry.payload)))
+
+			writeStart := time.Now()
+			err := c.send(s, entry.payload)
+			traceDelivery(TransportWebsocket, c.queueID, []redis.XMessage{entry.message}, writeStart, err)
+
+			if err != nil {
+				return err
+			}
+
+			killmailsDelivered.WithLabelValues(TransportWebsocket).Inc()
+			observeDelivery([]redis.XMessage{entry.message}, time.Now())
+		}
+
+		return nil
+	}
+
+	for start := 0; start < len(entries); start += c.batchSize {
+		batch := entries[start:min(start+c.batchSize, len(entries))]
+
+		envelope := Envelope{Type: EnvelopeKillmail, Cursor: batch[len(batch)-1].id}
+
+		payloads := make([][]byte, len(batch))
+		for i, entry := range batch {
+			payloads[i] = entry.payload
+		}
+
+		if c.batchSize == 1 {
+			envelope.Data = rawData(c.format, payloads[0])
+		} else {
+			envelope.Type = EnvelopeKillmails
+			envelope.Data = rawDataList(c.format, payloads)
+		}
+
+		frame, err := encodeEnvelope(c.format, envelope)
+		if err != nil {
+			return err
+		}
+
+		websocketPayloadBytes.Add(float64(len(frame)))
+
+		delivered := make([]redis.XMessage, len(batch))
+		for i, entry := range batch {
+			delivered[i] = entry.message
+		}
+
+		writeStart := time.Now()
+		err = c.send(s, frame)
+		traceDelivery(TransportWebsocket, c.queueID, delivered, writeStart, err)
+
+		if err != nil {
+			return err
+		}
+
+		killmailsDelivered.WithLabelValues(TransportWebsocket).Add(float64(len(batch)))
+		observeDelivery(delivered, time.Now())
+	}
+
+	return nil
+}
+
+func handleWebsocket(ctx context.Context, logger zerolog.Logger, rdb redis.UniversalClient, resolver classify.Resolver, lags *lagMonitor, s *melody.Session, client *websocketClient) {
+	if err := client.loadCursor(ctx, rdb); err != nil {
+		logger.Error().Err(err).Msg("failed to load websocket cursor")
+		closeWithError(logger, s, client)
+		return
+	}
+
+	if err := client.sendEnvelope(s, Envelope{Type: EnvelopeSubscribed, Data: SubscribedData{QueueID: client.queueID, Stream: client.stream.Name, Format: client.format, BatchSize: client.batchSize}}); err != nil {
+		logger.Error().Err(err).Msg("failed to write subscription ack")
+	}
+
+	if client.envelope {
+		go sendHeartbeats(ctx, logger, s, client)
+	}
+
+	readCount := max(websocketReadCount, client.batchSize)
+
+	for {
+		if !client.waitResumed(ctx) {
+			closeIfEvicted(logger, s, client)
+			return
+		}
+
+		cursor, generation := client.readPosition()
+
+		entries, err := fetchWebsocketKillmails(ctx, rdb, client.stream, client.format, client.timings, cursor, int64(readCount))
+		if err != nil {
+			if errors.Is(err, context.Canceled) && client.evicted.Load() != nil {
+				closeIfEvicted(logger, s, client)
+				return
+			}
+
+			if errors.Is(err, context.Canceled) && s.IsClosed() {
+				return
+			}
+
+			logger.Error().Err(err).Msg("failed to fetch websocket killmails")
+			closeWithError(logger, s, client)
+			return
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		// Entries read across a seek or pause are dropped without moving the cursor, so they are
+		// read again from the right position
+		if !client.deliverable(generation) {
+			continue
+		}
+
+		lag, gap, checked, err := lags.check(ctx, client.stream.Key(TransportWebsocket, client.queueID), client.stream.Name, cursor, entries[0].id, entries[len(entries)-1].id, len(entries) == readCount)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to check websocket lag")
+		}
+
+		if gap != nil {
+			queueGaps.WithLabelValues(TransportWebsocket).Inc()
+			logger.Warn().Str("from", gap.From).Str("to", gap.To).Msg("websocket cursor was trimmed from the stream")
+
+			if err := client.sendEnvelope(s, Envelope{Type: EnvelopeGap, Data: gap}); err != nil {
+				logger.Error().Err(err).Msg("failed to write gap notice")
+			}
+		}
+
+		if checked {
+			client.setLag(lag)
+			observeLag(TransportWebsocket, lag)
+
+			if lags.exceeds(lag) {
+				if err := client.sendEnvelope(s, Envelope{Type: EnvelopeLag, Data: lag}); err != nil {
+					logger.Error().Err(err).Msg("failed to write lag warning")
+				}
+			}
+		}
+
+		selected, err := client.selectEntries(ctx, resolver, entries)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to filter websocket killmails")
+			closeWithError(logger, s, client)
+			return
+		}
+
+		if err := client.sendEntries(s, selected); err != nil {
+			logger.Error().Err(err).Msg("failed to write to websocket")
+			if err := s.CloseWithMsg(melody.FormatCloseMessage(melody.CloseAbnormalClosure, "write failed")); err != nil {
+				logger.Error().Err(err).Msg("failed to close websocket after write error")
+			}
+
+			return
+		}
+
+		if err := client.advance(ctx, rdb, generation, entries[len(entries)-1].id, len(selected), len(entries)-len(selected)); errors.Is(err, errCursorReset) {
+			// The eviction of the reset may not have arrived yet
+			client.evicted.CompareAndSwap(nil, &evictCursorReset)
+			closeIfEvicted(logger, s, client)
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msg("failed to store websocket cursor")
+			closeWithError(logger, s, client)
+			return
+		}
+	}
+}
+
+// closeIfEvicted tells an evicted session why it is closed and closes it
+func closeIfEvicted(logger zerolog.Logger, s *melody.Session, client *websocketClient) {
+	e := client.evicted.Load()
+	if e == nil || s.IsClosed() {
+		return
+	}
+
+	if err := client.sendEnvelope(s, Envelope{Type: EnvelopeError, Data: ErrorData{Code: e.Code, Message: e.Reason}}); err != nil {
+		logger.Error().Err(err).Msg("failed to write eviction notice")
+	}
+
+	if err := s.CloseWithMsg(melody.FormatCloseMessage(e.CloseCode, e.Reason)); err != nil {
+		logger.Error().Err(err).Msg("failed to close evicted websocket")
+	}
+}
+
+// closeWithError sends an error envelope and closes the websocket
+func closeWithError(logger zerolog.Logger, s *melody.Session, client *websocketClient) {
+	if err := client.sendEnvelope(s, Envelope{Type: EnvelopeError, Data: ErrorData{Code: http.StatusInternalServerError, Message: "internal server error"}}); err != nil {
+		logger.Error().Err(err).Msg("failed to write error message")
+	}
+
+	if err := s.CloseWithMsg(melody.FormatCloseMessage(melody.CloseInternalServerErr, "internal server error")); err != nil {
+		logger.Error().Err(err).Msg("failed to close websocket after fetch error")
+	}
+}
+
+// loadCursor restores the stored cursor of the queue, new queues start at the end of the stream
+func (c *websocketClient) loadCursor(ctx context.Context, rdb redis.UniversalClient) error {
+	cursor, epoch, err := loadCursor(ctx, rdb, c.stream.Key(TransportWebsocket, c.queueID))
+	if err != nil {
+		return err
+	}
+
+	if cursor == "" {
+		cursor, err = lastStreamID(ctx, rdb, c.stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.cursor = cursor
+	c.epoch = epoch
+	c.mu.Unlock()
+
+	return nil
+}
+
+// lastStreamID returns the ID of the newest entry, reading after it only returns new entries
+func lastStreamID(ctx context.Context, rdb redis.UniversalClient, stream killfeed.StreamConfig) (string, error) {
+	messages, err := rdb.XRevRangeN(ctx, stream.Name, "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to read last stream ID: %w", err)
+	}
+
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+
+	return messages[0].ID, nil
+}
+
+func (c *websocketClient) readPosition() (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cursor, c.generation
+}
+
+func (c *websocketClient) setLag(lag LagData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lag = lag
+}
+
+// waitResumed blocks while the client is paused, it returns false once ctx is done
+func (c *websocketClient) waitResumed(ctx context.Context) bool {
+	c.mu.Lock()
+	resumed := c.resumed
+	paused := c.paused
+	c.mu.Unlock()
+
+	if paused {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-resumed:
+		}
+	}
+
+	return ctx.Err() == nil
+}
+
+// deliverable reports whether entries read at generation may still be sent
+func (c *websocketClient) deliverable(generation int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.paused && c.generation == generation
+}
+
+// selectEntries drops the entries an unsubscribed client or its filter does not want
+func (c *websocketClient) selectEntries(ctx context.Context, resolver classify.Resolver, entries []streamEntry) ([]streamEntry, error) {
+	c.mu.Lock()
+	unsubscribed := c.unsubscribed
+	filter := c.filter
+	c.mu.Unlock()
+
+	if unsubscribed {
+		return nil, nil
+	}
+
+	if filter == nil && c.session == nil {
+		return entries, nil
+	}
+
+	selected := []streamEntry{}
+	for _, entry := range entries {
+		killmail, err := killfeed.DecodeStreamMessage(entry.message)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.session != nil && !c.session.Involved(killmail) {
+			continue
+		}
+
+		if filter != nil {
+			ok, err := filter.match(ctx, resolver, killmail)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				continue
+			}
+		}
+
+		selected = append(selected, entry)
+	}
+
+	return selected, nil
+}
+
+// advance moves the cursor past delivered entries unless a seek happened in the meantime
+func (c *websocketClient) advance(ctx context.Context, rdb redis.UniversalClient, generation int, cursor string, sent int, skipped int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return nil
+	}
+
+	c.sent += int64(sent)
+	c.skipped += int64(skipped)
+
+	return c.setCursor(ctx, rdb, cursor)
+}
+
+// setCursor stores the cursor, c.mu must be held
+func (c *websocketClient) setCursor(ctx context.Context, rdb redis.UniversalClient, cursor string) error {
+	if c.private {
+		c.cursor = cursor
+		return nil
+	}
+
+	if err := storeCursor(ctx, rdb, c.stream.Key(TransportWebsocket, c.queueID), cursor, c.epoch); err != nil {
+		return err
+	}
+
+	c.cursor = cursor
+	return nil
+}
+
+func sendHeartbeats(ctx context.Context, logger zerolog.Logger, s *melody.Session, client *websocketClient) {
+	ticker := time.NewTicker(websocketHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-ticker.C:
+			if s.IsClosed() {
+				return
+			}
+
+			if err := client.sendEnvelope(s, Envelope{Type: EnvelopeHeartbeat, Data: HeartbeatData{Time: now.UTC()}}); err != nil {
+				logger.Warn().Err(err).Msg("failed to write heartbeat")
+			}
+		}
+	}
+}
+
+// notifyShutdown tells every client the server is going away and closes all sessions
+func notifyShutdown(logger zerolog.Logger, m *melody.Melody) {
+	sessions, err := m.Sessions()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to list websocket sessions")
+	}
+
+	for _, s := range sessions {
+		client, ok := s.Keys["client"].(*websocketClient)
+		if !ok {
+			continue
+		}
+
+		if err := client.sendEnvelope(s, Envelope{Type: EnvelopeShutdown, Data: ShutdownData{Reason: "server shutting down"}}); err != nil {
+			logger.Warn().Err(err).Msg("failed to write shutdown notice")
+		}
+	}
+
+	if err := m.CloseWithMsg(melody.FormatCloseMessage(melody.CloseGoingAway, "server shutting down")); err != nil {
+		logger.Error().Err(err).Msg("failed to close websocket sessions")
+	}
+}
+
+func fetchWebsocketKillmails(ctx context.Context, rdb redis.UniversalClient, stream killfeed.StreamConfig, format string, timings bool, cursor string, count int64) ([]streamEntry, error) {
+	entries := []streamEntry{}
+
+	// Reads block for a bounded time so pauses and seeks take effect without waiting for a new killmail
+	args := &redis.XReadArgs{
+		ID:      cursor,
+		Streams: []string{stream.Name},
+		Count:   count,
+		Block:   websocketReadBlock,
+	}
+
+	readStart := time.Now()
+	streams, err := rdb.XRead(ctx, args).Result()
+	traceRead(ctx, stream.Name, readStart, streams, err)
+
+	if err == redis.Nil {
+		return entries, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from redis stream: %w", err)
+	}
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			payload, err := entryPayload(message, format, timings)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, streamEntry{id: message.ID, payload: payload, message: message})
+		}
+	}
+
+	return entries, nil
+}
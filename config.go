@@ -2,43 +2,466 @@ package killfeed
 
 import (
 	"errors"
-	"os"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Config holds the settings shared by every command
 type Config struct {
-	Environment           string
-	Port                  int
+	Environment string
+
+	Log   LogConfig
+	Redis RedisConfig
+
+	Stream StreamConfig
+	// BackfillStream shares the other settings of the live stream, it has its own name and retention
+	// so backfilled history is not trimmed away as soon as it is written
+	BackfillStream StreamConfig
+
+	// Traces are exported over OTLP/HTTP when an endpoint is set, e.g. http://collector:4318
+	OTLPEndpoint       string
+	TracingSampleRatio float64
+}
+
+// ESIConfig is needed by commands that call ESI
+type ESIConfig struct {
 	EsiContactInformation string
+}
+
+// ArchiveConfig locates the killmail archive
+type ArchiveConfig struct {
+	ArchiveURL         string
+	ArchiveCompression string
+	ArchiveS3Endpoint  string
+	ArchiveS3Region    string
+	ArchiveS3AccessKey string
+	ArchiveS3SecretKey string
+}
+
+// RateLimitConfig maps tier names to limits. Anonymous clients use the anonymous tier, API keys
+// their own tier and SSO sessions the default tier.
+type RateLimitConfig struct {
+	RateLimitEnabled bool
+	RateLimitTiers   map[string]RateLimitTier
+}
 
-	RedisURL string
+type PollerConfig struct {
+	Config
+	ESIConfig
 
 	ZkillboardQueueID string
+	MetricsPort       int
+
+	// The poller reports itself unhealthy when a stage has not succeeded for this long, 0 disables
+	// the check of a stage. ESI fetches and stream adds are measured from the first killmail received
+	// from RedisQ after their last success, so quiet periods without killmails are not held against them.
+	HealthRedisQMaxAge    time.Duration
+	HealthESIMaxAge       time.Duration
+	HealthStreamAddMaxAge time.Duration
+}
+
+type StreamAPIConfig struct {
+	Config
+	ESIConfig
+	ArchiveConfig
+	RateLimitConfig
+
+	Port int
+
+	WebsocketCompression bool
+	PollCompression      bool
+
+	// AuthEnabled requires API keys on the stream endpoints, the admin API always requires one
+	AuthEnabled bool
+
+	// SSO logins are enabled when a client ID is set
+	SSOClientID     string
+	SSOClientSecret string
+	SSOCallbackURL  string
+	SSOIssuer       string
+	SSOSessionTTL   time.Duration
+
+	// QueueOwnership binds a queue to the first client using it
+	QueueOwnership bool
+	// QueueSessionPolicy decides what happens to concurrent sessions on one queue
+	QueueSessionPolicy string
+
+	// Clients are warned when their queue falls this far behind the head of the stream
+	LagWarningThreshold time.Duration
+	LagWarningEntries   int64
+
+	// TrustProxyHeaders takes the client IP from X-Forwarded-For, only enable it behind a proxy
+	TrustProxyHeaders bool
+
+	// ReadyWithoutStream reports a fresh deployment ready before the poller added the first killmail
+	ReadyWithoutStream bool
+}
+
+// APIKeyConfig manages the API keys of streamapi, keys are checked against its rate limit tiers
+type APIKeyConfig struct {
+	Config
+	RateLimitConfig
+}
+
+type ArchiverConfig struct {
+	Config
+	ArchiveConfig
+}
+
+type BackfillConfig struct {
+	Config
+	ESIConfig
+}
+
+type RouterConfig struct {
+	Config
+	ESIConfig
 }
 
 const (
 	EnvironmentProduction = "production"
 )
 
-func NewConfig() (Config, error) {
-	config := Config{
-		Environment:           os.Getenv("ENVIRONMENT"),
-		Port:                  8081,
-		EsiContactInformation: os.Getenv("ESI_CONTACT_INFORMATION"),
-		RedisURL:              os.Getenv("REDIS_URL"),
-		ZkillboardQueueID:     os.Getenv("ZKILLBOARD_QUEUE_ID"),
+// Compressions of archive files
+const (
+	ArchiveCompressionGzip = "gzip"
+	ArchiveCompressionZstd = "zstd"
+)
+
+// Policies for a second session on a queue that is already being read
+const (
+	// QueueSessionReject refuses the new session
+	QueueSessionReject = "reject"
+	// QueueSessionTakeover closes the old sessions in favour of the new one
+	QueueSessionTakeover = "takeover"
+	// QueueSessionFanout delivers every killmail to all sessions
+	QueueSessionFanout = "fanout"
+)
+
+const (
+	RateLimitTierAnonymous = "anonymous"
+	RateLimitTierDefault   = "default"
+)
+
+// RateLimitTier limits the requests per window and the concurrent websockets and long polls of a client
+type RateLimitTier struct {
+	Requests    int64
+	Window      time.Duration
+	Connections int64
+}
+
+func (c *Config) settings(s *settingSet) {
+	s.StringVar(&c.Environment, "environment", "ENVIRONMENT", "", "deployment environment, e.g. production")
+	c.Log.settings(s)
+	c.Redis.settings(s)
+	s.StringVar(&c.Stream.Name, "stream.name", "STREAM_NAME", StreamKillmails, "name of the live killmail stream")
+	s.Int64Var(&c.Stream.MaxLength, "stream.max_length", "STREAM_MAX_LENGTH", StreamMaxLength, "trim the stream to roughly this many entries, 0 disables length based trimming")
+	s.DurationVar(&c.Stream.MaxAge, "stream.max_age", "STREAM_MAX_AGE", 0, "trim entries older than this, 0 disables age based trimming")
+	s.Int64Var(&c.Stream.DerivedMaxLength, "stream.derived_max_length", "DERIVED_STREAM_MAX_LENGTH", DerivedStreamMaxLength, "trim each per-entity stream to roughly this many entries")
+	s.BoolVar(&c.Stream.MsgpackPayload, "stream.msgpack_payload", "STREAM_MSGPACK_PAYLOAD", false, "store a MessagePack payload next to the JSON payload of every entry")
+	s.StringVar(&c.BackfillStream.Name, "stream.backfill_name", "BACKFILL_STREAM", "", "name of the backfill stream, defaults to the live stream name with a :backfill suffix")
+	s.Int64Var(&c.BackfillStream.MaxLength, "stream.backfill_max_length", "BACKFILL_STREAM_MAX_LENGTH", BackfillStreamMaxLength, "trim the backfill stream to roughly this many entries, 0 disables length based trimming")
+	s.DurationVar(&c.BackfillStream.MaxAge, "stream.backfill_max_age", "BACKFILL_STREAM_MAX_AGE", 0, "trim backfill entries older than this, 0 disables age based trimming")
+	s.StringVar(&c.OTLPEndpoint, "tracing.otlp_endpoint", "OTLP_ENDPOINT", "", "export traces to this OTLP/HTTP endpoint, tracing is disabled without one")
+	s.Float64Var(&c.TracingSampleRatio, "tracing.sample_ratio", "TRACING_SAMPLE_RATIO", 1, "ratio of new traces that are sampled, between 0 and 1")
+}
+
+func (c *Config) validate() error {
+	if err := c.Log.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Redis.validate(); err != nil {
+		return err
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return errors.New("tracing sample ratio must be between 0 and 1")
+	}
+
+	if err := c.Stream.Validate(); err != nil {
+		return err
+	}
+
+	// The backfill stream shares everything but its name and retention with the live stream
+	backfill := c.Stream
+	backfill.Name = c.BackfillStream.Name
+	backfill.MaxLength = c.BackfillStream.MaxLength
+	backfill.MaxAge = c.BackfillStream.MaxAge
+
+	if backfill.Name == "" {
+		backfill.Name = c.Stream.Name + ":backfill"
+	}
+
+	c.BackfillStream = backfill
+
+	if c.BackfillStream.Name == c.Stream.Name {
+		return errors.New("backfill stream must not be the live killmail stream")
+	}
+
+	if err := c.BackfillStream.Validate(); err != nil {
+		return fmt.Errorf("invalid backfill stream: %w", err)
+	}
+
+	return nil
+}
+
+func (c *ESIConfig) settings(s *settingSet) {
+	s.StringVar(&c.EsiContactInformation, "esi.contact_information", "ESI_CONTACT_INFORMATION", "", "contact information sent to ESI in the user agent, e.g. an email address")
+}
+
+func (c *ESIConfig) validate() error {
+	if c.EsiContactInformation == "" {
+		return errors.New("missing ESI contact information")
+	}
+
+	return nil
+}
+
+func (c *ArchiveConfig) settings(s *settingSet) {
+	s.StringVar(&c.ArchiveURL, "archive.url", "ARCHIVE_URL", "", "location of the killmail archive, a file:// or s3:// URL")
+	s.StringVar(&c.ArchiveCompression, "archive.compression", "ARCHIVE_COMPRESSION", ArchiveCompressionGzip, "compression of new archive files, gzip or zstd")
+	s.StringVar(&c.ArchiveS3Endpoint, "archive.s3_endpoint", "ARCHIVE_S3_ENDPOINT", "", "endpoint of an S3 compatible store, defaults to AWS")
+	s.StringVar(&c.ArchiveS3Region, "archive.s3_region", "ARCHIVE_S3_REGION", "", "region of the S3 bucket")
+	s.SecretVar(&c.ArchiveS3AccessKey, "archive.s3_access_key", "ARCHIVE_S3_ACCESS_KEY", "access key of the S3 bucket")
+	s.SecretVar(&c.ArchiveS3SecretKey, "archive.s3_secret_key", "ARCHIVE_S3_SECRET_KEY", "secret key of the S3 bucket")
+}
+
+func (c *RateLimitConfig) settings(s *settingSet) {
+	c.RateLimitTiers = map[string]RateLimitTier{
+		RateLimitTierAnonymous: {Requests: 60, Window: time.Minute, Connections: 2},
+		RateLimitTierDefault:   {Requests: 600, Window: time.Minute, Connections: 10},
+	}
+
+	s.BoolVar(&c.RateLimitEnabled, "rate_limit.enabled", "RATE_LIMIT_ENABLED", true, "limit the requests and connections of every client")
+	s.Var(rateLimitTiersValue(c.RateLimitTiers), "rate_limit.tiers", "RATE_LIMIT_TIERS", "tiers as name=requests/window/connections separated by commas, unlisted tiers keep their defaults")
+}
+
+func (c *PollerConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.ESIConfig.settings(s)
+
+	s.StringVar(&c.ZkillboardQueueID, "zkillboard.queue_id", "ZKILLBOARD_QUEUE_ID", "", "RedisQ queue ID, unique per poller")
+	s.IntVar(&c.MetricsPort, "metrics_port", "METRICS_PORT", 9091, "port of the metrics and health endpoints")
+	s.DurationVar(&c.HealthRedisQMaxAge, "health.redisq_max_age", "HEALTH_REDISQ_MAX_AGE", 2*time.Minute, "report unhealthy when RedisQ was not polled successfully for this long, 0 disables the check")
+	s.DurationVar(&c.HealthESIMaxAge, "health.esi_max_age", "HEALTH_ESI_MAX_AGE", time.Hour, "report unhealthy when a killmail received from RedisQ was not followed by an ESI fetch for this long, 0 disables the check")
+	s.DurationVar(&c.HealthStreamAddMaxAge, "health.stream_add_max_age", "HEALTH_STREAM_ADD_MAX_AGE", time.Hour, "report unhealthy when a killmail received from RedisQ was not followed by a stream add for this long, 0 disables the check")
+}
+
+func (c *PollerConfig) validate() error {
+	if err := c.Config.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ESIConfig.validate(); err != nil {
+		return err
+	}
+
+	if c.ZkillboardQueueID == "" {
+		return errors.New("missing zkillboard queue ID")
+	}
+
+	if err := validatePort("metrics port", c.MetricsPort); err != nil {
+		return err
+	}
+
+	for name, maxAge := range map[string]time.Duration{"health RedisQ max age": c.HealthRedisQMaxAge, "health ESI max age": c.HealthESIMaxAge, "health stream add max age": c.HealthStreamAddMaxAge} {
+		if maxAge < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+func (c *PollerConfig) reloadable() []string {
+	return []string{"log.level", "stream.max_length", "stream.max_age", "health.redisq_max_age", "health.esi_max_age", "health.stream_add_max_age"}
+}
+
+func (c *StreamAPIConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.ESIConfig.settings(s)
+	c.ArchiveConfig.settings(s)
+	c.RateLimitConfig.settings(s)
+
+	s.IntVar(&c.Port, "port", "PORT", 8081, "port of the HTTP server")
+	s.BoolVar(&c.WebsocketCompression, "websocket_compression", "WEBSOCKET_COMPRESSION", true, "negotiate permessage-deflate with websocket clients that offer it")
+	s.BoolVar(&c.PollCompression, "poll_compression", "POLL_COMPRESSION", true, "compress poll responses for clients that accept it")
+	s.BoolVar(&c.AuthEnabled, "auth_enabled", "AUTH_ENABLED", true, "require API keys on the stream endpoints, the admin API always requires one")
+	s.StringVar(&c.SSOClientID, "sso.client_id", "SSO_CLIENT_ID", "", "EVE SSO client ID, SSO logins are enabled when it is set")
+	s.SecretVar(&c.SSOClientSecret, "sso.client_secret", "SSO_CLIENT_SECRET", "EVE SSO client secret")
+	s.StringVar(&c.SSOCallbackURL, "sso.callback_url", "SSO_CALLBACK_URL", "", "callback URL registered with EVE SSO")
+	s.StringVar(&c.SSOIssuer, "sso.issuer", "SSO_ISSUER", "", "issuer of EVE SSO tokens, defaults to the Tranquility login server")
+	s.DurationVar(&c.SSOSessionTTL, "sso.session_ttl", "SSO_SESSION_TTL", 24*time.Hour, "lifetime of SSO sessions")
+	s.BoolVar(&c.QueueOwnership, "queue.ownership", "QUEUE_OWNERSHIP", true, "bind a queue to the first client using it")
+	s.StringVar(&c.QueueSessionPolicy, "queue.session_policy", "QUEUE_SESSION_POLICY", QueueSessionTakeover, "what happens to a second session on a queue: reject, takeover or fanout")
+	s.DurationVar(&c.LagWarningThreshold, "lag.warning_threshold", "LAG_WARNING_THRESHOLD", time.Minute, "warn clients whose queue is this far behind the stream, 0 disables the warning")
+	s.Int64Var(&c.LagWarningEntries, "lag.warning_entries", "LAG_WARNING_ENTRIES", 1000, "warn clients whose queue is this many entries behind the stream, 0 disables the warning")
+	s.BoolVar(&c.TrustProxyHeaders, "trust_proxy_headers", "TRUST_PROXY_HEADERS", false, "take the client IP from X-Forwarded-For, only enable it behind a proxy")
+	s.BoolVar(&c.ReadyWithoutStream, "health.ready_without_stream", "HEALTH_READY_WITHOUT_STREAM", false, "report ready while the killmail stream does not exist yet, e.g. for a fresh deployment")
+}
+
+func (c *StreamAPIConfig) validate() error {
+	if err := c.Config.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ESIConfig.validate(); err != nil {
+		return err
+	}
+
+	if err := validatePort("port", c.Port); err != nil {
+		return err
+	}
+
+	if c.SSOClientID != "" && (c.SSOClientSecret == "" || c.SSOCallbackURL == "") {
+		return errors.New("SSO requires a client secret and callback URL")
+	}
+
+	if c.SSOSessionTTL <= 0 {
+		return errors.New("SSO session TTL must be positive")
+	}
+
+	if c.QueueSessionPolicy != QueueSessionReject && c.QueueSessionPolicy != QueueSessionTakeover && c.QueueSessionPolicy != QueueSessionFanout {
+		return fmt.Errorf("invalid queue session policy %q", c.QueueSessionPolicy)
+	}
+
+	if c.LagWarningThreshold < 0 {
+		return errors.New("lag warning threshold must not be negative")
+	}
+
+	if c.LagWarningEntries < 0 {
+		return errors.New("lag warning entries must not be negative")
+	}
+
+	return nil
+}
+
+func (c *StreamAPIConfig) reloadable() []string {
+	return []string{"log.level", "rate_limit.enabled", "rate_limit.tiers", "queue.ownership", "queue.session_policy", "lag.warning_threshold", "lag.warning_entries"}
+}
+
+func (c *APIKeyConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.RateLimitConfig.settings(s)
+}
+
+func (c *APIKeyConfig) validate() error {
+	return c.Config.validate()
+}
+
+func (c *ArchiverConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.ArchiveConfig.settings(s)
+}
+
+func (c *ArchiverConfig) validate() error {
+	if err := c.Config.validate(); err != nil {
+		return err
+	}
+
+	if c.ArchiveURL == "" {
+		return errors.New("missing archive url")
+	}
+
+	if c.ArchiveCompression != ArchiveCompressionGzip && c.ArchiveCompression != ArchiveCompressionZstd {
+		return fmt.Errorf("unknown archive compression %q", c.ArchiveCompression)
+	}
+
+	return nil
+}
+
+func (c *BackfillConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.ESIConfig.settings(s)
+}
+
+func (c *BackfillConfig) validate() error {
+	if err := c.Config.validate(); err != nil {
+		return err
+	}
+
+	return c.ESIConfig.validate()
+}
+
+func (c *RouterConfig) settings(s *settingSet) {
+	c.Config.settings(s)
+	c.ESIConfig.settings(s)
+}
+
+func (c *RouterConfig) validate() error {
+	if err := c.Config.validate(); err != nil {
+		return err
 	}
 
-	if config.RedisURL == "" {
-		return config, errors.New("missing redis url")
+	return c.ESIConfig.validate()
+}
+
+func validatePort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s must be between 1 and 65535", name)
 	}
 
-	if config.EsiContactInformation == "" {
-		return config, errors.New("missing ESI contact information")
+	return nil
+}
+
+// rateLimitTiersValue parses RATE_LIMIT_TIERS into the tiers it points to
+type rateLimitTiersValue map[string]RateLimitTier
+
+func (v rateLimitTiersValue) Set(value string) error {
+	return parseRateLimitTiers(value, v)
+}
+
+func (v rateLimitTiersValue) String() string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
 	}
 
-	if config.ZkillboardQueueID == "" {
-		return config, errors.New("missing zkillboard queue ID")
+	sort.Strings(names)
+
+	tiers := make([]string, len(names))
+	for i, name := range names {
+		tiers[i] = fmt.Sprintf("%s=%d/%s/%d", name, v[name].Requests, v[name].Window, v[name].Connections)
+	}
+
+	return strings.Join(tiers, ",")
+}
+
+// parseRateLimitTiers reads tiers in the form name=requests/window/connections, separated by
+// commas, into tiers. Tiers that are not listed keep their defaults.
+func parseRateLimitTiers(value string, tiers map[string]RateLimitTier) error {
+	for _, entry := range strings.Split(value, ",") {
+		name, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			return fmt.Errorf("tier %q must have the form name=requests/window/connections", entry)
+		}
+
+		parts := strings.Split(limits, "/")
+		if len(parts) != 3 {
+			return fmt.Errorf("tier %q must have the form name=requests/window/connections", entry)
+		}
+
+		var tier RateLimitTier
+		var err error
+
+		if tier.Requests, err = strconv.ParseInt(parts[0], 10, 64); err != nil || tier.Requests <= 0 {
+			return fmt.Errorf("requests of tier %s must be a positive integer", name)
+		}
+
+		if tier.Window, err = time.ParseDuration(parts[1]); err != nil || tier.Window < time.Second {
+			return fmt.Errorf("window of tier %s must be a duration of at least 1s", name)
+		}
+
+		if tier.Connections, err = strconv.ParseInt(parts[2], 10, 64); err != nil || tier.Connections <= 0 {
+			return fmt.Errorf("connections of tier %s must be a positive integer", name)
+		}
+
+		tiers[name] = tier
 	}
 
-	return config, nil
+	return nil
 }
@@ -0,0 +1,35 @@
+package killfeed
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestBackfillStreamRetention(t *testing.T) {
+	t.Setenv("REDIS_URL", "redis://redis:6379/0")
+
+	var config BackfillConfig
+	if _, _, err := load(&config, flag.NewFlagSet("test", flag.ContinueOnError), []string{"-esi-contact-information", "test@example.com", "-stream-max-length", "100", "-stream-derived-max-length", "10"}); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	backfill := config.BackfillStream
+	if backfill.Name != "killmails:backfill" || backfill.DerivedMaxLength != 10 {
+		t.Fatalf("backfill stream does not share the live stream settings: %+v", backfill)
+	}
+
+	// The live stream retention would trim backfilled history right away
+	if backfill.MaxLength != BackfillStreamMaxLength || backfill.MaxAge != 0 {
+		t.Fatalf("backfill stream uses the live stream retention: %+v", backfill)
+	}
+
+	config = BackfillConfig{}
+	if _, _, err := load(&config, flag.NewFlagSet("test", flag.ContinueOnError), []string{"-esi-contact-information", "test@example.com", "-stream-backfill-max-length", "0", "-stream-backfill-max-age", "720h"}); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if config.BackfillStream.MaxLength != 0 || config.BackfillStream.MaxAge != 720*time.Hour {
+		t.Fatalf("backfill retention not applied: %+v", config.BackfillStream)
+	}
+}
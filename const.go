@@ -1,6 +1,17 @@
 package killfeed
 
+import "time"
+
+// Defaults of the killmail stream, see StreamConfig
 const (
 	StreamKillmails = "killmails"
 	StreamMaxLength = 65_536
+
+	DerivedStreamMaxLength = 1024
+
+	// BackfillStreamMaxLength keeps years of history, backfills replay far more than the live stream holds
+	BackfillStreamMaxLength = 4_194_304
 )
+
+// KillmailStreamIDTTL outlives the time it takes to trim an entry from the stream with the default retention
+const KillmailStreamIDTTL = 7 * 24 * time.Hour
@@ -0,0 +1,45 @@
+package killfeed
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Payload formats clients can choose from. JSON is the default.
+const (
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+)
+
+func IsFormat(format string) bool {
+	return format == FormatJSON || format == FormatMsgpack
+}
+
+// EncodeMsgpack encodes a killmail as MessagePack. The schema mirrors the JSON encoding: every
+// object is a map keyed by the same field names, integers use the smallest fitting type and
+// killmail_time is a MessagePack timestamp.
+func EncodeMsgpack(killmail CombinedKillmail) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	encoder.SetOmitEmpty(true)
+	encoder.UseCompactInts(true)
+
+	if err := encoder.Encode(killmail); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// EncodeMsgpackArray wraps already encoded MessagePack values into an array
+func EncodeMsgpackArray(payloads [][]byte) ([]byte, error) {
+	raw := make([]msgpack.RawMessage, len(payloads))
+	for i, payload := range payloads {
+		raw[i] = payload
+	}
+
+	return msgpack.Marshal(raw)
+}
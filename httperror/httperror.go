@@ -3,8 +3,12 @@ package httperror
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 )
 
@@ -12,9 +16,19 @@ type HTTPError struct {
 	error
 	Code    int    `json:"code"`
 	Message string `json:"error"`
+	// RequestID lets clients refer to the failed request, it is filled in when the error is rendered
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is sent as the Retry-After header when set
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (e *HTTPError) Render(w http.ResponseWriter, r *http.Request) error {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+
+	e.RequestID = middleware.GetReqID(r.Context())
+
 	render.Status(r, e.Code)
 	return nil
 }
@@ -31,6 +45,10 @@ func InternalServerError(message string, err error) *HTTPError {
 	return New(http.StatusInternalServerError, "internal server error", fmt.Errorf("%s: %w", message, err))
 }
 
+func Unauthorized(message string) *HTTPError {
+	return New(http.StatusUnauthorized, message, errors.New(message))
+}
+
 func Forbidden(message string) *HTTPError {
 	return New(http.StatusForbidden, message, errors.New(message))
 }
@@ -39,10 +57,24 @@ func NotFound(message string) *HTTPError {
 	return New(http.StatusNotFound, message, errors.New(message))
 }
 
+func Conflict(message string) *HTTPError {
+	return New(http.StatusConflict, message, errors.New(message))
+}
+
 func BadRequest(message string) *HTTPError {
 	return New(http.StatusBadRequest, message, errors.New(message))
 }
 
+func TooManyRequests(message string, retryAfter time.Duration) *HTTPError {
+	err := New(http.StatusTooManyRequests, message, errors.New(message))
+	err.RetryAfter = retryAfter
+	return err
+}
+
 func BadRequestWithError(message string, err error) *HTTPError {
 	return New(http.StatusBadRequest, message, fmt.Errorf("%s: %w", message, err))
 }
+
+func ServiceUnavailable(message string, err error) *HTTPError {
+	return New(http.StatusServiceUnavailable, message, fmt.Errorf("%s: %w", message, err))
+}
@@ -0,0 +1,92 @@
+package ingest
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// esiErrorLimitThreshold leaves some headroom before ESI starts rejecting requests with 420
+	esiErrorLimitThreshold = 10
+	esiMaxAttempts         = 5
+)
+
+// ESILimiter keeps ESI calls within the error limit and honours rate limit responses. ESI
+// tracks the limits per IP, so a single limiter should be shared by all callers of a process.
+type ESILimiter struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func NewESILimiter() *ESILimiter {
+	return &ESILimiter{}
+}
+
+// Wait blocks while ESI calls are paused
+func (l *ESILimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	delay := time.Until(l.pausedUntil)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Observe updates the limiter from an ESI response and reports whether the request should be retried
+func (l *ESILimiter) Observe(res *http.Response) bool {
+	if res == nil {
+		return false
+	}
+
+	remain, remainErr := strconv.Atoi(res.Header.Get("X-Esi-Error-Limit-Remain"))
+	reset := headerSeconds(res, "X-Esi-Error-Limit-Reset", 60*time.Second)
+
+	switch {
+	case res.StatusCode == 420:
+		l.pause(reset)
+		return true
+
+	case res.StatusCode == http.StatusTooManyRequests:
+		l.pause(headerSeconds(res, "Retry-After", 10*time.Second))
+		return true
+
+	case res.StatusCode == http.StatusBadGateway, res.StatusCode == http.StatusServiceUnavailable, res.StatusCode == http.StatusGatewayTimeout:
+		l.pause(1 * time.Second)
+		return true
+	}
+
+	if remainErr == nil && remain <= esiErrorLimitThreshold {
+		l.pause(reset)
+	}
+
+	return false
+}
+
+func (l *ESILimiter) pause(delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(delay); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func headerSeconds(res *http.Response, name string, fallback time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(res.Header.Get(name))
+	if err != nil || seconds < 0 {
+		return fallback
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,46 @@
+package ingest
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	esiRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "killfeed_esi_request_duration_seconds",
+		Help:    "Duration of killmail requests to ESI",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	esiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "killfeed_esi_requests_total",
+		Help: "Killmail requests to ESI by status class, error when no response was received",
+	}, []string{"status"})
+
+	esiRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_esi_retries_total",
+		Help: "Killmail requests to ESI retried after rate limiting or server errors",
+	})
+
+	streamAddFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_stream_add_failures_total",
+		Help: "Killmails that failed to be added to the stream",
+	})
+
+	killmailsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "killfeed_killmails_published_total",
+		Help: "Killmails added to the stream",
+	})
+)
+
+// statusClass keeps the status label low-cardinality
+func statusClass(res *http.Response) string {
+	if res == nil {
+		return "error"
+	}
+
+	return strconv.Itoa(res.StatusCode/100) + "xx"
+}
@@ -0,0 +1,159 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"killfeed"
+	"killfeed/classify"
+	"killfeed/tracing"
+	"sync/atomic"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Publisher fetches killmails from ESI, classifies them and adds them to a stream
+type Publisher struct {
+	rdb       redis.UniversalClient
+	esiClient *goesi.APIClient
+	resolver  classify.Resolver
+	limiter   *ESILimiter
+	// stream is replaced when its retention is reloaded
+	stream atomic.Pointer[killfeed.StreamConfig]
+
+	// Unix nanoseconds of the last successful ESI fetch and stream add, for health checks
+	lastFetch atomic.Int64
+	lastAdd   atomic.Int64
+}
+
+func NewPublisher(rdb redis.UniversalClient, esiClient *goesi.APIClient, resolver classify.Resolver, limiter *ESILimiter, stream killfeed.StreamConfig) *Publisher {
+	p := &Publisher{
+		rdb:       rdb,
+		esiClient: esiClient,
+		resolver:  resolver,
+		limiter:   limiter,
+	}
+	p.stream.Store(&stream)
+
+	return p
+}
+
+// SetRetention changes how the stream is trimmed, killmails being processed keep the previous
+// retention. The stream itself and its format stay as they were.
+func (p *Publisher) SetRetention(maxLength int64, maxAge time.Duration) {
+	stream := *p.stream.Load()
+	stream.MaxLength = maxLength
+	stream.MaxAge = maxAge
+
+	p.stream.Store(&stream)
+}
+
+// LastFetch returns when a killmail was last fetched from ESI, or the zero time if none was
+func (p *Publisher) LastFetch() time.Time {
+	return unixNanoTime(p.lastFetch.Load())
+}
+
+// LastAdd returns when a killmail was last added to the stream, or the zero time if none was
+func (p *Publisher) LastAdd() time.Time {
+	return unixNanoTime(p.lastAdd.Load())
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// FetchKillmail fetches a killmail from ESI, waiting out and retrying rate limited requests
+func (p *Publisher) FetchKillmail(ctx context.Context, killmailID int32, hash string) (killmail killfeed.Killmail, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "esi.fetch_killmail", trace.WithAttributes(attribute.Int("killmail.id", int(killmailID))))
+	defer func() { tracing.End(span, err) }()
+
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("esi.attempts", attempt))
+
+		if err := p.limiter.Wait(ctx); err != nil {
+			return killfeed.Killmail{}, err
+		}
+
+		start := time.Now()
+		killmail, res, err := p.esiClient.ESI.KillmailsApi.GetKillmailsKillmailIdKillmailHash(ctx, hash, killmailID, nil)
+		esiRequestDuration.Observe(time.Since(start).Seconds())
+		esiRequests.WithLabelValues(statusClass(res)).Inc()
+
+		if res != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+		}
+
+		if p.limiter.Observe(res) && attempt < esiMaxAttempts {
+			esiRetries.Inc()
+			continue
+		}
+
+		if err != nil {
+			return killfeed.Killmail{}, fmt.Errorf("failed to fetch killmail from ESI: %w", err)
+		}
+
+		p.lastFetch.Store(time.Now().UnixNano())
+
+		return killmail, nil
+	}
+}
+
+// Process fetches, classifies and publishes a single killmail. receivedAt is when the killmail was
+// announced, it is recorded with the entry unless it is zero.
+func (p *Publisher) Process(ctx context.Context, logger zerolog.Logger, killmailID int32, killmailZkb killfeed.KillmailZkb, receivedAt time.Time) error {
+	killmail, err := p.FetchKillmail(ctx, killmailID, killmailZkb.Hash)
+	if err != nil {
+		return err
+	}
+
+	fetchedAt := time.Now()
+	stream := p.stream.Load()
+
+	// Classification is best effort, a failed static data lookup only leaves out the tags that depend on it
+	in, err := classify.Resolve(ctx, p.resolver, killmail)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to resolve static data for classification")
+	}
+
+	values, err := killfeed.EncodeStreamMessage(killfeed.NewCombinedKillmail(killmail, killmailZkb, classify.Classify(in, classify.DefaultRules)), stream.MsgpackPayload)
+	if err != nil {
+		return err
+	}
+
+	killfeed.AddTimings(values, killfeed.Timings{KillmailTime: killmail.KillmailTime, ReceivedAt: receivedAt, FetchedAt: fetchedAt})
+
+	addCtx, span := tracing.Tracer().Start(ctx, "stream.add", trace.WithAttributes(attribute.String("stream", stream.Name)))
+
+	// Consumers continue the trace from the entry
+	tracing.Inject(addCtx, values)
+
+	pipe := p.rdb.Pipeline()
+	addCmd := stream.Add(addCtx, pipe, values)
+	_, err = pipe.Exec(addCtx)
+	tracing.End(span, err)
+
+	if err != nil {
+		streamAddFailures.Inc()
+		return fmt.Errorf("failed to add killmail to queue: %w", err)
+	}
+
+	killmailsPublished.Inc()
+	p.lastAdd.Store(time.Now().UnixNano())
+
+	messageID := addCmd.Val()
+
+	ttl := max(killfeed.KillmailStreamIDTTL, stream.MaxAge)
+	if err := p.rdb.Set(ctx, stream.KillmailIDKey(killmailID), messageID, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store killmail stream ID: %w", err)
+	}
+
+	return nil
+}
@@ -24,6 +24,8 @@ type KillmailZkb struct {
 }
 
 type CombinedKillmail struct {
+	SchemaVersion int `json:"schema_version"`
+
 	// These fields need to be copied here, because extending would not work otherwise because
 	// goesi is using easyjson custom marshalers
 	Attackers     []esi.GetKillmailsKillmailIdKillmailHashAttacker `json:"attackers,omitempty"`       /* attackers array */
@@ -34,5 +36,24 @@ type CombinedKillmail struct {
 	Victim        esi.GetKillmailsKillmailIdKillmailHashVictim     `json:"victim,omitzero"`
 	WarId         int32                                            `json:"war_id,omitempty"` /* War if the killmail is generated in relation to an official war  */
 
-	Zkb KillmailZkb `json:"zkb"`
+	Zkb  KillmailZkb `json:"zkb"`
+	Tags []string    `json:"tags,omitempty"`
+
+	// Timings are only included for clients that ask for them, they are never stored in the payload
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+func NewCombinedKillmail(killmail Killmail, killmailZkb KillmailZkb, tags []string) CombinedKillmail {
+	return CombinedKillmail{
+		SchemaVersion: StreamSchemaVersion,
+		Attackers:     killmail.Attackers,
+		KillmailId:    killmail.KillmailId,
+		KillmailTime:  killmail.KillmailTime,
+		MoonId:        killmail.MoonId,
+		SolarSystemId: killmail.SolarSystemId,
+		Victim:        killmail.Victim,
+		WarId:         killmail.WarId,
+		Zkb:           killmailZkb,
+		Tags:          tags,
+	}
 }
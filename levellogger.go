@@ -1,29 +1,112 @@
 package killfeed
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
+// Log formats
+const (
+	LogFormatJSON = "json"
+	// LogFormatConsole is human readable and meant for development
+	LogFormatConsole = "console"
+)
+
+// LogConfig controls what is logged and how
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+func (c *LogConfig) settings(s *settingSet) {
+	s.StringVar(&c.Level, "log.level", "LOG_LEVEL", zerolog.LevelInfoValue, "minimum level of logged events: trace, debug, info, warn or error")
+	s.StringVar(&c.Format, "log.format", "LOG_FORMAT", LogFormatJSON, "json, or console for human readable logs")
+}
+
+func (c *LogConfig) validate() error {
+	if _, err := c.level(); err != nil {
+		return err
+	}
+
+	if c.Format != LogFormatJSON && c.Format != LogFormatConsole {
+		return fmt.Errorf("invalid log format %q", c.Format)
+	}
+
+	return nil
+}
+
+func (c *LogConfig) level() (zerolog.Level, error) {
+	level, err := zerolog.ParseLevel(c.Level)
+	if err != nil || level == zerolog.NoLevel {
+		return zerolog.NoLevel, fmt.Errorf("invalid log level %q", c.Level)
+	}
+
+	return level, nil
+}
+
+// SetupLogging configures the global logger. Loggers taken from a context without one, like those
+// of requests, fall back to it.
+func SetupLogging(config LogConfig) {
+	log.Logger = log.Output(NewLogOut(config.Format == LogFormatConsole))
+	zerolog.DefaultContextLogger = &log.Logger
+
+	SetLogLevel(config)
+}
+
+// SetLogLevel changes the level of every logger, it is safe to call while logging
+func SetLogLevel(config LogConfig) {
+	if level, err := config.level(); err == nil {
+		zerolog.SetGlobalLevel(level)
+	}
+}
+
 var (
-	debugOut = os.Stdout
-	errorOut = os.Stderr
+	debugOut io.Writer = os.Stdout
+	errorOut io.Writer = os.Stderr
 )
 
-// logOut implements zerolog.LevelWriter
-type LogOut struct{}
+// logOut implements zerolog.LevelWriter. The zero value writes JSON, like commands do until their
+// configuration is loaded.
+type LogOut struct {
+	debug io.Writer
+	error io.Writer
+}
+
+// NewLogOut returns a LogOut that writes JSON, or formats events for humans with console
+func NewLogOut(console bool) LogOut {
+	if !console {
+		return LogOut{debug: debugOut, error: errorOut}
+	}
+
+	return LogOut{
+		debug: zerolog.ConsoleWriter{Out: debugOut, TimeFormat: time.RFC3339},
+		error: zerolog.ConsoleWriter{Out: errorOut, TimeFormat: time.RFC3339},
+	}
+}
 
 // Write should not be called
 func (l LogOut) Write(p []byte) (n int, err error) {
-	return os.Stdout.Write(p)
+	return l.write(l.debug, os.Stdout, p)
 }
 
 // WriteLevel write to the appropriate output
 func (l LogOut) WriteLevel(level zerolog.Level, p []byte) (n int, err error) {
 	if level < zerolog.WarnLevel {
-		return debugOut.Write(p)
+		return l.write(l.debug, debugOut, p)
 	} else {
-		return errorOut.Write(p)
+		return l.write(l.error, errorOut, p)
 	}
 }
+
+func (l LogOut) write(out io.Writer, fallback io.Writer, p []byte) (n int, err error) {
+	if out == nil {
+		return fallback.Write(p)
+	}
+
+	return out.Write(p)
+}
@@ -0,0 +1,39 @@
+package killfeed
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogOut(t *testing.T) {
+	var debug, errors bytes.Buffer
+
+	previousDebug, previousError := debugOut, errorOut
+	debugOut, errorOut = &debug, &errors
+	t.Cleanup(func() { debugOut, errorOut = previousDebug, previousError })
+
+	for _, console := range []bool{false, true} {
+		debug.Reset()
+		errors.Reset()
+
+		logger := zerolog.New(NewLogOut(console))
+		logger.Info().Msg("info event")
+		logger.Warn().Msg("warn event")
+
+		if !strings.Contains(debug.String(), "info event") || strings.Contains(debug.String(), "warn event") {
+			t.Fatalf("console %t: unexpected debug output %q", console, debug.String())
+		}
+
+		if !strings.Contains(errors.String(), "warn event") || strings.Contains(errors.String(), "info event") {
+			t.Fatalf("console %t: unexpected error output %q", console, errors.String())
+		}
+
+		// Console output is formatted for humans instead of JSON
+		if json := strings.HasPrefix(debug.String(), "{"); json == console {
+			t.Fatalf("console %t: unexpected format %q", console, debug.String())
+		}
+	}
+}
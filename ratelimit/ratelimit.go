@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisRequestsPrefix    = "ratelimit:requests:"
+	redisConnectionsPrefix = "ratelimit:connections:"
+)
+
+// LeaseTTL is how long a connection slot is held without a refresh. Holders refresh well within it,
+// so slots of crashed servers free up on their own.
+const LeaseTTL = 90 * time.Second
+
+// ErrSlotLost is returned when a held connection slot expired or was taken by Force and the limit
+// is reached, so the connection holding it has to be closed
+var ErrSlotLost = errors.New("connection slot was lost")
+
+// acquireScript drops expired leases and adds a lease when the subject is below its limit. Leases
+// are members of a sorted set scored by their expiry.
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZSCORE", KEYS[1], ARGV[2]) or redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call("ZADD", KEYS[1], now + tonumber(ARGV[4]), ARGV[2])
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+	return 1
+end
+return 0
+`)
+
+// Limiter counts requests and concurrent connections per subject in Redis, so limits hold across
+// all streamapi instances
+type Limiter struct {
+	rdb redis.Cmdable
+}
+
+func New(rdb redis.Cmdable) *Limiter {
+	return &Limiter{rdb: rdb}
+}
+
+// Allow counts a request of subject in a fixed window and reports whether it is within limit. When
+// it is not, the returned duration is the time until the window resets.
+func (l *Limiter) Allow(ctx context.Context, subject string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	now := time.Now()
+	windowStart := now.Truncate(window)
+	key := redisRequestsPrefix + subject + ":" + strconv.FormatInt(windowStart.Unix(), 10)
+
+	pipe := l.rdb.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, window)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, 0, fmt.Errorf("failed to count request: %w", err)
+	}
+
+	if count.Val() > limit {
+		return false, windowStart.Add(window).Sub(now), nil
+	}
+
+	return true, 0, nil
+}
+
+// Acquire takes one of limit connection slots of subject for the connection id
+func (l *Limiter) Acquire(ctx context.Context, subject string, id string, limit int64) (bool, error) {
+	now := time.Now().UnixMilli()
+
+	acquired, err := acquireScript.Run(ctx, l.rdb, []string{redisConnectionsPrefix + subject}, now, id, limit, LeaseTTL.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire connection slot: %w", err)
+	}
+
+	return acquired == 1, nil
+}
+
+// Refresh extends the lease of a held connection slot, it returns ErrSlotLost when the slot is gone
+// and cannot be taken again
+func (l *Limiter) Refresh(ctx context.Context, subject string, id string, limit int64) error {
+	acquired, err := l.Acquire(ctx, subject, id, limit)
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return ErrSlotLost
+	}
+
+	return nil
+}
+
+// Force takes a slot for id and evicts every other holder, used when a new connection replaces old ones
+func (l *Limiter) Force(ctx context.Context, subject string, id string) error {
+	key := redisConnectionsPrefix + subject
+
+	_, err := l.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(time.Now().Add(LeaseTTL).UnixMilli()), Member: id})
+		pipe.PExpire(ctx, key, LeaseTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to take over connection slot: %w", err)
+	}
+
+	return nil
+}
+
+// Hold keeps refreshing a slot acquired for id until the returned function is called, which
+// releases the slot. Refreshing stops after onError was called with ErrSlotLost.
+func (l *Limiter) Hold(subject string, id string, limit int64, onError func(error)) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(LeaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := l.Refresh(context.Background(), subject, id, limit)
+				if err != nil {
+					onError(err)
+				}
+
+				if errors.Is(err, ErrSlotLost) {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+
+		// The request context is usually canceled by the time a slot is released
+		if err := l.Release(context.Background(), subject, id); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Release frees the connection slot of id
+func (l *Limiter) Release(ctx context.Context, subject string, id string) error {
+	if err := l.rdb.ZRem(ctx, redisConnectionsPrefix+subject, id).Err(); err != nil {
+		return fmt.Errorf("failed to release connection slot: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestLimiter(t *testing.T) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return New(rdb), server
+}
+
+func TestAllow(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := limiter.Allow(ctx, "client", 3, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to count request: %v", err)
+		}
+
+		if !allowed {
+			t.Fatalf("request %d within the limit was rejected", i+1)
+		}
+	}
+
+	allowed, retryAfter, err := limiter.Allow(ctx, "client", 3, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to count request: %v", err)
+	}
+
+	if allowed {
+		t.Fatal("request over the limit was allowed")
+	}
+
+	if retryAfter <= 0 || retryAfter > time.Hour {
+		t.Fatalf("retry after %s is outside the window", retryAfter)
+	}
+
+	// Subjects are counted separately
+	if allowed, _, _ := limiter.Allow(ctx, "other", 3, time.Hour); !allowed {
+		t.Fatal("request of another subject was rejected")
+	}
+}
+
+func TestAcquireLimitsConnections(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		if acquired, err := limiter.Acquire(ctx, "client", id, 2); err != nil || !acquired {
+			t.Fatalf("slot %s not acquired: %v", id, err)
+		}
+	}
+
+	if acquired, err := limiter.Acquire(ctx, "client", "c", 2); err != nil || acquired {
+		t.Fatalf("slot over the limit acquired: %v", err)
+	}
+
+	// Holders refresh their own slot even when the limit is reached
+	if acquired, err := limiter.Acquire(ctx, "client", "a", 2); err != nil || !acquired {
+		t.Fatalf("held slot not refreshed: %v", err)
+	}
+
+	if err := limiter.Release(ctx, "client", "a"); err != nil {
+		t.Fatalf("failed to release slot: %v", err)
+	}
+
+	if acquired, err := limiter.Acquire(ctx, "client", "c", 2); err != nil || !acquired {
+		t.Fatalf("released slot not reused: %v", err)
+	}
+}
+
+func TestAcquireDropsExpiredLeases(t *testing.T) {
+	limiter, server := newTestLimiter(t)
+	ctx := context.Background()
+
+	// A lease that expired without a refresh, like the slot of a crashed server
+	key := redisConnectionsPrefix + "client"
+	if _, err := server.ZAdd(key, float64(time.Now().Add(-time.Second).UnixMilli()), "crashed"); err != nil {
+		t.Fatalf("failed to add lease: %v", err)
+	}
+
+	if acquired, err := limiter.Acquire(ctx, "client", "new", 1); err != nil || !acquired {
+		t.Fatalf("expired lease kept the slot: %v", err)
+	}
+}
+
+func TestForce(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	ctx := context.Background()
+
+	if acquired, err := limiter.Acquire(ctx, "queue", "old", 1); err != nil || !acquired {
+		t.Fatalf("slot not acquired: %v", err)
+	}
+
+	if err := limiter.Force(ctx, "queue", "new"); err != nil {
+		t.Fatalf("failed to force slot: %v", err)
+	}
+
+	// The old holder lost its slot and cannot take it back while the new one holds it
+	if acquired, err := limiter.Acquire(ctx, "queue", "old", 1); err != nil || acquired {
+		t.Fatalf("evicted holder acquired the slot again: %v", err)
+	}
+
+	if acquired, err := limiter.Acquire(ctx, "queue", "new", 1); err != nil || !acquired {
+		t.Fatalf("forced slot not held: %v", err)
+	}
+}
+
+func TestRefreshReportsLostSlot(t *testing.T) {
+	limiter, _ := newTestLimiter(t)
+	ctx := context.Background()
+
+	if acquired, err := limiter.Acquire(ctx, "queue", "old", 1); err != nil || !acquired {
+		t.Fatalf("slot not acquired: %v", err)
+	}
+
+	if err := limiter.Refresh(ctx, "queue", "old", 1); err != nil {
+		t.Fatalf("failed to refresh held slot: %v", err)
+	}
+
+	if err := limiter.Force(ctx, "queue", "new"); err != nil {
+		t.Fatalf("failed to force slot: %v", err)
+	}
+
+	if err := limiter.Refresh(ctx, "queue", "old", 1); !errors.Is(err, ErrSlotLost) {
+		t.Fatalf("expected ErrSlotLost after a takeover, got %v", err)
+	}
+
+	// A lost slot is taken again while the limit allows it
+	if err := limiter.Release(ctx, "queue", "new"); err != nil {
+		t.Fatalf("failed to release slot: %v", err)
+	}
+
+	if err := limiter.Refresh(ctx, "queue", "old", 1); err != nil {
+		t.Fatalf("failed to take free slot again: %v", err)
+	}
+}
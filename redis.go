@@ -0,0 +1,314 @@
+package killfeed
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis deployment modes
+const (
+	RedisModeStandalone = "standalone"
+	// RedisModeSentinel finds the master through Sentinel and follows failovers
+	RedisModeSentinel = "sentinel"
+	// RedisModeCluster shards keys across a Redis Cluster, keys used together in a transaction or
+	// script share a hash tag
+	RedisModeCluster = "cluster"
+)
+
+// RedisConfig describes how to connect to Redis. The URL carries the credentials, database and TLS
+// of the data nodes, go-redis options can be given as query parameters, e.g. ?max_retries=5.
+type RedisConfig struct {
+	// URL is a redis:// or rediss:// URL, a bare host:port is accepted for older deployments
+	URL  string
+	Mode string
+	// Addrs are nodes in addition to the host of the URL, Sentinels in sentinel mode and seed nodes
+	// in cluster mode
+	Addrs string
+
+	SentinelMaster   string
+	SentinelPassword string
+
+	// Zero keeps the go-redis default or the value given in the URL
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+
+	// TLS is enabled by rediss:// URLs, these verify the servers with a private CA and authenticate
+	// the client with a certificate
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+func (c *RedisConfig) settings(s *settingSet) {
+	s.URLVar(&c.URL, "redis.url", "REDIS_URL", "", "redis:// or rediss:// URL of Redis, e.g. redis://:password@redis:6379/0")
+	s.StringVar(&c.Mode, "redis.mode", "REDIS_MODE", RedisModeStandalone, "standalone, sentinel or cluster")
+	s.StringVar(&c.Addrs, "redis.addrs", "REDIS_ADDRS", "", "further Sentinel or cluster seed addresses as host:port separated by commas")
+	s.StringVar(&c.SentinelMaster, "redis.sentinel_master", "REDIS_SENTINEL_MASTER", "", "name of the master monitored by Sentinel")
+	s.SecretVar(&c.SentinelPassword, "redis.sentinel_password", "REDIS_SENTINEL_PASSWORD", "password of the Sentinels, if they require one")
+	s.IntVar(&c.PoolSize, "redis.pool_size", "REDIS_POOL_SIZE", 0, "connections per node, every open websocket and long poll holds one while it waits; 0 uses the go-redis default")
+	s.IntVar(&c.MinIdleConns, "redis.min_idle_conns", "REDIS_MIN_IDLE_CONNS", 0, "idle connections kept open per node")
+	s.DurationVar(&c.DialTimeout, "redis.dial_timeout", "REDIS_DIAL_TIMEOUT", 0, "timeout of new connections, 0 uses the go-redis default")
+	s.DurationVar(&c.ReadTimeout, "redis.read_timeout", "REDIS_READ_TIMEOUT", 0, "timeout of reads, blocking reads wait this much longer than their block time; 0 uses the go-redis default")
+	s.DurationVar(&c.WriteTimeout, "redis.write_timeout", "REDIS_WRITE_TIMEOUT", 0, "timeout of writes, 0 uses the go-redis default")
+	s.DurationVar(&c.PoolTimeout, "redis.pool_timeout", "REDIS_POOL_TIMEOUT", 0, "how long to wait for a free connection, 0 uses the go-redis default")
+	s.StringVar(&c.TLSCAFile, "redis.tls_ca_file", "REDIS_TLS_CA_FILE", "", "PEM file of the CA that signed the Redis certificates, defaults to the system roots")
+	s.StringVar(&c.TLSCertFile, "redis.tls_cert_file", "REDIS_TLS_CERT_FILE", "", "PEM file of the client certificate")
+	s.StringVar(&c.TLSKeyFile, "redis.tls_key_file", "REDIS_TLS_KEY_FILE", "", "PEM file of the client certificate key")
+}
+
+func (c *RedisConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("missing redis url")
+	}
+
+	options, err := c.options()
+	if err != nil {
+		return err
+	}
+
+	switch c.Mode {
+	case RedisModeStandalone:
+		if c.Addrs != "" || c.SentinelMaster != "" {
+			return errors.New("redis addrs and sentinel master are only used in sentinel and cluster mode")
+		}
+
+	case RedisModeSentinel:
+		if c.SentinelMaster == "" {
+			return errors.New("redis sentinel mode requires the name of the master")
+		}
+
+	case RedisModeCluster:
+		if options.DB != 0 {
+			return errors.New("redis cluster only has database 0")
+		}
+
+	default:
+		return fmt.Errorf("invalid redis mode %q", c.Mode)
+	}
+
+	if c.PoolSize < 0 || c.MinIdleConns < 0 {
+		return errors.New("redis pool sizes must not be negative")
+	}
+
+	for name, timeout := range map[string]time.Duration{"dial": c.DialTimeout, "read": c.ReadTimeout, "write": c.WriteTimeout, "pool": c.PoolTimeout} {
+		if timeout < 0 {
+			return fmt.Errorf("redis %s timeout must not be negative", name)
+		}
+	}
+
+	if (c.TLSCAFile != "" || c.TLSCertFile != "") && options.TLSConfig == nil {
+		return errors.New("redis TLS files require a rediss:// URL")
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("redis TLS client certificate requires both a cert and a key file")
+	}
+
+	return nil
+}
+
+// options parses the URL into the options of a single node with the settings applied
+func (c *RedisConfig) options() (*redis.Options, error) {
+	var options *redis.Options
+
+	if strings.Contains(c.URL, "://") {
+		var err error
+		if options, err = redis.ParseURL(c.URL); err != nil {
+			return nil, fmt.Errorf("invalid redis url: %w", err)
+		}
+	} else {
+		options = &redis.Options{Addr: c.URL}
+	}
+
+	if c.PoolSize > 0 {
+		options.PoolSize = c.PoolSize
+	}
+
+	if c.MinIdleConns > 0 {
+		options.MinIdleConns = c.MinIdleConns
+	}
+
+	if c.DialTimeout > 0 {
+		options.DialTimeout = c.DialTimeout
+	}
+
+	if c.ReadTimeout > 0 {
+		options.ReadTimeout = c.ReadTimeout
+	}
+
+	if c.WriteTimeout > 0 {
+		options.WriteTimeout = c.WriteTimeout
+	}
+
+	if c.PoolTimeout > 0 {
+		options.PoolTimeout = c.PoolTimeout
+	}
+
+	return options, nil
+}
+
+// addrs returns the address of the URL followed by the further addresses
+func (c *RedisConfig) addrs(options *redis.Options) []string {
+	addrs := []string{options.Addr}
+
+	for _, addr := range strings.Split(c.Addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// tlsConfig loads the CA and client certificate into the TLS config parsed from the URL
+func (c *RedisConfig) tlsConfig(config *tls.Config) error {
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read redis CA file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("redis CA file contains no certificates")
+		}
+	}
+
+	if c.TLSCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load redis client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	// Sentinels and cluster nodes have their own host names, which are verified per connection
+	if c.Mode != RedisModeStandalone {
+		config.ServerName = ""
+	}
+
+	return nil
+}
+
+// NewRedisClient connects to Redis as configured and checks the connection. Sentinel and cluster
+// clients share the interface of a single node client.
+func NewRedisClient(ctx context.Context, config RedisConfig) (redis.UniversalClient, error) {
+	options, err := config.options()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.TLSConfig != nil {
+		if err := config.tlsConfig(options.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	var rdb redis.UniversalClient
+
+	switch config.Mode {
+	case RedisModeSentinel:
+		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.SentinelMaster,
+			SentinelAddrs:    config.addrs(options),
+			SentinelPassword: config.SentinelPassword,
+			ClientName:       options.ClientName,
+			Protocol:         options.Protocol,
+			Username:         options.Username,
+			Password:         options.Password,
+			DB:               options.DB,
+			MaxRetries:       options.MaxRetries,
+			DialTimeout:      options.DialTimeout,
+			ReadTimeout:      options.ReadTimeout,
+			WriteTimeout:     options.WriteTimeout,
+			PoolSize:         options.PoolSize,
+			PoolTimeout:      options.PoolTimeout,
+			MinIdleConns:     options.MinIdleConns,
+			MaxIdleConns:     options.MaxIdleConns,
+			ConnMaxIdleTime:  options.ConnMaxIdleTime,
+			ConnMaxLifetime:  options.ConnMaxLifetime,
+			TLSConfig:        options.TLSConfig,
+		})
+
+	case RedisModeCluster:
+		rdb = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           config.addrs(options),
+			ClientName:      options.ClientName,
+			Protocol:        options.Protocol,
+			Username:        options.Username,
+			Password:        options.Password,
+			MaxRetries:      options.MaxRetries,
+			DialTimeout:     options.DialTimeout,
+			ReadTimeout:     options.ReadTimeout,
+			WriteTimeout:    options.WriteTimeout,
+			PoolSize:        options.PoolSize,
+			PoolTimeout:     options.PoolTimeout,
+			MinIdleConns:    options.MinIdleConns,
+			MaxIdleConns:    options.MaxIdleConns,
+			ConnMaxIdleTime: options.ConnMaxIdleTime,
+			ConnMaxLifetime: options.ConnMaxLifetime,
+			TLSConfig:       options.TLSConfig,
+		})
+
+	default:
+		rdb = redis.NewClient(options)
+	}
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+
+	return rdb, nil
+}
+
+// hasHashTag reports whether Redis Cluster hashes only a part of the key, the first non-empty
+// part between braces
+func hasHashTag(key string) bool {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start:], "}"); end > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ColocatedKey returns a key named after key with the suffix that Redis Cluster stores in the same
+// slot as key, so both can be used in one transaction or script. A key without a hash tag is hashed
+// as a whole, which is the same slot as a tag holding the whole key.
+func ColocatedKey(key string, suffix string) string {
+	if hasHashTag(key) {
+		return key + suffix
+	}
+
+	return "{" + key + "}" + suffix
+}
+
+// redactURL hides the password of a URL
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redacted
+	}
+
+	if u.User == nil {
+		return value
+	}
+
+	return u.Redacted()
+}
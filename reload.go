@@ -0,0 +1,164 @@
+package killfeed
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// configWatchInterval is how often the config file is checked for changes. Polling also notices
+// files replaced through symlinks, like mounted Kubernetes config maps.
+const configWatchInterval = 5 * time.Second
+
+// reloadable is implemented by configurations with settings that can change while a command runs
+type reloadable interface {
+	// reloadable returns the keys of the settings that take effect without a restart
+	reloadable() []string
+}
+
+// Change is a setting whose value differs after a reload, secrets are redacted
+type Change struct {
+	Key string
+	Old string
+	New string
+	// Restart is set for settings that only take effect when the command is restarted
+	Restart bool
+}
+
+// Reloader loads a configuration again from the config file, environment and flags it was first
+// loaded from. It is not safe for concurrent use.
+type Reloader struct {
+	file     string
+	explicit map[string]string
+	current  *settingSet
+}
+
+// Reload loads the configuration into next, an empty configuration of the loaded type, and returns
+// the settings that changed. An invalid configuration returns an error and leaves the current one
+// in place.
+func (r *Reloader) Reload(next Configurable) ([]Change, error) {
+	s := &settingSet{flags: flag.NewFlagSet("reload", flag.ContinueOnError)}
+	next.settings(s)
+
+	if err := s.apply(r.file, r.explicit); err != nil {
+		return nil, err
+	}
+
+	if err := next.validate(); err != nil {
+		return nil, err
+	}
+
+	live := []string{}
+	if config, ok := next.(reloadable); ok {
+		live = config.reloadable()
+	}
+
+	changes := []Change{}
+	for i, setting := range s.settings {
+		previous := r.current.settings[i]
+
+		// Secrets are compared in full, the changes only carry them redacted
+		if r.current.flags.Lookup(previous.flag).Value.String() != s.flags.Lookup(setting.flag).Value.String() {
+			changes = append(changes, Change{Key: setting.key, Old: r.current.value(previous), New: s.value(setting), Restart: !slices.Contains(live, setting.key)})
+		}
+	}
+
+	r.current = s
+	return changes, nil
+}
+
+// WatchConfig reloads the configuration whenever the process receives SIGHUP or the config file
+// changes, until ctx is done. Every change is logged, apply is called with the new configuration
+// when a setting that can be reloaded changed. Invalid reloads are logged and ignored.
+func WatchConfig[C any, P interface {
+	*C
+	Configurable
+}](ctx context.Context, r *Reloader, apply func(P)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	contents := r.readFile()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hangup:
+			log.Info().Msg("reloading config after SIGHUP")
+
+		case <-ticker.C:
+			if r.file == "" {
+				continue
+			}
+
+			latest := r.readFile()
+			if bytes.Equal(latest, contents) {
+				continue
+			}
+
+			contents = latest
+			log.Info().Str("file", r.file).Msg("reloading changed config file")
+		}
+
+		next := P(new(C))
+
+		changes, err := r.Reload(next)
+		if err != nil {
+			log.Error().Err(err).Msg("rejected config reload, keeping the current config")
+			continue
+		}
+
+		if logChanges(changes) {
+			apply(next)
+		}
+	}
+}
+
+// readFile returns the contents of the config file, or nil when it cannot be read, which the
+// reload then reports
+func (r *Reloader) readFile() []byte {
+	if r.file == "" {
+		return nil
+	}
+
+	contents, err := os.ReadFile(r.file)
+	if err != nil {
+		return nil
+	}
+
+	return contents
+}
+
+// logChanges logs the changes of a reload and reports whether any of them takes effect live
+func logChanges(changes []Change) bool {
+	if len(changes) == 0 {
+		log.Info().Msg("config reloaded without changes")
+		return false
+	}
+
+	live := false
+
+	for _, change := range changes {
+		if change.Restart {
+			log.Warn().Str("setting", change.Key).Str("old", change.Old).Str("new", change.New).Msg("config setting changed, it takes effect after a restart")
+			continue
+		}
+
+		live = true
+		log.Info().Str("setting", change.Key).Str("old", change.Old).Str("new", change.New).Msg("config setting changed")
+	}
+
+	return live
+}
@@ -0,0 +1,160 @@
+package killfeed
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, path string, contents string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+}
+
+// loadReloader loads a StreamAPIConfig from a config file and flags
+func loadReloader(t *testing.T, contents string, args ...string) (*Reloader, string) {
+	t.Helper()
+
+	t.Setenv("ESI_CONTACT_INFORMATION", "test@example.com")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, contents)
+
+	var config StreamAPIConfig
+	reloader, _, err := load(&config, flag.NewFlagSet("test", flag.ContinueOnError), append([]string{"-config", path}, args...))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	return reloader, path
+}
+
+func changesByKey(changes []Change) map[string]Change {
+	byKey := map[string]Change{}
+	for _, change := range changes {
+		byKey[change.Key] = change
+	}
+
+	return byKey
+}
+
+func TestReloadChanges(t *testing.T) {
+	reloader, path := loadReloader(t, `
+redis:
+  url: redis://redis:6379/0
+lag:
+  warning_entries: 5
+`, "-port", "9000")
+
+	writeConfigFile(t, path, `
+redis:
+  url: redis://other:6379/0
+lag:
+  warning_entries: 7
+port: 1
+`)
+
+	var next StreamAPIConfig
+	changes, err := reloader.Reload(&next)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	byKey := changesByKey(changes)
+	if len(byKey) != 2 {
+		t.Fatalf("expected 2 changes, got %+v", changes)
+	}
+
+	if change := byKey["lag.warning_entries"]; change != (Change{Key: "lag.warning_entries", Old: "5", New: "7"}) {
+		t.Fatalf("unexpected change of a reloadable setting: %+v", change)
+	}
+
+	if change := byKey["redis.url"]; !change.Restart || change.Old != "redis://redis:6379/0" || change.New != "redis://other:6379/0" {
+		t.Fatalf("unexpected change of a restart only setting: %+v", change)
+	}
+
+	// Flags given on the command line still win over the file
+	if next.Port != 9000 {
+		t.Fatalf("expected the port of the flag, got %d", next.Port)
+	}
+
+	if next.LagWarningEntries != 7 {
+		t.Fatalf("expected the reloaded value, got %d", next.LagWarningEntries)
+	}
+}
+
+func TestReloadRedactsSecrets(t *testing.T) {
+	reloader, path := loadReloader(t, `
+redis:
+  url: redis://:first@redis:6379/0
+sso:
+  client_secret: first
+`)
+
+	writeConfigFile(t, path, `
+redis:
+  url: redis://:second@redis:6379/0
+sso:
+  client_secret: second
+`)
+
+	changes, err := reloader.Reload(&StreamAPIConfig{})
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	// Secrets are reported when they change, without their values
+	byKey := changesByKey(changes)
+
+	if change := byKey["sso.client_secret"]; change.Old != redacted || change.New != redacted {
+		t.Fatalf("secret not redacted: %+v", change)
+	}
+
+	if change := byKey["redis.url"]; change.Old != "redis://:xxxxx@redis:6379/0" || change.New != "redis://:xxxxx@redis:6379/0" {
+		t.Fatalf("url password not redacted: %+v", change)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	reloader, path := loadReloader(t, `
+redis:
+  url: redis://redis:6379/0
+queue:
+  session_policy: reject
+`)
+
+	for _, invalid := range []string{
+		"queue:\n  session_policy: bogus\n",
+		"lag:\n  warning_entries: many\n",
+		"unknown: 1\n",
+		"port: [\n",
+	} {
+		contents := "redis:\n  url: redis://redis:6379/0\n" + invalid
+		writeConfigFile(t, path, contents)
+
+		if _, err := reloader.Reload(&StreamAPIConfig{}); err == nil {
+			t.Fatalf("invalid config accepted: %q", contents)
+		}
+	}
+
+	// The rejected reloads left the loaded config in place, changes are still relative to it
+	writeConfigFile(t, path, `
+redis:
+  url: redis://redis:6379/0
+queue:
+  session_policy: fanout
+`)
+
+	changes, err := reloader.Reload(&StreamAPIConfig{})
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	if len(changes) != 1 || changes[0] != (Change{Key: "queue.session_policy", Old: "reject", New: "fanout"}) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
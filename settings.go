@@ -0,0 +1,322 @@
+package killfeed
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// redacted replaces the values of secrets when the configuration is printed
+const redacted = "<redacted>"
+
+// Configurable is implemented by the configuration of every command
+type Configurable interface {
+	// settings registers the settings of the configuration together with their defaults
+	settings(s *settingSet)
+	// validate checks the loaded settings and fills in values derived from them
+	validate() error
+}
+
+// setting is a configuration value. It is read from the config file under key, where dots separate
+// nested keys, from the environment variable env and from a flag named after key with dashes.
+type setting struct {
+	key  string
+	env  string
+	flag string
+	// redact hides secrets in the value when the configuration is printed
+	redact func(string) string
+}
+
+// settingSet registers settings as flags, which hold their values, defaults and documentation
+type settingSet struct {
+	flags    *flag.FlagSet
+	settings []setting
+}
+
+func (s *settingSet) add(key string, env string, usage string, redact func(string) string, register func(name string, usage string)) {
+	name := strings.NewReplacer(".", "-", "_", "-").Replace(key)
+	register(name, fmt.Sprintf("%s (env %s)", usage, env))
+	s.settings = append(s.settings, setting{key: key, env: env, flag: name, redact: redact})
+}
+
+func (s *settingSet) StringVar(p *string, key string, env string, value string, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.StringVar(p, name, value, usage) })
+}
+
+// SecretVar registers a string setting that is redacted when the configuration is printed
+func (s *settingSet) SecretVar(p *string, key string, env string, usage string) {
+	s.add(key, env, usage, redactSecret, func(name string, usage string) { s.flags.StringVar(p, name, "", usage) })
+}
+
+// URLVar registers a URL setting whose password is redacted when the configuration is printed
+func (s *settingSet) URLVar(p *string, key string, env string, value string, usage string) {
+	s.add(key, env, usage, redactURL, func(name string, usage string) { s.flags.StringVar(p, name, value, usage) })
+}
+
+func (s *settingSet) IntVar(p *int, key string, env string, value int, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.IntVar(p, name, value, usage) })
+}
+
+func (s *settingSet) Int64Var(p *int64, key string, env string, value int64, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.Int64Var(p, name, value, usage) })
+}
+
+func (s *settingSet) Float64Var(p *float64, key string, env string, value float64, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.Float64Var(p, name, value, usage) })
+}
+
+func (s *settingSet) BoolVar(p *bool, key string, env string, value bool, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.BoolVar(p, name, value, usage) })
+}
+
+func (s *settingSet) DurationVar(p *time.Duration, key string, env string, value time.Duration, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.DurationVar(p, name, value, usage) })
+}
+
+// Var registers a setting with a custom parser, its current value is the default
+func (s *settingSet) Var(value flag.Value, key string, env string, usage string) {
+	s.add(key, env, usage, nil, func(name string, usage string) { s.flags.Var(value, name, usage) })
+}
+
+// Load fills config with its defaults, then a YAML config file, environment variables and command
+// line flags, each overriding the previous. It parses flag.CommandLine, so commands register their
+// own flags first. The config file is named by -config or CONFIG_FILE. With -print-config the
+// effective configuration is printed with secrets redacted and the command exits, an invalid
+// configuration is printed as well and makes it exit with an error.
+func Load(config Configurable) error {
+	_, err := LoadReloadable(config)
+	return err
+}
+
+// LoadReloadable loads config like Load and returns a Reloader to load it again later
+func LoadReloadable(config Configurable) (*Reloader, error) {
+	reloader, printConfig, err := load(config, flag.CommandLine, os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if printConfig {
+		if err := reloader.current.print(os.Stdout); err != nil {
+			return nil, err
+		}
+
+		// The configuration is printed before it is validated, so an invalid one can be inspected
+		if err := config.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	return reloader, nil
+}
+
+func load(config Configurable, flags *flag.FlagSet, args []string) (*Reloader, bool, error) {
+	s := &settingSet{flags: flags}
+	config.settings(s)
+
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "read settings from this YAML file, it is reloaded on changes by commands that support it (env CONFIG_FILE)")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	// Flags take precedence over the file and the environment, so they are applied again after both
+	explicit := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if err := s.apply(*file, explicit); err != nil {
+		return nil, false, err
+	}
+
+	reloader := &Reloader{file: *file, explicit: explicit, current: s}
+
+	// Printing the configuration leaves the validation to the caller
+	if *printConfig {
+		return reloader, true, nil
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, false, err
+	}
+
+	return reloader, false, nil
+}
+
+// apply sets the settings from the config file, the environment and the explicitly given flags
+func (s *settingSet) apply(file string, explicit map[string]string) error {
+	if file != "" {
+		if err := s.loadFile(file); err != nil {
+			return err
+		}
+	}
+
+	for _, setting := range s.settings {
+		// Empty variables count as unset, like an empty entry in an env file
+		if value := os.Getenv(setting.env); value != "" {
+			if err := s.flags.Set(setting.flag, value); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", setting.env, value, err)
+			}
+		}
+	}
+
+	for _, setting := range s.settings {
+		if value, ok := explicit[setting.flag]; ok {
+			if err := s.flags.Set(setting.flag, value); err != nil {
+				return fmt.Errorf("invalid -%s %q: %w", setting.flag, value, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// value returns the current value of a setting, with secrets redacted
+func (s *settingSet) value(setting setting) string {
+	value := s.flags.Lookup(setting.flag).Value.String()
+
+	if setting.redact != nil && value != "" {
+		return setting.redact(value)
+	}
+
+	return value
+}
+
+// loadFile sets the settings found in a YAML file. Nested mappings are flattened into dotted keys,
+// keys that are not settings are rejected so typos do not go unnoticed.
+func (s *settingSet) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// An empty file has no content
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	byKey := map[string]setting{}
+	for _, setting := range s.settings {
+		byKey[setting.key] = setting
+	}
+
+	return s.loadNode(document.Content[0], "", byKey)
+}
+
+func (s *settingSet) loadNode(node *yaml.Node, prefix string, byKey map[string]setting) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("config file: %s must be a mapping", strings.TrimSuffix(prefix, "."))
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + node.Content[i].Value
+		value := node.Content[i+1]
+
+		setting, ok := byKey[key]
+		if !ok {
+			if value.Kind == yaml.MappingNode && hasKeyPrefix(byKey, key+".") {
+				if err := s.loadNode(value, key+".", byKey); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			return fmt.Errorf("config file: unknown setting %s", key)
+		}
+
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("config file: %s must be a single value", key)
+		}
+
+		// An empty value leaves the default, like an unset environment variable
+		if value.Tag == "!!null" {
+			continue
+		}
+
+		if err := s.flags.Set(setting.flag, value.Value); err != nil {
+			return fmt.Errorf("config file: invalid %s %q: %w", key, value.Value, err)
+		}
+	}
+
+	return nil
+}
+
+func hasKeyPrefix(byKey map[string]setting, prefix string) bool {
+	for key := range byKey {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// print writes the current settings as a YAML config file, secrets are redacted
+func (s *settingSet) print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, setting := range s.settings {
+		parent := root
+		parts := strings.Split(setting.key, ".")
+
+		for _, part := range parts[:len(parts)-1] {
+			parent = mappingChild(parent, part)
+		}
+
+		node := &yaml.Node{Kind: yaml.ScalarNode, Value: s.value(setting)}
+
+		// Strings are quoted where needed to read back as strings, other values as their type
+		if getter, ok := s.flags.Lookup(setting.flag).Value.(flag.Getter); !ok || isString(getter.Get()) {
+			node.Tag = "!!str"
+		}
+
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: parts[len(parts)-1]}, node)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(root); err != nil {
+		return fmt.Errorf("failed to print config: %w", err)
+	}
+
+	return encoder.Close()
+}
+
+// mappingChild returns the mapping under key, adding it when it does not exist yet
+func mappingChild(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+
+	child := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+
+	return child
+}
+
+func redactSecret(string) string {
+	return redacted
+}
+
+func isString(value any) bool {
+	_, ok := value.(string)
+	return ok
+}
@@ -0,0 +1,91 @@
+package killfeed
+
+import (
+	"bytes"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, `
+redis:
+  url: redis://file:6379/0
+stream:
+  name: file-stream
+  max_length: 100
+port: 1000
+`)
+
+	// The environment overrides the file, explicit flags override both
+	t.Setenv("ESI_CONTACT_INFORMATION", "test@example.com")
+	t.Setenv("STREAM_MAX_LENGTH", "200")
+	t.Setenv("PORT", "2000")
+
+	var config StreamAPIConfig
+	if _, _, err := load(&config, flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-port", "3000"}); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if config.Stream.Name != "file-stream" || config.Redis.URL != "redis://file:6379/0" {
+		t.Fatalf("file settings not applied: %+v", config.Config)
+	}
+
+	if config.Stream.MaxLength != 200 {
+		t.Fatalf("environment did not override the file: %d", config.Stream.MaxLength)
+	}
+
+	if config.Port != 3000 {
+		t.Fatalf("flag did not override the environment: %d", config.Port)
+	}
+
+	// Settings set nowhere keep their defaults
+	if config.Stream.DerivedMaxLength != DerivedStreamMaxLength {
+		t.Fatalf("default not applied: %d", config.Stream.DerivedMaxLength)
+	}
+}
+
+func TestLoadPrintConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, `
+redis:
+  url: redis://:hunter2@redis:6379/0
+sso:
+  client_secret: s3cr3t
+port: 0
+`)
+
+	// The port is invalid and ESI contact information is missing, it is printed anyway
+	var config StreamAPIConfig
+	reloader, printConfig, err := load(&config, flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-print-config"})
+	if err != nil {
+		t.Fatalf("failed to load config for printing: %v", err)
+	}
+
+	if !printConfig {
+		t.Fatal("print-config not reported")
+	}
+
+	var out bytes.Buffer
+	if err := reloader.current.print(&out); err != nil {
+		t.Fatalf("failed to print config: %v", err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, "hunter2") || strings.Contains(printed, "s3cr3t") {
+		t.Fatalf("secrets printed:\n%s", printed)
+	}
+
+	for _, expected := range []string{"url: redis://:xxxxx@redis:6379/0", "client_secret: " + redacted, "port: 0"} {
+		if !strings.Contains(printed, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, printed)
+		}
+	}
+
+	// Without -print-config the same configuration is rejected
+	if _, _, err := load(&StreamAPIConfig{}, flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"killfeed"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenPrefix tells session tokens apart from API keys
+const TokenPrefix = "kfs_"
+
+const (
+	stateTTL = 10 * time.Minute
+
+	redisSessionPrefix = "sso:session:"
+	redisStatePrefix   = "sso:state:"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a logged in pilot. Its feed is restricted to kills involving the pilot's corporation
+// or alliance as of login.
+type Session struct {
+	CharacterID   int32     `json:"character_id"`
+	CharacterName string    `json:"character_name"`
+	CorporationID int32     `json:"corporation_id"`
+	AllianceID    int32     `json:"alliance_id,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// Involved reports whether the pilot's corporation or alliance is on the killmail
+func (s Session) Involved(killmail killfeed.CombinedKillmail) bool {
+	matches := func(corporationID int32, allianceID int32) bool {
+		return corporationID == s.CorporationID || (s.AllianceID != 0 && allianceID == s.AllianceID)
+	}
+
+	if matches(killmail.Victim.CorporationId, killmail.Victim.AllianceId) {
+		return true
+	}
+
+	for _, attacker := range killmail.Attackers {
+		if matches(attacker.CorporationId, attacker.AllianceId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupAffiliation returns the current corporation and alliance of a character
+func LookupAffiliation(ctx context.Context, esiClient *goesi.APIClient, characterID int32) (int32, int32, error) {
+	affiliations, _, err := esiClient.ESI.CharacterApi.PostCharactersAffiliation(ctx, []int32{characterID}, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to look up affiliation of character %d: %w", characterID, err)
+	}
+
+	for _, affiliation := range affiliations {
+		if affiliation.CharacterId == characterID {
+			return affiliation.CorporationId, affiliation.AllianceId, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("no affiliation for character %d", characterID)
+}
+
+// SessionStore keeps sessions and pending login states in Redis. Like API keys, only a hash of
+// the session token is stored.
+type SessionStore struct {
+	rdb redis.Cmdable
+	ttl time.Duration
+}
+
+func NewSessionStore(rdb redis.Cmdable, ttl time.Duration) *SessionStore {
+	return &SessionStore{rdb: rdb, ttl: ttl}
+}
+
+// CreateState returns a state for a login attempt, it is valid once for a few minutes
+func (s *SessionStore) CreateState(ctx context.Context) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.rdb.Set(ctx, redisStatePrefix+state, 1, stateTTL).Err(); err != nil {
+		return "", fmt.Errorf("failed to store login state: %w", err)
+	}
+
+	return state, nil
+}
+
+// ConsumeState reports whether state was issued by CreateState and invalidates it
+func (s *SessionStore) ConsumeState(ctx context.Context, state string) (bool, error) {
+	if state == "" {
+		return false, nil
+	}
+
+	deleted, err := s.rdb.Del(ctx, redisStatePrefix+state).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to consume login state: %w", err)
+	}
+
+	return deleted == 1, nil
+}
+
+// Create starts a session for a character and returns its token
+func (s *SessionStore) Create(ctx context.Context, character Character, corporationID int32, allianceID int32) (Session, string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	token := TokenPrefix + secret
+
+	session := Session{
+		CharacterID:   character.ID,
+		CharacterName: character.Name,
+		CorporationID: corporationID,
+		AllianceID:    allianceID,
+		ExpiresAt:     time.Now().Add(s.ttl).UTC().Truncate(time.Second),
+	}
+
+	key := redisSessionPrefix + hash(token)
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, map[string]any{
+			"character_id":   session.CharacterID,
+			"character_name": session.CharacterName,
+			"corporation_id": session.CorporationID,
+			"alliance_id":    session.AllianceID,
+			"expires_at":     session.ExpiresAt.Format(time.RFC3339),
+		})
+		pipe.ExpireAt(ctx, key, session.ExpiresAt)
+		return nil
+	})
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to store session: %w", err)
+	}
+
+	return session, token, nil
+}
+
+// Get returns the session of a token, or ErrSessionNotFound for unknown and expired tokens
+func (s *SessionStore) Get(ctx context.Context, token string) (Session, error) {
+	if !strings.HasPrefix(token, TokenPrefix) {
+		return Session{}, ErrSessionNotFound
+	}
+
+	fields, err := s.rdb.HGetAll(ctx, redisSessionPrefix+hash(token)).Result()
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return Session{}, ErrSessionNotFound
+	}
+
+	session := Session{CharacterName: fields["character_name"]}
+
+	for name, target := range map[string]*int32{
+		"character_id":   &session.CharacterID,
+		"corporation_id": &session.CorporationID,
+		"alliance_id":    &session.AllianceID,
+	} {
+		value, err := strconv.ParseInt(fields[name], 10, 32)
+		if err != nil {
+			return Session{}, fmt.Errorf("failed to parse session %s: %w", name, err)
+		}
+
+		*target = int32(value)
+	}
+
+	session.ExpiresAt, err = time.Parse(time.RFC3339, fields["expires_at"])
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to parse session expiry: %w", err)
+	}
+
+	return session, nil
+}
+
+// Delete ends the session of a token
+func (s *SessionStore) Delete(ctx context.Context, token string) error {
+	if err := s.rdb.Del(ctx, redisSessionPrefix+hash(token)).Err(); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	return nil
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,131 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+const DefaultIssuer = "https://login.eveonline.com"
+
+// audience is the second audience every EVE SSO token carries next to the client ID
+const audience = "EVE Online"
+
+var ErrInvalidToken = errors.New("invalid SSO token")
+
+// Config describes an EVE SSO application. The OAuth endpoints are derived from the issuer, so a
+// local fake issuer can stand in for login.eveonline.com.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	CallbackURL  string
+	Issuer       string
+}
+
+// Character is the pilot an SSO token was issued for
+type Character struct {
+	ID   int32
+	Name string
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	Name string `json:"name"`
+}
+
+// Provider runs the authorization code flow against EVE SSO and validates the issued tokens
+type Provider struct {
+	oauth      oauth2.Config
+	issuer     string
+	clientID   string
+	httpClient *http.Client
+	keys       *keySet
+}
+
+func NewProvider(httpClient *http.Client, config Config) *Provider {
+	issuer := strings.TrimSuffix(config.Issuer, "/")
+	if issuer == "" {
+		issuer = DefaultIssuer
+	}
+
+	return &Provider{
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.CallbackURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   issuer + "/v2/oauth/authorize",
+				TokenURL:  issuer + "/v2/oauth/token",
+				AuthStyle: oauth2.AuthStyleInHeader,
+			},
+		},
+		issuer:     issuer,
+		clientID:   config.ClientID,
+		httpClient: httpClient,
+		keys:       newKeySet(httpClient, issuer+"/oauth/jwks"),
+	}
+}
+
+// AuthCodeURL returns the URL pilots are redirected to for logging in. No ESI scopes are requested
+// since only the identity of the character is needed.
+func (p *Provider) AuthCodeURL(state string) string {
+	return p.oauth.AuthCodeURL(state)
+}
+
+// Exchange trades the code returned to the callback for a token and returns the character it belongs to
+func (p *Provider) Exchange(ctx context.Context, code string) (Character, error) {
+	token, err := p.oauth.Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.httpClient), code)
+	if err != nil {
+		return Character{}, fmt.Errorf("failed to exchange SSO code: %w", err)
+	}
+
+	return p.Verify(ctx, token.AccessToken)
+}
+
+// Verify validates an SSO access token, which is a JWT signed with one of the issuer's keys
+func (p *Provider) Verify(ctx context.Context, accessToken string) (Character, error) {
+	var c claims
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "ES256"}))
+
+	_, err := parser.ParseWithClaims(accessToken, &c, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.key(ctx, kid)
+	})
+	if err != nil {
+		return Character{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if c.ExpiresAt == nil {
+		return Character{}, fmt.Errorf("%w: missing expiry", ErrInvalidToken)
+	}
+
+	// EVE SSO has issued tokens both with and without the scheme in the issuer
+	if c.Issuer != p.issuer && c.Issuer != strings.TrimPrefix(p.issuer, "https://") {
+		return Character{}, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, c.Issuer)
+	}
+
+	if !slices.Contains(c.Audience, p.clientID) || !slices.Contains(c.Audience, audience) {
+		return Character{}, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	// The subject has the form CHARACTER:EVE:<character ID>
+	rawID, ok := strings.CutPrefix(c.Subject, "CHARACTER:EVE:")
+	if !ok {
+		return Character{}, fmt.Errorf("%w: unexpected subject %q", ErrInvalidToken, c.Subject)
+	}
+
+	characterID, err := strconv.ParseInt(rawID, 10, 32)
+	if err != nil || characterID <= 0 {
+		return Character{}, fmt.Errorf("%w: invalid character ID %q", ErrInvalidToken, rawID)
+	}
+
+	return Character{ID: int32(characterID), Name: c.Name}, nil
+}
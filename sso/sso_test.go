@@ -0,0 +1,291 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testClientID = "test-client"
+
+// fakeIssuer stands in for login.eveonline.com, it serves a JWKS and a token endpoint that trades
+// the code "valid" for a token of the test character
+type fakeIssuer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]crypto.Signer
+	jwksFetches int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	issuer := &fakeIssuer{keys: map[string]crypto.Signer{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/jwks", issuer.serveJWKS)
+	mux.HandleFunc("/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != "valid" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": issuer.sign(t, "rsa", issuer.claims()),
+			"token_type":   "Bearer",
+			"expires_in":   1199,
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	issuer.addKey("rsa", mustRSAKey(t))
+
+	return issuer
+}
+
+func (i *fakeIssuer) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.jwksFetches++
+
+	keys := []map[string]string{}
+	for kid, signer := range i.keys {
+		switch key := signer.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "RSA", "n": encodeBigInt(key.N), "e": encodeBigInt(big.NewInt(int64(key.E)))})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": encodeBigInt(key.X), "y": encodeBigInt(key.Y)})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (i *fakeIssuer) addKey(kid string, key crypto.Signer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.keys[kid] = key
+}
+
+func (i *fakeIssuer) fetches() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.jwksFetches
+}
+
+// claims returns the claims of a valid token for character 90000001
+func (i *fakeIssuer) claims() claims {
+	return claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.URL,
+			Subject:   "CHARACTER:EVE:90000001",
+			Audience:  jwt.ClaimStrings{testClientID, audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(20 * time.Minute)),
+		},
+		Name: "Test Pilot",
+	}
+}
+
+func (i *fakeIssuer) sign(t *testing.T, kid string, c claims) string {
+	i.mu.Lock()
+	key := i.keys[kid]
+	i.mu.Unlock()
+
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+
+	token := jwt.NewWithClaims(method, c)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return signed
+}
+
+func (i *fakeIssuer) provider() *Provider {
+	return NewProvider(i.Client(), Config{ClientID: testClientID, ClientSecret: "secret", CallbackURL: "http://localhost/auth/callback", Issuer: i.URL})
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	return key
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+
+	return key
+}
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func TestVerifyValidTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	issuer.addKey("ec", mustECKey(t))
+
+	for _, kid := range []string{"rsa", "ec"} {
+		t.Run(kid, func(t *testing.T) {
+			character, err := issuer.provider().Verify(context.Background(), issuer.sign(t, kid, issuer.claims()))
+			if err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			}
+
+			if character != (Character{ID: 90000001, Name: "Test Pilot"}) {
+				t.Fatalf("unexpected character %+v", character)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	tests := []struct {
+		name   string
+		modify func(c *claims)
+	}{
+		{"wrong issuer", func(c *claims) { c.Issuer = "https://login.example.com" }},
+		{"wrong audience", func(c *claims) { c.Audience = jwt.ClaimStrings{"other-client", audience} }},
+		{"missing EVE audience", func(c *claims) { c.Audience = jwt.ClaimStrings{testClientID} }},
+		{"expired", func(c *claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }},
+		{"missing expiry", func(c *claims) { c.ExpiresAt = nil }},
+		{"subject of another kind", func(c *claims) { c.Subject = "CORPORATION:EVE:98000001" }},
+		{"subject without ID", func(c *claims) { c.Subject = "CHARACTER:EVE:pilot" }},
+		{"negative character ID", func(c *claims) { c.Subject = "CHARACTER:EVE:-5" }},
+		{"character ID out of range", func(c *claims) { c.Subject = "CHARACTER:EVE:99999999999" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := issuer.claims()
+			test.modify(&c)
+
+			if _, err := issuer.provider().Verify(context.Background(), issuer.sign(t, "rsa", c)); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsForeignSignature(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, issuer.claims())
+	token.Header["kid"] = "rsa"
+
+	signed, err := token.SignedString(mustRSAKey(t))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	if _, err := issuer.provider().Verify(context.Background(), signed); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestVerifyRefetchesUnknownKeys(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	if _, err := provider.Verify(ctx, issuer.sign(t, "rsa", issuer.claims())); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	// The issuer rotates to a key the provider has not seen yet
+	issuer.addKey("rotated", mustECKey(t))
+	rotated := issuer.sign(t, "rotated", issuer.claims())
+
+	// Refetches are limited, an unknown key right after a fetch is rejected without one
+	if _, err := provider.Verify(ctx, rotated); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken within the refresh interval, got %v", err)
+	}
+
+	if fetches := issuer.fetches(); fetches != 1 {
+		t.Fatalf("expected 1 JWKS fetch, got %d", fetches)
+	}
+
+	// Once the interval passed, the unknown key triggers a refetch that finds it
+	provider.keys.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+
+	if _, err := provider.Verify(ctx, rotated); err != nil {
+		t.Fatalf("token of rotated key rejected: %v", err)
+	}
+
+	if fetches := issuer.fetches(); fetches != 2 {
+		t.Fatalf("expected 2 JWKS fetches, got %d", fetches)
+	}
+
+	// Keys that are still unknown after a refetch are rejected
+	provider.keys.fetchedAt = time.Time{}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, issuer.claims())
+	token.Header["kid"] = "missing"
+
+	signed, err := token.SignedString(mustRSAKey(t))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	if _, err := provider.Verify(ctx, signed); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider()
+
+	character, err := provider.Exchange(context.Background(), "valid")
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+
+	if character.ID != 90000001 {
+		t.Fatalf("unexpected character %+v", character)
+	}
+
+	_, err = provider.Exchange(context.Background(), "expired")
+	if err == nil {
+		t.Fatal("exchange of an invalid code succeeded")
+	}
+
+	// A failed exchange is an SSO failure, not an invalid token
+	if errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("failed exchange reported as invalid token: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package killfeed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StreamConfig describes a killmail stream and how long its entries are retained
+type StreamConfig struct {
+	Name string
+	// MaxLength trims the stream to roughly this many entries, 0 disables length based trimming
+	MaxLength int64
+	// MaxAge trims entries older than this, 0 disables age based trimming
+	MaxAge time.Duration
+	// DerivedMaxLength bounds each per-entity stream derived from this stream
+	DerivedMaxLength int64
+	// MsgpackPayload stores a MessagePack encoding next to the JSON payload of every entry
+	MsgpackPayload bool
+}
+
+// Kinds of per-entity streams derived from a killmail stream
+const (
+	DerivedAlliance    = "alliance"
+	DerivedCorporation = "corporation"
+	DerivedRegion      = "region"
+)
+
+func IsDerivedKind(kind string) bool {
+	return kind == DerivedAlliance || kind == DerivedCorporation || kind == DerivedRegion
+}
+
+func (s StreamConfig) Validate() error {
+	if s.Name == "" {
+		return errors.New("missing stream name")
+	}
+
+	if strings.ContainsAny(s.Name, " \t\r\n") {
+		return fmt.Errorf("stream name %q must not contain whitespace", s.Name)
+	}
+
+	if s.MaxLength < 0 {
+		return errors.New("stream max length must not be negative")
+	}
+
+	if s.MaxAge < 0 {
+		return errors.New("stream max age must not be negative")
+	}
+
+	if s.MaxLength == 0 && s.MaxAge == 0 {
+		return errors.New("stream needs a max length or a max age, otherwise it grows without bound")
+	}
+
+	if s.MaxAge > 0 && s.MaxAge < time.Minute {
+		return errors.New("stream max age must be at least one minute")
+	}
+
+	if s.DerivedMaxLength < 0 {
+		return errors.New("derived stream max length must not be negative")
+	}
+
+	if s.DerivedMaxLength == 0 && s.MaxAge == 0 {
+		return errors.New("derived streams need a max length or a max age, otherwise they grow without bound")
+	}
+
+	return nil
+}
+
+// MinID returns the oldest stream entry ID retained under MaxAge
+func (s StreamConfig) MinID(now time.Time) string {
+	return fmt.Sprintf("%d-0", now.Add(-s.MaxAge).UnixMilli())
+}
+
+// Derived returns the per-entity stream holding the killmails of this stream involving the entity.
+// The entity is the hash tag of the name, so in a cluster the derived streams are spread across the
+// slots and each one shares its slot with the keys named after it, like its cursors.
+func (s StreamConfig) Derived(kind string, entityID int32) StreamConfig {
+	return StreamConfig{
+		Name:      fmt.Sprintf("%s:{%s:%d}", s.Name, kind, entityID),
+		MaxLength: s.DerivedMaxLength,
+		MaxAge:    s.MaxAge,
+	}
+}
+
+// Add queues an entry on the stream, trimming it according to the retention. Age based retention
+// needs a separate XTRIM when a max length is configured as well, so a pipeline should be passed
+// to send both at once.
+func (s StreamConfig) Add(ctx context.Context, rdb redis.Cmdable, values map[string]any) *redis.StringCmd {
+	args := &redis.XAddArgs{
+		Stream: s.Name,
+		ID:     "*",
+		Approx: true,
+		Values: values,
+	}
+
+	if s.MaxLength > 0 {
+		args.MaxLen = s.MaxLength
+	} else {
+		args.MinID = s.MinID(time.Now())
+	}
+
+	cmd := rdb.XAdd(ctx, args)
+
+	if s.MaxLength > 0 && s.MaxAge > 0 {
+		rdb.XTrimMinIDApprox(ctx, s.Name, s.MinID(time.Now()), 0)
+	}
+
+	return cmd
+}
+
+// Key returns a Redis key belonging to the stream. Keys of the default stream are not prefixed with
+// the stream name, so cursors of existing deployments stay valid.
+func (s StreamConfig) Key(parts ...string) string {
+	if s.Name == StreamKillmails {
+		return "stream:" + strings.Join(parts, ":")
+	}
+
+	return "stream:" + s.Name + ":" + strings.Join(parts, ":")
+}
+
+// KillmailIDKey is the key mapping a killmail ID to the ID of its entry in the stream
+func (s StreamConfig) KillmailIDKey(killmailID int32) string {
+	return s.Key("killmail", strconv.Itoa(int(killmailID)))
+}
+
+// StreamSchemaVersion is the version of the canonical stream entry encoding. Version 1 is the
+// legacy layout with separate killmail, killmail_zkb and tags fields.
+const StreamSchemaVersion = 2
+
+// EncodeStreamMessage encodes a killmail into the values of a canonical stream entry. With
+// withMsgpack the MessagePack encoding is stored next to the JSON payload, so binary clients do
+// not need to convert every entry.
+func EncodeStreamMessage(killmail CombinedKillmail, withMsgpack bool) (map[string]any, error) {
+	killmail.SchemaVersion = StreamSchemaVersion
+
+	payload, err := json.Marshal(killmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode killmail %d: %w", killmail.KillmailId, err)
+	}
+
+	values := map[string]any{
+		"schema_version": StreamSchemaVersion,
+		"payload":        string(payload),
+	}
+
+	if withMsgpack {
+		msgpackPayload, err := EncodeMsgpack(killmail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode killmail %d: %w", killmail.KillmailId, err)
+		}
+
+		values["payload_msgpack"] = string(msgpackPayload)
+	}
+
+	return values, nil
+}
+
+// IsLegacyStreamMessage reports whether an entry still uses the legacy two-field layout
+func IsLegacyStreamMessage(message redis.XMessage) bool {
+	_, ok := message.Values["payload"]
+	return !ok
+}
+
+// StreamPayload returns the canonical JSON encoding of a stream entry. Canonical entries are
+// returned as stored, legacy entries are converted.
+func StreamPayload(message redis.XMessage) ([]byte, error) {
+	if IsLegacyStreamMessage(message) {
+		killmail, err := decodeLegacyStreamMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := json.Marshal(killmail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode killmail message %s: %w", message.ID, err)
+		}
+
+		return payload, nil
+	}
+
+	if version, _ := message.Values["schema_version"].(string); version != strconv.Itoa(StreamSchemaVersion) {
+		return nil, fmt.Errorf("unsupported schema version %q of killmail message %s", version, message.ID)
+	}
+
+	payload, ok := message.Values["payload"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid killmail message %s", message.ID)
+	}
+
+	return []byte(payload), nil
+}
+
+// StreamPayloadFormat returns the encoding of a stream entry in the given format
+func StreamPayloadFormat(message redis.XMessage, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return StreamPayload(message)
+
+	case FormatMsgpack:
+		if payload, ok := message.Values["payload_msgpack"].(string); ok {
+			return []byte(payload), nil
+		}
+
+		killmail, err := DecodeStreamMessage(message)
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := EncodeMsgpack(killmail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode killmail message %s: %w", message.ID, err)
+		}
+
+		return payload, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported payload format %q", format)
+	}
+}
+
+// StreamPayloadWithTimings returns the encoding of a stream entry in the given format with its
+// timings included. Unlike StreamPayloadFormat it always decodes and encodes the entry again.
+func StreamPayloadWithTimings(message redis.XMessage, format string, deliveredAt time.Time) ([]byte, error) {
+	killmail, err := DecodeStreamMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	timings := StreamTimings(message)
+	timings.DeliveredAt = deliveredAt
+	killmail.Timings = &timings
+
+	var payload []byte
+
+	switch format {
+	case FormatJSON:
+		payload, err = json.Marshal(killmail)
+	case FormatMsgpack:
+		payload, err = EncodeMsgpack(killmail)
+	default:
+		return nil, fmt.Errorf("unsupported payload format %q", format)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode killmail message %s: %w", message.ID, err)
+	}
+
+	return payload, nil
+}
+
+// DecodeStreamMessage decodes a killmail stream entry in either the canonical or the legacy layout
+func DecodeStreamMessage(message redis.XMessage) (CombinedKillmail, error) {
+	if IsLegacyStreamMessage(message) {
+		return decodeLegacyStreamMessage(message)
+	}
+
+	payload, err := StreamPayload(message)
+	if err != nil {
+		return CombinedKillmail{}, err
+	}
+
+	var killmail CombinedKillmail
+	if err := json.Unmarshal(payload, &killmail); err != nil {
+		return CombinedKillmail{}, fmt.Errorf("failed to decode killmail message %s: %w", message.ID, err)
+	}
+
+	return killmail, nil
+}
+
+func decodeLegacyStreamMessage(message redis.XMessage) (CombinedKillmail, error) {
+	encodedKillmail, ok := message.Values["killmail"].(string)
+	if !ok {
+		return CombinedKillmail{}, fmt.Errorf("invalid killmail message %s", message.ID)
+	}
+
+	encodedKillmailZkb, ok := message.Values["killmail_zkb"].(string)
+	if !ok {
+		return CombinedKillmail{}, fmt.Errorf("invalid killmail message %s, missing zkb fields", message.ID)
+	}
+
+	var killmail Killmail
+	if err := json.Unmarshal([]byte(encodedKillmail), &killmail); err != nil {
+		return CombinedKillmail{}, fmt.Errorf("failed to decode killmail message %s: %w", message.ID, err)
+	}
+
+	var killmailZkb KillmailZkb
+	if err := json.Unmarshal([]byte(encodedKillmailZkb), &killmailZkb); err != nil {
+		return CombinedKillmail{}, fmt.Errorf("failed to decode killmail message %s zkb fields: %w", message.ID, err)
+	}
+
+	// Tags are missing on entries written before the poller classified killmails
+	var tags []string
+	if encodedTags, ok := message.Values["tags"].(string); ok {
+		if err := json.Unmarshal([]byte(encodedTags), &tags); err != nil {
+			return CombinedKillmail{}, fmt.Errorf("failed to decode killmail message %s tags: %w", message.ID, err)
+		}
+	}
+
+	return NewCombinedKillmail(killmail, killmailZkb, tags), nil
+}
@@ -0,0 +1,92 @@
+package killfeed
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Timings are the points in time a killmail passed on its way through the pipeline
+type Timings struct {
+	KillmailTime time.Time `json:"killmail_time,omitzero"`
+	// ReceivedAt is when the poller got the killmail from RedisQ, it is missing for backfilled killmails
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+	FetchedAt  time.Time `json:"fetched_at,omitzero"`
+	// AddedAt is when the entry was added to the stream, taken from its ID
+	AddedAt     time.Time `json:"added_at,omitzero"`
+	DeliveredAt time.Time `json:"delivered_at,omitzero"`
+}
+
+// AddTimings stores the timings known before the entry is added as millisecond fields of stream
+// entry values. The time of the XADD itself is the timestamp of the entry ID.
+func AddTimings(values map[string]any, timings Timings) {
+	for field, t := range map[string]time.Time{
+		"killmail_time": timings.KillmailTime,
+		"received_at":   timings.ReceivedAt,
+		"fetched_at":    timings.FetchedAt,
+	} {
+		if !t.IsZero() {
+			values[field] = t.UnixMilli()
+		}
+	}
+}
+
+// StreamTimings reads the timings of a stream entry, fields of entries written before timings were
+// recorded are left zero
+func StreamTimings(message redis.XMessage) Timings {
+	field := func(name string) time.Time {
+		raw, _ := message.Values[name].(string)
+
+		millis, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+
+		return time.UnixMilli(millis)
+	}
+
+	return Timings{
+		KillmailTime: field("killmail_time"),
+		ReceivedAt:   field("received_at"),
+		FetchedAt:    field("fetched_at"),
+		AddedAt:      StreamIDTime(message.ID),
+	}
+}
+
+// StreamIDTime returns the time a stream entry was added, taken from the millisecond part of its
+// ID. Invalid IDs return the zero time.
+func StreamIDTime(id string) time.Time {
+	rawMillis, _, _ := strings.Cut(id, "-")
+
+	millis, err := strconv.ParseInt(rawMillis, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis)
+}
+
+// CompareStreamIDs orders two stream IDs like Redis does, it returns -1, 0 or 1. A missing sequence
+// part counts as 0.
+func CompareStreamIDs(a string, b string) int {
+	aMillis, aSeq := splitStreamID(a)
+	bMillis, bSeq := splitStreamID(b)
+
+	if aMillis != bMillis {
+		return cmp.Compare(aMillis, bMillis)
+	}
+
+	return cmp.Compare(aSeq, bSeq)
+}
+
+func splitStreamID(id string) (uint64, uint64) {
+	rawMillis, rawSeq, _ := strings.Cut(id, "-")
+
+	millis, _ := strconv.ParseUint(rawMillis, 10, 64)
+	seq, _ := strconv.ParseUint(rawSeq, 10, 64)
+
+	return millis, seq
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"killfeed"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultTracesPath is where OTLP/HTTP collectors receive traces
+const defaultTracesPath = "/v1/traces"
+
+// propagator carries the W3C trace context, stream entries store it in traceparent and tracestate
+// fields so consumers can continue the trace of a killmail
+var propagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider of a service. Without an OTLP endpoint spans are not
+// recorded. The returned function flushes pending spans and must be called before exiting.
+func Setup(ctx context.Context, config killfeed.Config, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	if config.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := url.Parse(config.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = defaultTracesPath
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+		semconv.ServiceVersion(killfeed.Version),
+		semconv.DeploymentEnvironmentName(config.Environment),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TracingSampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of killfeed, it follows the global provider installed by Setup
+func Tracer() trace.Tracer {
+	return otel.Tracer("killfeed")
+}
+
+// Inject stores the trace context of ctx in the values of a stream entry
+func Inject(ctx context.Context, values map[string]any) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	for key, value := range carrier {
+		values[key] = value
+	}
+}
+
+// Extract returns a context continuing the trace stored in a stream entry
+func Extract(ctx context.Context, message redis.XMessage) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, key := range propagator.Fields() {
+		if value, ok := message.Values[key].(string); ok {
+			carrier[key] = value
+		}
+	}
+
+	return propagator.Extract(ctx, carrier)
+}
+
+// End ends a span, marking it as failed when err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,132 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"killfeed"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// collector stands in for an OpenTelemetry collector receiving OTLP/HTTP
+type collector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	body     string
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if r.URL.Path != defaultTracesPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		c.requests++
+		c.body += string(body)
+	}))
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func (c *collector) received() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.requests, c.body
+}
+
+func TestSetupExportsSpans(t *testing.T) {
+	collector := newCollector(t)
+	ctx := context.Background()
+
+	shutdown, err := Setup(ctx, killfeed.Config{OTLPEndpoint: collector.URL, TracingSampleRatio: 1, Environment: "test"}, "tracing-test")
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	_, span := Tracer().Start(ctx, "test.span")
+	span.End()
+
+	// Spans are exported in batches, shutting down flushes them
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	requests, body := collector.received()
+	if requests == 0 {
+		t.Fatal("no spans exported")
+	}
+
+	for _, expected := range []string{"test.span", "tracing-test"} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("export does not contain %q", expected)
+		}
+	}
+}
+
+func TestSetupSamplesNothingAtZeroRatio(t *testing.T) {
+	collector := newCollector(t)
+	ctx := context.Background()
+
+	shutdown, err := Setup(ctx, killfeed.Config{OTLPEndpoint: collector.URL, TracingSampleRatio: 0}, "tracing-test")
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	_, span := Tracer().Start(ctx, "test.span")
+	span.End()
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	if requests, _ := collector.received(); requests != 0 {
+		t.Fatalf("expected no exports, got %d", requests)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	values := map[string]any{"killmail": "{}"}
+	Inject(ctx, values)
+
+	extracted := trace.SpanContextFromContext(Extract(context.Background(), redis.XMessage{Values: values}))
+	if extracted.TraceID() != traceID || extracted.SpanID() != spanID || !extracted.IsSampled() {
+		t.Fatalf("trace context not carried through the entry: %+v", extracted)
+	}
+
+	// Entries added before tracing have no trace context
+	if trace.SpanContextFromContext(Extract(context.Background(), redis.XMessage{Values: map[string]any{}})).IsValid() {
+		t.Fatal("extracted a trace context from an entry without one")
+	}
+}